@@ -0,0 +1,237 @@
+package jssquish
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The kinds of archive a `Repository` can be built from. Everything but zip is
+// a tar file, possibly wrapped in a compression format.
+type archiveFormat uint8
+
+const (
+	formatTar archiveFormat = iota
+	formatGzip
+	formatBzip2
+	formatZstd
+	formatZip
+)
+
+func (af archiveFormat) String() string {
+	switch af {
+	case formatTar:
+		return "tar"
+	case formatGzip:
+		return "gzip"
+	case formatBzip2:
+		return "bzip2"
+	case formatZstd:
+		return "zstd"
+	case formatZip:
+		return "zip"
+	}
+	return fmt.Sprintf("archiveFormat(%d)", af)
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic   = []byte("PK\x03\x04")
+
+	// An empty zip file is nothing but its end of central directory record
+	zipEmptyMagic = []byte("PK\x05\x06")
+)
+
+// Sniffs the format of an archive by its leading magic bytes. Anything which
+// isn't recognized is assumed to be an uncompressed tar, which has its magic
+// buried in the first header (and no magic at all in its oldest form). The
+// tar reader will complain soon enough if that guess is wrong.
+func detectArchive(f *os.File) (archiveFormat, error) {
+	head := make([]byte, 4)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return formatTar, err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return formatGzip, nil
+	case bytes.HasPrefix(head, bzip2Magic):
+		return formatBzip2, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		return formatZstd, nil
+	case bytes.HasPrefix(head, zipMagic), bytes.HasPrefix(head, zipEmptyMagic):
+		return formatZip, nil
+	}
+	return formatTar, nil
+}
+
+// Opens the decompressed tar stream of an archive from its start. The returned
+// function releases any decompressor state, and should always be called.
+func openTarStream(f *os.File, format archiveFormat) (io.Reader, func(),
+	error) {
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	switch format {
+	case formatTar:
+		return f, func() {}, nil
+
+	case formatGzip:
+		gzf, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gzf, func() { gzf.Close() }, nil
+
+	case formatBzip2:
+		return bzip2.NewReader(f), func() {}, nil
+
+	case formatZstd:
+		zf, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zf, zf.Close, nil
+	}
+	return nil, nil, fmt.Errorf("Not a tar stream: %s", format)
+}
+
+type tarFlowControl uint8
+
+func (tarFlowControl) Error() string {
+	return "Stop Iteration"
+}
+
+const stopIteration = tarFlowControl(0)
+
+// Iterate over an archive, invoking each function as a file is encountered.
+// The format is detected from the file's contents, and zip entries are
+// presented with synthesized tar headers so callers need only deal with one
+// shape of metadata. To abort iteration, the function can return the above
+// defined `stopIteration` error value.
+// Because the tar reading implementation is serial and stateful, It is not safe
+// to call this function with the same file concurrently.
+func iterateArchive(f *os.File, each func(*tar.Header, os.FileInfo,
+	io.Reader) error) error {
+
+	format, err := detectArchive(f)
+	if err != nil {
+		return err
+	}
+	if format == formatZip {
+		return iterateZip(f, each)
+	}
+
+	stream, release, err := openTarStream(f, format)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = each(hdr, hdr.FileInfo(), tr)
+		if err == stopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func iterateZip(f *os.File, each func(*tar.Header, os.FileInfo,
+	io.Reader) error) error {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		hdr, err := zipHeader(zf)
+		if err != nil {
+			return err
+		}
+
+		var r io.ReadCloser
+		if hdr.Typeflag == tar.TypeReg {
+			if r, err = zf.Open(); err != nil {
+				return err
+			}
+		} else {
+			r = ioutil.NopCloser(bytes.NewReader(nil))
+		}
+
+		err = each(hdr, hdr.FileInfo(), r)
+		r.Close()
+		if err == stopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describes a zip entry as a tar header. Zip stores a symlink's target as the
+// entry's contents, so it's read into `Linkname` here.
+func zipHeader(zf *zip.File) (*tar.Header, error) {
+	mode := zf.Mode()
+	hdr := &tar.Header{
+		Name:    zf.Name,
+		Mode:    int64(mode.Perm()),
+		ModTime: zf.Modified,
+	}
+
+	switch {
+	case mode.IsDir() || strings.HasSuffix(zf.Name, "/"):
+		hdr.Typeflag = tar.TypeDir
+
+	case mode&os.ModeSymlink != 0:
+		r, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		target, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(zf.UncompressedSize64)
+	}
+	return hdr, nil
+}
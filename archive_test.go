@@ -0,0 +1,227 @@
+package jssquish
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// `a.js` and `lib/b.js` containing "a" and "b", tarred and run through the
+// bzip2 command line tool, as there's no bzip2 writer in the standard library.
+const bzip2Fixture = `
+QlpoOTFBWSZTWTdgK3MAAKR7kMkAAEJAAf8AAERwNJ4ABAAACCAAkoSqekZqBoBp6mjIFSkjNTQD
+0h6g0Ph+1cGLZAvfCsglrZMFDVuWUZFaJDBFJM86dG1JooJe9VlEc16qtFGLlAE7Q3Hio4QvIPUs
+rKQ5p/TFYKAxyalCrE+vzNIfxdyRThQkDdgK3MA=`
+
+// Writes the given files into an uncompressed tar stream
+func writeTar(w io.Writer, files map[string]string) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		}
+		Expect(tw.WriteHeader(hdr)).To(Succeed())
+		_, err := tw.Write([]byte(files[name]))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+}
+
+// Loads the given files straight into a `MemoryRepository`
+func memoryRepository(files map[string]string) MemoryRepository {
+	repo := make(MemoryRepository, len(files))
+	for name, src := range files {
+		repo[filepath.Clean(name)] = bytes.NewBufferString(src)
+	}
+	return repo
+}
+
+// Creates a temporary file containing the given files in the requested format.
+// It's up to the caller to remove it.
+func archiveFile(format archiveFormat, files map[string]string) *os.File {
+	f, err := ioutil.TempFile("", "js-squish-archive")
+	Expect(err).ToNot(HaveOccurred())
+
+	switch format {
+	case formatTar:
+		writeTar(f, files)
+
+	case formatGzip:
+		gzf := gzip.NewWriter(f)
+		writeTar(gzf, files)
+		Expect(gzf.Close()).To(Succeed())
+
+	case formatZstd:
+		zf, err := zstd.NewWriter(f)
+		Expect(err).ToNot(HaveOccurred())
+		writeTar(zf, files)
+		Expect(zf.Close()).To(Succeed())
+
+	case formatZip:
+		zw := zip.NewWriter(f)
+		for name, src := range files {
+			w, err := zw.Create(name)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = w.Write([]byte(src))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := zw.Create("lib/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(zw.Close()).To(Succeed())
+
+	case formatBzip2:
+		Expect(files).To(Equal(map[string]string{"a.js": "a", "lib/b.js": "b"}))
+		bs, err := base64.StdEncoding.DecodeString(bzip2Fixture)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.Write(bs)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	return f
+}
+
+var _ = Describe("Archives", func() {
+
+	files := map[string]string{
+		"a.js":     "a",
+		"lib/b.js": "b",
+	}
+
+	contents := func(repo Repository, path string) string {
+		r, err := repo.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		return string(bs)
+	}
+
+	formats := []archiveFormat{
+		formatTar,
+		formatGzip,
+		formatBzip2,
+		formatZstd,
+		formatZip,
+	}
+
+	for _, format := range formats {
+		format := format
+
+		Describe(format.String(), func() {
+
+			var f *os.File
+
+			BeforeEach(func() {
+				f = archiveFile(format, files)
+			})
+
+			AfterEach(func() {
+				f.Close()
+				os.Remove(f.Name())
+			})
+
+			It("should be detected", func() {
+				detected, err := detectArchive(f)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(detected).To(Equal(format))
+			})
+
+			It("should load into memory", func() {
+				repo, err := NewMemoryJsTarRepository(f)
+				Expect(err).ToNot(HaveOccurred())
+				defer repo.Close()
+
+				Expect(repo.IsFile("lib")).To(BeFalse())
+				Expect(contents(repo, "a.js")).To(Equal("a"))
+				Expect(contents(repo, "lib/b.js")).To(Equal("b"))
+
+				// Reading a file doesn't use it up
+				Expect(contents(repo, "a.js")).To(Equal("a"))
+			})
+
+			It("should index for reading on demand", func() {
+				repo, err := NewIndexedJsTarRepository(f, 1)
+				Expect(err).ToNot(HaveOccurred())
+				defer repo.Close()
+
+				// Read out of archive order, and repeatedly, so compressed archives
+				// have to be read from the top more than once.
+				Expect(repo.IsFile("lib")).To(BeFalse())
+				Expect(contents(repo, "lib/b.js")).To(Equal("b"))
+				Expect(contents(repo, "a.js")).To(Equal("a"))
+				Expect(contents(repo, "lib/b.js")).To(Equal("b"))
+				Expect(contents(repo, "a.js")).To(Equal("a"))
+			})
+
+			It("should expand to disk", func() {
+				repo, err := NewDiskJsTarRepository(f)
+				Expect(err).ToNot(HaveOccurred())
+				defer repo.Close()
+
+				Expect(contents(repo, "a.js")).To(Equal("a"))
+				Expect(contents(repo, "lib/b.js")).To(Equal("b"))
+			})
+		})
+	}
+
+	It("should reject garbage", func() {
+		f, err := ioutil.TempFile("", "js-squish-archive")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		_, err = f.Write(bytes.Repeat([]byte("not a tar"), 100))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = NewMemoryJsTarRepository(f)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("LRU cache", func() {
+
+	It("should evict the least recently used contents", func() {
+		cache := newLRUCache(6)
+		cache.Put("a", []byte("aa"))
+		cache.Put("b", []byte("bb"))
+		cache.Put("c", []byte("cc"))
+
+		_, ok := cache.Get("a")
+		Expect(ok).To(BeTrue())
+
+		cache.Put("d", []byte("dd"))
+		_, ok = cache.Get("b")
+		Expect(ok).To(BeFalse())
+
+		for _, key := range []string{"a", "c", "d"} {
+			_, ok := cache.Get(key)
+			Expect(ok).To(BeTrue())
+		}
+	})
+
+	It("should not keep contents larger than itself", func() {
+		cache := newLRUCache(2)
+		cache.Put("big", []byte("big"))
+		_, ok := cache.Get("big")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -42,9 +42,10 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 		return fmt.Errorf("ast.WalkNode can't handle %T: %#v", node, node)
 
 	case *ast.ArrayLiteral:
+		// Elisions (`[a,,b]`) show up as nil elements
 		for _, expr := range t.Value {
-			if err := next(expr); err != nil {
-				return nil
+			if err := nextIfNotNil(expr); err != nil {
+				return err
 			}
 		}
 
@@ -59,7 +60,7 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 
 	case *ast.BinaryExpression:
 		if err := next(t.Left); err != nil {
-			return nil
+			return err
 		}
 		return next(t.Right)
 
@@ -79,7 +80,9 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 		return next(t.Member)
 
 	case *ast.BranchStatement:
-		return nextIfNotNil(t.Label)
+		if t.Label != nil {
+			return next(t.Label)
+		}
 
 	case *ast.CallExpression:
 		if err := next(t.Callee); err != nil {
@@ -92,8 +95,9 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 		}
 
 	case *ast.CaseStatement:
-		if err := next(t.Test); err != nil {
-			return nil
+		// The `default` case has no test
+		if err := nextIfNotNil(t.Test); err != nil {
+			return err
 		}
 		for _, stmt := range t.Consequent {
 			if err := next(stmt); err != nil {
@@ -102,8 +106,10 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 		}
 
 	case *ast.CatchStatement:
-		if err := nextIfNotNil(t.Parameter); err != nil {
-			return err
+		if t.Parameter != nil {
+			if err := next(t.Parameter); err != nil {
+				return err
+			}
 		}
 		return next(t.Body)
 
@@ -130,7 +136,7 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 		if err := next(t.Left); err != nil {
 			return err
 		}
-		return nextIfNotNil(t.Identifier)
+		return next(t.Identifier)
 
 	case *ast.EmptyExpression:
 
@@ -141,28 +147,32 @@ func walkNode(v Visitor, node ast.Node, depth int) error {
 
 	case *ast.ForInStatement:
 		if err := next(t.Into); err != nil {
-			return nil
+			return err
 		}
 		if err := next(t.Source); err != nil {
-			return nil
+			return err
 		}
 		return next(t.Body)
 
 	case *ast.ForStatement:
-		if err := next(t.Initializer); err != nil {
-			return nil
+		// Any of the three clauses may be omitted, as in `for (;;)`
+		if err := nextIfNotNil(t.Initializer); err != nil {
+			return err
 		}
-		if err := next(t.Update); err != nil {
-			return nil
+		if err := nextIfNotNil(t.Update); err != nil {
+			return err
 		}
-		if err := next(t.Test); err != nil {
-			return nil
+		if err := nextIfNotNil(t.Test); err != nil {
+			return err
 		}
 		return next(t.Body)
 
 	case *ast.FunctionLiteral:
-		if err := nextIfNotNil(t.Name); err != nil {
-			return err
+		// Careful not to hand a typed nil `*ast.Identifier` to the visitor
+		if t.Name != nil {
+			if err := next(t.Name); err != nil {
+				return err
+			}
 		}
 		return next(t.Body)
 
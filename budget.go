@@ -0,0 +1,144 @@
+package jssquish
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Limits on how big a bundle may get, in bytes. Zero means no limit.
+type Budget struct {
+	Size    int
+	Gzipped int
+
+	// Limits on the raw size of packages, by name. See `NewStats` for what
+	// belongs to a package.
+	Packages map[string]int
+}
+
+// A bundle over its budget. The message says which limits were exceeded, and
+// what's taking up the most room.
+type BudgetError struct {
+	// One line for each limit exceeded
+	Exceeded []string
+
+	report string
+}
+
+func (be *BudgetError) Error() string {
+	return be.report
+}
+
+// How many of the largest packages and modules an over budget report lists
+const budgetReportLength = 10
+
+// Checks a bundle against its budget, giving a `*BudgetError` if it's over
+func (s *Stats) CheckBudget(budget Budget) error {
+	var exceeded []string
+	if budget.Size > 0 && s.Size > budget.Size {
+		exceeded = append(exceeded, fmt.Sprintf("size %s is over the limit of %s",
+			FormatSize(s.Size), FormatSize(budget.Size)))
+	}
+	if budget.Gzipped > 0 && s.Gzipped > budget.Gzipped {
+		exceeded = append(exceeded, fmt.Sprintf(
+			"gzipped size %s is over the limit of %s",
+			FormatSize(s.Gzipped), FormatSize(budget.Gzipped)))
+	}
+
+	packages := make([]string, 0, len(budget.Packages))
+	for pkg := range budget.Packages {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+	for _, pkg := range packages {
+		limit := budget.Packages[pkg]
+		for _, ps := range s.Packages {
+			if ps.Package == pkg && ps.Raw > limit {
+				exceeded = append(exceeded, fmt.Sprintf(
+					"package %s is %s, over its limit of %s",
+					pkg, FormatSize(ps.Raw), FormatSize(limit)))
+			}
+		}
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+	return &BudgetError{exceeded, s.budgetReport(exceeded)}
+}
+
+func (s *Stats) budgetReport(exceeded []string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("bundle is over budget:\n")
+	for _, line := range exceeded {
+		fmt.Fprintf(buf, "  %s\n", line)
+	}
+
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "largest packages:\traw\tgzipped\tmodules")
+	for i, ps := range s.Packages {
+		if i == budgetReportLength {
+			break
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\n", ps.Package, FormatSize(ps.Raw),
+			FormatSize(ps.Gzipped), ps.Modules)
+	}
+	tw.Flush()
+
+	tw = tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "largest modules:\traw\tgzipped")
+	for i, ms := range s.Modules {
+		if i == budgetReportLength {
+			break
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", ms.Path, FormatSize(ms.Raw),
+			FormatSize(ms.Gzipped))
+	}
+	tw.Flush()
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Gives a size in bytes, KB or MB, whichever reads best
+func FormatSize(size int) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%.2f MB", float64(size)/1024/1024)
+	}
+}
+
+// Reads a size, which is a number of bytes, or of kilobytes or megabytes with
+// a `KB` or `MB` suffix, such as "300KB" or "1.5MB"
+func ParseSize(s string) (int, error) {
+	text, unit := strings.ToUpper(strings.TrimSpace(s)), 1.0
+	for _, suffix := range []struct {
+		suffix string
+		unit   float64
+	}{{"KB", 1024}, {"MB", 1024 * 1024}, {"B", 1}} {
+		if strings.HasSuffix(text, suffix.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, suffix.suffix))
+			unit = suffix.unit
+			break
+		}
+	}
+
+	// Infinities, NaN and sizes too big for an int can all be parsed, but would
+	// give a size which isn't a limit at all
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || n*unit >= maxSize {
+		return 0, errors.New("invalid size " + strconv.Quote(s))
+	}
+	return int(n * unit), nil
+}
+
+// One more than the biggest size `ParseSize` gives
+const maxSize = float64(int(^uint(0)>>1)) + 1
@@ -0,0 +1,76 @@
+package jssquish
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Budget", func() {
+
+	stats := &Stats{
+		Size:    300 * 1024,
+		Gzipped: 90 * 1024,
+		Packages: []PackageStats{
+			{Package: "lodash", Modules: 40, Sizes: Sizes{Raw: 200 * 1024}},
+			{Package: ".", Modules: 3, Sizes: Sizes{Raw: 100 * 1024}},
+		},
+		Modules: []ModuleStats{
+			{Path: "lodash/lodash.js", Package: "lodash",
+				Sizes: Sizes{Raw: 150 * 1024}},
+			{Path: "index.js", Package: ".", Sizes: Sizes{Raw: 80 * 1024}},
+		},
+	}
+
+	It("should pass a bundle within its budget", func() {
+		Expect(stats.CheckBudget(Budget{})).To(Succeed())
+		Expect(stats.CheckBudget(Budget{
+			Size:     300 * 1024,
+			Gzipped:  100 * 1024,
+			Packages: map[string]int{"lodash": 200 * 1024, "react": 1},
+		})).To(Succeed())
+	})
+
+	It("should say which limits were exceeded, and what's biggest", func() {
+		err := stats.CheckBudget(Budget{
+			Size:     250 * 1024,
+			Gzipped:  80 * 1024,
+			Packages: map[string]int{"lodash": 50 * 1024, ".": 100 * 1024},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*BudgetError).Exceeded).To(Equal([]string{
+			"size 300.0 KB is over the limit of 250.0 KB",
+			"gzipped size 90.0 KB is over the limit of 80.0 KB",
+			"package lodash is 200.0 KB, over its limit of 50.0 KB",
+		}))
+		Expect(err.Error()).To(HavePrefix("bundle is over budget:\n" +
+			"  size 300.0 KB is over the limit of 250.0 KB\n"))
+		Expect(err.Error()).To(MatchRegexp(
+			`largest packages:.*\n +lodash +200\.0 KB +0 B +40\n +\. +100\.0 KB`))
+		Expect(err.Error()).To(MatchRegexp(
+			`largest modules:.*\n +lodash/lodash\.js +150\.0 KB`))
+	})
+
+	It("should read sizes in bytes, kilobytes and megabytes", func() {
+		for text, size := range map[string]int{
+			"1000":    1000,
+			"300KB":   300 * 1024,
+			"300 kb":  300 * 1024,
+			"1.5MB":   1536 * 1024,
+			"12B":     12,
+			" 2 MB  ": 2 * 1024 * 1024,
+		} {
+			Expect(ParseSize(text)).To(Equal(size), text)
+		}
+		for _, text := range []string{"", "KB", "-1", "1GB", "lots", "inf",
+			"-Inf", "NaN", "1e30", "1e30KB", "9223372036854775807"} {
+			_, err := ParseSize(text)
+			Expect(err).To(HaveOccurred(), text)
+		}
+	})
+
+	It("should format sizes", func() {
+		Expect(FormatSize(512)).To(Equal("512 B"))
+		Expect(FormatSize(1536)).To(Equal("1.5 KB"))
+		Expect(FormatSize(3 * 1024 * 1024)).To(Equal("3.00 MB"))
+	})
+})
@@ -0,0 +1,240 @@
+package jssquish
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/robertkrimen/otto/ast"
+)
+
+// What's kept of a module between builds. This is everything reading a file
+// works out, short of its parsed program.
+type cachedModule struct {
+	Requires []string `json:"requires"`
+
+	// For an ES module, its lowered source and exports
+	ESM     bool           `json:"esm,omitempty"`
+	Src     string         `json:"src,omitempty"`
+	Exports []cachedExport `json:"exports,omitempty"`
+}
+
+type cachedExport struct {
+	Name  string `json:"name"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// What the built in transforms gave a file
+type cachedSource struct {
+	Src string `json:"src"`
+}
+
+// An on-disk cache of modules, keyed by a hash of their contents. Anything
+// else which changes how a file is read, such as the version of js-squish, goes
+// into every key, so a stale entry is never found rather than needing to be
+// removed. It's safe for concurrent use.
+type buildCache struct {
+	dir  string
+	salt string
+}
+
+func newBuildCache(dir string) (*buildCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &buildCache{dir: dir, salt: cacheSalt}, nil
+}
+
+// Goes into every cache key
+const cacheSalt = "js-squish " + Version
+
+func (bc *buildCache) key(src []byte) string {
+	return contentKey(bc.salt, src)
+}
+
+func contentKey(salt string, src []byte) string {
+	h := sha256.New()
+	h.Write([]byte(salt))
+	h.Write([]byte{0})
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (bc *buildCache) path(key string) string {
+	return filepath.Join(bc.dir, key[:2], key[2:]+".json")
+}
+
+// Finds a module in the cache. Entries which can't be read are misses.
+func (bc *buildCache) Get(key string) (*cachedModule, bool) {
+	cm := &cachedModule{}
+	if !bc.get(key, cm) {
+		return nil, false
+	}
+	return cm, true
+}
+
+// Finds what the built in transforms gave a file
+func (bc *buildCache) GetSource(key string) ([]byte, bool) {
+	cs := &cachedSource{}
+	if !bc.get(key, cs) {
+		return nil, false
+	}
+	return []byte(cs.Src), true
+}
+
+func (bc *buildCache) get(key string, entry interface{}) bool {
+	bs, err := ioutil.ReadFile(bc.path(key))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(bs, entry) == nil
+}
+
+// Adds a module to the cache. Failing to shouldn't fail the build, so errors
+// are only logged. Entries are written to a temporary file and renamed into
+// place, so a concurrent build never sees half of one.
+func (bc *buildCache) Put(key string, cm *cachedModule) {
+	if err := bc.put(key, cm); err != nil {
+		log.Printf("not caching: %s", err)
+	}
+}
+
+// Adds what the built in transforms gave a file, as `Put` adds a module
+func (bc *buildCache) PutSource(key string, src []byte) {
+	if err := bc.put(key, &cachedSource{string(src)}); err != nil {
+		log.Printf("not caching: %s", err)
+	}
+}
+
+func (bc *buildCache) put(key string, entry interface{}) error {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := bc.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// An in-memory cache of parsed modules, keyed by a hash of their contents, for
+// a process which builds many bundles, such as a persistent worker. Parsed
+// programs are kept too, so a module found here is never parsed again, as is
+// what the built in transforms gave each file. Each call to `Prune` ends a
+// build, and modules no build has used for a while are forgotten. It's safe
+// for concurrent use.
+type ParseCache struct {
+	mu      sync.Mutex
+	build   int
+	modules map[string]*parsedModule
+	sources map[string]*transformedSource
+}
+
+type parsedModule struct {
+	module  *cachedModule
+	program *ast.Program
+	used    int
+}
+
+type transformedSource struct {
+	src  []byte
+	used int
+}
+
+func NewParseCache() *ParseCache {
+	return &ParseCache{
+		modules: make(map[string]*parsedModule),
+		sources: make(map[string]*transformedSource),
+	}
+}
+
+func (pc *ParseCache) key(src []byte) string {
+	return contentKey(cacheSalt, src)
+}
+
+// Finds a module, and its program if it's been parsed
+func (pc *ParseCache) Get(key string) (*cachedModule, *ast.Program, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pm, ok := pc.modules[key]
+	if !ok {
+		return nil, nil, false
+	}
+	pm.used = pc.build
+	return pm.module, pm.program, true
+}
+
+// Adds a module, replacing any there already. The program may be nil.
+func (pc *ParseCache) Put(key string, cm *cachedModule, program *ast.Program) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.modules[key] = &parsedModule{cm, program, pc.build}
+}
+
+// Finds what the built in transforms gave a file
+func (pc *ParseCache) GetSource(key string) ([]byte, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	ts, ok := pc.sources[key]
+	if !ok {
+		return nil, false
+	}
+	ts.used = pc.build
+	return ts.src, true
+}
+
+// Adds what the built in transforms gave a file
+func (pc *ParseCache) PutSource(key string, src []byte) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.sources[key] = &transformedSource{src, pc.build}
+}
+
+// Ends a build, forgetting modules and sources which weren't used by it or by
+// any of the `keep` builds before it.
+func (pc *ParseCache) Prune(keep int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for key, pm := range pc.modules {
+		if pc.build-pm.used > keep {
+			delete(pc.modules, key)
+		}
+	}
+	for key, ts := range pc.sources {
+		if pc.build-ts.used > keep {
+			delete(pc.sources, key)
+		}
+	}
+	pc.build++
+}
+
+// How many modules are cached
+func (pc *ParseCache) Len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.modules)
+}
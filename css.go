@@ -0,0 +1,262 @@
+package jssquish
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	pth "path"
+	"regexp"
+	"strings"
+)
+
+// Writes the CSS extracted from a bundle, as one stylesheet
+type cssWriter struct {
+	w io.Writer
+
+	// The directory the stylesheet is written to, relative to the root of the
+	// repository
+	dir string
+
+	sourceMapOut io.Writer
+	sourceMapURL string
+}
+
+// Creates a `cssWriter` for the stylesheet the options ask for, or nil if they
+// don't ask for one
+func newCSSWriter(opts Options) *cssWriter {
+	if opts.CSS == nil {
+		return nil
+	}
+	dir := pth.Clean(opts.CSSDir)
+	if dir == "/" {
+		dir = "."
+	}
+	return &cssWriter{
+		w:            opts.CSS,
+		dir:          strings.TrimPrefix(dir, "/"),
+		sourceMapOut: opts.CSSSourceMap,
+		sourceMapURL: opts.CSSSourceMapURL,
+	}
+}
+
+// A `url()` in CSS, with the URL quoted either way or not at all
+var cssURL = regexp.MustCompile(
+	`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`)
+
+// URLs which aren't relative to the stylesheet they're in, such as
+// `https://...`, `data:...`, `//host/...`, `/path` and `#fragment`
+var cssAbsoluteURL = regexp.MustCompile(`^(?:[a-zA-Z][a-zA-Z0-9+.-]*:|/|#|$)`)
+
+// Writes each stylesheet, in the order given, along with a source map if one
+// was asked for. Each is mapped line by line, as the JavaScript of a bundle
+// which isn't minified is. Browsers ignore an `@import` anywhere but the start
+// of a stylesheet, so those each stylesheet starts with are moved to the start
+// of the one written, in the same order.
+func (cw *cssWriter) Write(sheets []*srcEntry) error {
+	out := &bytes.Buffer{}
+	var sm *sourceMap
+	if cw.sourceMapOut != nil {
+		sm = newSourceMap("")
+	}
+
+	sources := make([]int, len(sheets))
+	rests := make([][]byte, len(sheets))
+	line := 0
+	for i, sheet := range sheets {
+		if sm != nil {
+			sources[i] = sm.AddSource(sheet.path, sheet.css)
+		}
+		imports, rest := splitImports(sheet.css)
+		for _, imp := range imports {
+			rule := cw.rewriteImport(sheet.path, imp.rule)
+			if sm != nil {
+				sm.AddMapping(line, 0, sources[i], imp.line, 0, "")
+			}
+			out.Write(rule)
+			out.WriteByte('\n')
+			line += bytes.Count(rule, []byte("\n")) + 1
+		}
+		rests[i] = rest
+	}
+
+	for i, sheet := range sheets {
+		css := bytes.TrimSuffix(cw.rewriteURLs(sheet.path, rests[i]),
+			[]byte("\n"))
+		if sm != nil {
+			sm.AddLines(line, sources[i], css)
+		}
+		out.Write(css)
+		out.WriteByte('\n')
+		line += bytes.Count(css, []byte("\n")) + 1
+	}
+
+	if sm != nil && cw.sourceMapURL != "" {
+		fmt.Fprintf(out, "/*# sourceMappingURL=%s */\n", cw.sourceMapURL)
+	}
+	if _, err := out.WriteTo(cw.w); err != nil {
+		return err
+	}
+	if sm != nil {
+		_, err := sm.WriteTo(cw.sourceMapOut)
+		return err
+	}
+	return nil
+}
+
+// An `@import` rule from the start of a stylesheet, and the line it was on
+type cssImport struct {
+	rule []byte
+	line int
+}
+
+// Takes the `@import` rules from the start of a stylesheet, past any
+// whitespace, comments and `@charset`. What's left keeps the line breaks of
+// each rule taken, so every line stays where it was.
+func splitImports(css []byte) ([]cssImport, []byte) {
+	var imports []cssImport
+	var rest []byte
+
+	pos, kept := 0, 0
+scan:
+	for pos < len(css) {
+		switch c := css[pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			pos++
+		case bytes.HasPrefix(css[pos:], []byte("/*")):
+			end := bytes.Index(css[pos+2:], []byte("*/"))
+			if end < 0 {
+				break scan
+			}
+			pos += end + 4
+		case hasAtRule(css[pos:], "@charset"):
+			pos = cssRuleEnd(css, pos)
+		case hasAtRule(css[pos:], "@import"):
+			end := cssRuleEnd(css, pos)
+			imports = append(imports, cssImport{
+				rule: css[pos:end],
+				line: bytes.Count(css[:pos], []byte("\n")),
+			})
+			rest = append(rest, css[kept:pos]...)
+			rest = append(rest, bytes.Repeat([]byte("\n"),
+				bytes.Count(css[pos:end], []byte("\n")))...)
+			pos, kept = end, end
+		default:
+			break scan
+		}
+	}
+	return imports, append(rest, css[kept:]...)
+}
+
+// Whether `css` starts with the at-rule `name`, in any case
+func hasAtRule(css []byte, name string) bool {
+	if len(css) <= len(name) || !bytes.EqualFold(css[:len(name)], []byte(name)) {
+		return false
+	}
+	c := css[len(name)]
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '"' ||
+		c == '\'' || c == ';'
+}
+
+// Where the statement at-rule starting at `pos` ends, just past its semicolon,
+// skipping over any in quotes
+func cssRuleEnd(css []byte, pos int) int {
+	var quote byte
+	for ; pos < len(css); pos++ {
+		switch c := css[pos]; {
+		case quote != 0 && c == '\\':
+			pos++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return pos + 1
+		}
+	}
+	return pos
+}
+
+// The `@import` of a string, rather than a `url()`
+var cssImportString = regexp.MustCompile(
+	`^(?i:@import)(\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// Rewrites the URL of an `@import` rule from the stylesheet at `path`, as
+// `rewriteURLs` does
+func (cw *cssWriter) rewriteImport(path string, rule []byte) []byte {
+	groups := cssImportString.FindSubmatchIndex(rule)
+	if groups == nil {
+		return cw.rewriteURLs(path, rule)
+	}
+	quote, url := `"`, groups[4:6]
+	if groups[4] < 0 {
+		quote, url = `'`, groups[6:8]
+	}
+	return []byte(string(rule[:groups[3]]) + quote +
+		cw.rewriteURL(path, string(rule[url[0]:url[1]])) + quote +
+		string(rule[groups[1]:]))
+}
+
+// Rewrites the relative `url()`s of the stylesheet at `path`, which are
+// relative to it, to be relative to where the stylesheet is written
+func (cw *cssWriter) rewriteURLs(path string, css []byte) []byte {
+	return cssURL.ReplaceAllFunc(css, func(match []byte) []byte {
+		groups := cssURL.FindSubmatch(match)
+		quote, url := "", ""
+		switch {
+		case groups[1] != nil:
+			quote, url = `"`, string(groups[1])
+		case groups[2] != nil:
+			quote, url = `'`, string(groups[2])
+		default:
+			url = string(groups[3])
+		}
+		if cssAbsoluteURL.MatchString(url) {
+			return match
+		}
+		return []byte("url(" + quote + cw.rewriteURL(path, url) + quote + ")")
+	})
+}
+
+// Rewrites a URL from the stylesheet at `path` to be relative to where the
+// stylesheet is written, unless it's absolute. Any query or fragment is kept
+// as it is.
+func (cw *cssWriter) rewriteURL(path, url string) string {
+	if cssAbsoluteURL.MatchString(url) {
+		return url
+	}
+	suffix := ""
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url, suffix = url[:i], url[i:]
+	}
+	target := pth.Join(pth.Dir(path), url)
+	return relativePath(cw.dir, target) + suffix
+}
+
+// The path to `to` from the directory `from`, both relative to the same root
+func relativePath(from, to string) string {
+	split := func(path string) []string {
+		if path = pth.Clean(path); path == "." {
+			return nil
+		}
+		return strings.Split(path, "/")
+	}
+	fromParts, toParts := split(from), split(to)
+
+	common := 0
+	for common < len(fromParts) && common < len(toParts) &&
+		fromParts[common] == toParts[common] {
+		common++
+	}
+
+	var parts []string
+	for range fromParts[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, toParts[common:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,117 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Extracting CSS", func() {
+
+	files := map[string]string{
+		"index.js": "var a = require('./a'); result = [a," +
+			" require('./styles/app.css')]",
+		"a.js":           "require('./styles/base.css'); module.exports = 'a'",
+		"styles/app.css": "body { background: url(img/bg.png) }\n",
+		"styles/base.css": "@font-face { src: url('../fonts/f.woff2?v=1') }\n" +
+			"a { background: url(\"data:image/png;base64,AA==\") }\n" +
+			"b { background: url(/abs.png), url(https://x.com/y.png) }",
+	}
+
+	build := func(opts Options) (*BuildResult, string) {
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		result, err := Build(repo, "index.js", out, opts)
+		Expect(err).ToNot(HaveOccurred())
+		return result, out.String()
+	}
+
+	It("should write stylesheets in the order they're required", func() {
+		css := &bytes.Buffer{}
+		result, bundle := build(Options{CSS: css, CSSDir: "dist"})
+		Expect(result.Stylesheets).To(Equal([]string{"styles/base.css",
+			"styles/app.css"}))
+		Expect(css.String()).To(Equal(
+			"@font-face { src: url('../fonts/f.woff2?v=1') }\n" +
+				"a { background: url(\"data:image/png;base64,AA==\") }\n" +
+				"b { background: url(/abs.png), url(https://x.com/y.png) }\n" +
+				"body { background: url(../styles/img/bg.png) }\n"))
+
+		Expect(bundle).ToNot(ContainSubstring(styleHelper))
+		vm := otto.New()
+		_, err := vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result[0] + ' ' + typeof result[1]")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("a object"))
+	})
+
+	It("should keep stylesheets out of the bundle when tree shaking", func() {
+		css := &bytes.Buffer{}
+		result, _ := build(Options{CSS: css, TreeShake: true, ScopeHoist: true,
+			Minify: true})
+		Expect(result.Stylesheets).To(Equal([]string{"styles/base.css",
+			"styles/app.css"}))
+		Expect(css.String()).To(ContainSubstring(
+			"url('fonts/f.woff2?v=1')"))
+	})
+
+	It("should write a source map of the stylesheet", func() {
+		css, sourceMap := &bytes.Buffer{}, &bytes.Buffer{}
+		build(Options{CSS: css, CSSSourceMap: sourceMap,
+			CSSSourceMapURL: "app.css.map"})
+		Expect(css.String()).To(HaveSuffix(
+			"url(styles/img/bg.png) }\n/*# sourceMappingURL=app.css.map */\n"))
+
+		var parsed struct {
+			Sources        []string
+			SourcesContent []string
+			Mappings       string
+		}
+		Expect(json.Unmarshal(sourceMap.Bytes(), &parsed)).To(Succeed())
+		Expect(parsed.Sources).To(Equal([]string{"styles/base.css",
+			"styles/app.css"}))
+		Expect(parsed.SourcesContent[1]).To(Equal(files["styles/app.css"]))
+		Expect(parsed.Mappings).To(Equal("AAAA;AACA;AACA;ACFA"))
+	})
+
+	It("should move each stylesheet's imports to the start", func() {
+		repo := memoryRepository(map[string]string{
+			"index.js": "require('./a.css'); require('./styles/b.css')",
+			"a.css":    "a { color: red }\n",
+			"styles/b.css": "/* b */\n@charset \"utf-8\";\n" +
+				"@import \"base.css\" screen;\n" +
+				"@IMPORT url(../theme.css?v=2);\n" +
+				"b { content: \"@import 'x';\" }\n",
+		})
+		defer repo.Close()
+
+		css, sourceMap := &bytes.Buffer{}, &bytes.Buffer{}
+		_, err := Build(repo, "index.js", &bytes.Buffer{}, Options{
+			CSS: css, CSSSourceMap: sourceMap})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(css.String()).To(Equal(
+			"@import \"styles/base.css\" screen;\n" +
+				"@IMPORT url(theme.css?v=2);\n" +
+				"a { color: red }\n" +
+				"/* b */\n@charset \"utf-8\";\n\n\n" +
+				"b { content: \"@import 'x';\" }\n"))
+
+		var parsed struct{ Mappings string }
+		Expect(json.Unmarshal(sourceMap.Bytes(), &parsed)).To(Succeed())
+		Expect(parsed.Mappings).To(Equal(
+			"ACEA;AACA;ADHA;ACAA;AACA;AACA;AACA;AACA"))
+	})
+
+	It("should find the path between directories", func() {
+		Expect(relativePath(".", "a/b.png")).To(Equal("a/b.png"))
+		Expect(relativePath("dist", "a/b.png")).To(Equal("../a/b.png"))
+		Expect(relativePath("a/c", "a/b.png")).To(Equal("../b.png"))
+		Expect(relativePath("a", "a")).To(Equal("."))
+	})
+})
@@ -0,0 +1,352 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	pth "path"
+	"sort"
+)
+
+// More than one copy of something in a bundle: either a package at different
+// versions, or modules with identical contents at different paths
+type Duplicate struct {
+	// The name of the package, for copies of a package. Empty for modules with
+	// identical contents.
+	Package string
+
+	// Ordered by path
+	Copies []DuplicateCopy
+
+	// For modules with identical contents which were written only once, the
+	// path of the one which was, and which every require of any of them gives
+	DedupedTo string
+}
+
+type DuplicateCopy struct {
+	// The package's directory, or the module's path
+	Path string
+
+	// The package's version, from its package.json
+	Version string
+
+	// The shortest chain of requires from the entrypoint to the copy. For a
+	// package, this is the chain to the closest of its modules.
+	Chain []RequireHop
+}
+
+// A warning about the duplicate, with how each copy was reached
+func (d Duplicate) String() string {
+	buf := &bytes.Buffer{}
+	if d.Package != "" {
+		fmt.Fprintf(buf, "%d versions of package %s are bundled:",
+			len(d.Copies), d.Package)
+	} else {
+		fmt.Fprintf(buf, "%d modules with identical contents are bundled",
+			len(d.Copies))
+		if d.DedupedTo != "" {
+			fmt.Fprintf(buf, " (deduped to %s)", d.DedupedTo)
+		}
+		buf.WriteString(":")
+	}
+
+	for _, copy := range d.Copies {
+		fmt.Fprintf(buf, "\n  %s", copy.Path)
+		if copy.Version != "" {
+			fmt.Fprintf(buf, "@%s", copy.Version)
+		}
+		for _, hop := range copy.Chain {
+			fmt.Fprintf(buf, "\n    %s:%d:%d: %q -> %s", hop.From, hop.Line,
+				hop.Column, hop.Specifier, hop.To)
+		}
+	}
+	return buf.String()
+}
+
+// Finds packages bundled at more than one version, and modules bundled more
+// than once with identical contents. Packages come first, by name, followed by
+// modules, by path.
+func (fs *FileSet) duplicates() []Duplicate {
+	var (
+		dups []Duplicate
+
+		// The modules of each copy of each duplicate, the closest of which it's
+		// reached by
+		modules [][][]*srcEntry
+	)
+
+	// Packages, by the name and version given by their package.json
+	type pkg struct {
+		dir, version string
+		modules      []*srcEntry
+	}
+	var (
+		names    []string
+		packages = make(map[string][]*pkg)
+		dirs     = make(map[string]*pkg)
+	)
+	for _, entry := range fs.byId() {
+		dir := packageDir(entry.path)
+		if dir == "" {
+			continue
+		}
+		p, ok := dirs[dir]
+		if !ok {
+			name, version := fs.readPackage(dir)
+			if version != "" {
+				p = &pkg{dir: dir, version: version}
+				if packages[name] == nil {
+					names = append(names, name)
+				}
+				packages[name] = append(packages[name], p)
+			}
+			dirs[dir] = p
+		}
+		if p != nil {
+			p.modules = append(p.modules, entry)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		versions := make(map[string]bool)
+		for _, p := range packages[name] {
+			versions[p.version] = true
+		}
+		if len(versions) < 2 {
+			continue
+		}
+
+		dup := Duplicate{Package: name}
+		var copies [][]*srcEntry
+		for _, p := range packages[name] {
+			dup.Copies = append(dup.Copies,
+				DuplicateCopy{Path: p.dir, Version: p.version})
+			copies = append(copies, p.modules)
+		}
+		dups = append(dups, dup)
+		modules = append(modules, copies)
+	}
+
+	pkgDups := len(dups)
+
+	// Modules, by their contents. Empty modules are all alike, and not worth
+	// mentioning.
+	var (
+		contents  []string
+		identical = make(map[string][]*srcEntry)
+	)
+	for _, entry := range fs.byId() {
+		if len(bytes.TrimSpace(entry.src)) == 0 {
+			continue
+		}
+		key := string(entry.src)
+		if identical[key] == nil {
+			contents = append(contents, key)
+		}
+		identical[key] = append(identical[key], entry)
+	}
+	for _, key := range contents {
+		if len(identical[key]) < 2 {
+			continue
+		}
+		dup := Duplicate{}
+		var copies [][]*srcEntry
+		for _, entry := range identical[key] {
+			dup.Copies = append(dup.Copies, DuplicateCopy{Path: entry.path})
+			copies = append(copies, []*srcEntry{entry})
+		}
+		dups = append(dups, dup)
+		modules = append(modules, copies)
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+
+	chains := fs.shortestChains()
+	for i, dup := range dups {
+		for j, copies := range modules[i] {
+			closest := copies[0]
+			for _, entry := range copies[1:] {
+				if len(chains[entry]) < len(chains[closest]) {
+					closest = entry
+				}
+			}
+			dup.Copies[j].Chain = fs.locateHops(chains[closest])
+		}
+		sort.Slice(dup.Copies, func(i, j int) bool {
+			return dup.Copies[i].Path < dup.Copies[j].Path
+		})
+	}
+	identicals := dups[pkgDups:]
+	sort.Slice(identicals, func(i, j int) bool {
+		return identicals[i].Copies[0].Path < identicals[j].Copies[0].Path
+	})
+	return dups
+}
+
+// Gives the name and version from a package's package.json. Its name defaults
+// to that of its directory, and its version is empty if it can't be read.
+func (fs *FileSet) readPackage(dir string) (string, string) {
+	name := packageOf(pth.Join(dir, "package.json"))
+
+	r, err := fs.repo.Open(pth.Join(dir, "package.json"))
+	if err != nil {
+		return name, ""
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return name, ""
+	}
+
+	var pkg struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if json.Unmarshal(bs, &pkg) != nil {
+		return name, ""
+	}
+	if pkg.Name != "" {
+		name = pkg.Name
+	}
+	return name, pkg.Version
+}
+
+// Every entry placed, ordered by id
+func (fs *FileSet) byId() []*srcEntry {
+	entries := make([]*srcEntry, len(fs.order))
+	copy(entries, fs.order)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+	return entries
+}
+
+// Gives a shortest chain of requires from the entrypoint to every entry.
+// Where there's more than one, the first found is given, taking requires in
+// order of their specifiers.
+func (fs *FileSet) shortestChains() map[*srcEntry][]RequireHop {
+	entries := fs.byId()
+	chains := make(map[*srcEntry][]RequireHop, len(entries))
+	if len(entries) == 0 {
+		return chains
+	}
+
+	root := entries[0]
+	chains[root] = []RequireHop{}
+	for queue := []*srcEntry{root}; len(queue) > 0; queue = queue[1:] {
+		from := queue[0]
+
+		specifiers := make([]string, 0, len(from.deps))
+		for specifier := range from.deps {
+			specifiers = append(specifiers, specifier)
+		}
+		sort.Strings(specifiers)
+		for _, specifier := range specifiers {
+			dep := from.deps[specifier]
+			if _, seen := chains[dep]; seen {
+				continue
+			}
+			chain := chains[from]
+			chains[dep] = append(chain[:len(chain):len(chain)],
+				RequireHop{From: from.path, Specifier: specifier, To: dep.path})
+			queue = append(queue, dep)
+		}
+	}
+	return chains
+}
+
+// Gives a copy of a chain with where each require is filled in
+func (fs *FileSet) locateHops(chain []RequireHop) []RequireHop {
+	located := make([]RequireHop, len(chain))
+	for i, hop := range chain {
+		hop.Line, hop.Column = findSpecifier(tokenizeFile(fs.repo, hop.From),
+			hop.Specifier)
+		located[i] = hop
+	}
+	return located
+}
+
+// Writes modules with identical contents only once, where they also require
+// the same modules, giving every require of any of them the first. The rest are
+// dropped from the bundle. Identical modules which require different modules,
+// as the same relative require from different directories can, are left be.
+func (fs *FileSet) dedupe(root *srcEntry, dups []Duplicate) []Duplicate {
+	// As entries are in the order they were finished, the modules an entry
+	// requires have been deduped before it is, other than in a cycle
+	canonical := make(map[*srcEntry]*srcEntry)
+	first := make(map[string][]*srcEntry)
+	for _, entry := range fs.order {
+		if entry == root || len(bytes.TrimSpace(entry.src)) == 0 {
+			continue
+		}
+		key := string(entry.src)
+		for _, other := range first[key] {
+			if sameDeps(entry, other, canonical) {
+				canonical[entry] = other
+				break
+			}
+		}
+		if canonical[entry] == nil {
+			first[key] = append(first[key], entry)
+		}
+	}
+	if len(canonical) == 0 {
+		return dups
+	}
+
+	for _, entry := range fs.order {
+		for specifier, dep := range entry.deps {
+			if c, ok := canonical[dep]; ok {
+				entry.deps[specifier] = c
+			}
+		}
+		if canonical[entry] != nil {
+			entry.dropped = true
+		}
+	}
+
+	// Only those duplicates which were wholly deduped are marked so
+	for i, dup := range dups {
+		if dup.Package != "" {
+			continue
+		}
+		kept := make(map[*srcEntry]bool)
+		for _, copy := range dup.Copies {
+			entry := fs.entries[copy.Path]
+			if c, ok := canonical[entry]; ok {
+				entry = c
+			}
+			kept[entry] = true
+		}
+		if len(kept) == 1 {
+			for entry := range kept {
+				dups[i].DedupedTo = entry.path
+			}
+		}
+	}
+	return dups
+}
+
+// Whether two entries require the same modules by the same specifiers, once
+// deduped
+func sameDeps(a, b *srcEntry, canonical map[*srcEntry]*srcEntry) bool {
+	if len(a.deps) != len(b.deps) {
+		return false
+	}
+	resolve := func(entry *srcEntry) *srcEntry {
+		if c, ok := canonical[entry]; ok {
+			return c
+		}
+		return entry
+	}
+	for specifier, dep := range a.deps {
+		other, ok := b.deps[specifier]
+		if !ok || resolve(dep) != resolve(other) {
+			return false
+		}
+	}
+	return true
+}
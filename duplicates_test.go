@@ -0,0 +1,161 @@
+package jssquish
+
+import (
+	"bytes"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Duplicates", func() {
+
+	build := func(files map[string]string, opts Options) (*BuildResult,
+		string) {
+
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		result, err := Build(repo, "index.js", out, opts)
+		Expect(err).ToNot(HaveOccurred())
+		return result, out.String()
+	}
+
+	It("should find packages bundled at more than one version", func() {
+		result, _ := build(map[string]string{
+			"index.js":            "require('lodash');\nrequire('widget')",
+			"lodash/package.json": `{"name": "lodash", "version": "4.17.21"}`,
+			"lodash/index.js":     "module.exports = 4",
+			"widget/package.json": `{"name": "widget", "version": "1.0.0"}`,
+			"widget/index.js":     "require('./node_modules/lodash')",
+			"widget/node_modules/lodash/package.json": `{"version": "3.10.1"}`,
+			"widget/node_modules/lodash/index.js":     "require('./lib/x')",
+			"widget/node_modules/lodash/lib/x.js":     "module.exports = 3",
+		}, Options{})
+
+		Expect(result.Duplicates).To(Equal([]Duplicate{{
+			Package: "lodash",
+			Copies: []DuplicateCopy{
+				{"lodash", "4.17.21", []RequireHop{
+					{"index.js", "lodash", "lodash/index.js", 1, 9},
+				}},
+				{"widget/node_modules/lodash", "3.10.1", []RequireHop{
+					{"index.js", "widget", "widget/index.js", 2, 9},
+					{"widget/index.js", "./node_modules/lodash",
+						"widget/node_modules/lodash/index.js", 1, 9},
+				}},
+			},
+		}}))
+		Expect(result.Duplicates[0].String()).To(Equal(
+			"2 versions of package lodash are bundled:\n" +
+				"  lodash@4.17.21\n" +
+				"    index.js:1:9: \"lodash\" -> lodash/index.js\n" +
+				"  widget/node_modules/lodash@3.10.1\n" +
+				"    index.js:2:9: \"widget\" -> widget/index.js\n" +
+				"    widget/index.js:1:9: \"./node_modules/lodash\" -> " +
+				"widget/node_modules/lodash/index.js"))
+	})
+
+	It("should leave be copies of a package at the same version", func() {
+		result, _ := build(map[string]string{
+			"index.js":            "require('a'); require('b')",
+			"a/package.json":      `{"name": "a", "version": "1.0.0"}`,
+			"a/index.js":          "module.exports = 'a'",
+			"b/package.json":      `{"name": "a", "version": "1.0.0"}`,
+			"b/index.js":          "module.exports = 'b'",
+			"c/package.json":      `{"name": "a"}`,
+			"unused/index.js":     "",
+			"unused/package.json": `{"name": "a", "version": "2.0.0"}`,
+		}, Options{})
+		Expect(result.Duplicates).To(BeEmpty())
+	})
+
+	files := map[string]string{
+		"index.js": "result = [require('./a/util'), require('./b/util')," +
+			" require('./a/same'), require('./b/same')]",
+		"a/util.js": "module.exports = {count: 0}",
+		"b/util.js": "module.exports = {count: 0}",
+		"a/same.js": "module.exports = require('./dep')",
+		"b/same.js": "module.exports = require('./dep')",
+		"a/dep.js":  "module.exports = 'a'",
+		"b/dep.js":  "module.exports = 'b'",
+	}
+
+	It("should find modules with identical contents", func() {
+		result, _ := build(files, Options{})
+		Expect(result.Duplicates).To(HaveLen(2))
+
+		same := result.Duplicates[0]
+		Expect(same.Package).To(BeEmpty())
+		Expect(same.DedupedTo).To(BeEmpty())
+		Expect(same.Copies).To(HaveLen(2))
+		Expect(same.Copies[0].Path).To(Equal("a/same.js"))
+		Expect(same.Copies[0].Chain).To(Equal([]RequireHop{
+			{"index.js", "./a/same", "a/same.js", 1, 61},
+		}))
+		Expect(same.Copies[1].Path).To(Equal("b/same.js"))
+
+		util := result.Duplicates[1]
+		Expect(util.Copies[0].Path).To(Equal("a/util.js"))
+		Expect(util.Copies[1].Path).To(Equal("b/util.js"))
+		Expect(util.String()).To(HavePrefix(
+			"2 modules with identical contents are bundled:\n  a/util.js\n"))
+	})
+
+	It("should write modules with identical contents once when asked", func() {
+		result, bundle := build(files, Options{Dedupe: true})
+		Expect(result.Duplicates).To(HaveLen(2))
+		Expect(result.Duplicates[0].DedupedTo).To(BeEmpty())
+		Expect(result.Duplicates[1].DedupedTo).To(Equal("a/util.js"))
+		Expect(result.Duplicates[1].String()).To(HavePrefix(
+			"2 modules with identical contents are bundled " +
+				"(deduped to a/util.js):"))
+
+		paths := make(map[string]bool)
+		for _, module := range result.Modules {
+			paths[module.Path] = true
+		}
+		Expect(paths).ToNot(HaveKey("b/util.js"))
+		Expect(paths).To(HaveKey("a/util.js"))
+		Expect(paths).To(HaveKey("b/same.js"))
+
+		vm := otto.New()
+		_, err := vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run(
+			"result[0] === result[1] && result[2] + result[3]")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("ab"))
+	})
+
+	It("should dedupe modules requiring modules which were deduped", func() {
+		result, bundle := build(map[string]string{
+			"index.js":  "result = [require('./a/same'), require('./b/same')]",
+			"a/same.js": "module.exports = require('./dep')",
+			"b/same.js": "module.exports = require('./dep')",
+			"a/dep.js":  "module.exports = {}",
+			"b/dep.js":  "module.exports = {}",
+		}, Options{Dedupe: true, TreeShake: true})
+		Expect(result.Modules).To(HaveLen(3))
+
+		vm := otto.New()
+		_, err := vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result[0] === result[1]")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.Export()).To(BeTrue())
+	})
+
+	It("should never dedupe the entrypoint", func() {
+		result, bundle := build(map[string]string{
+			"index.js": "result = require('./a')",
+			"a.js":     "result = require('./a')",
+		}, Options{Dedupe: true})
+		Expect(result.Modules).To(HaveLen(2))
+		Expect(result.Duplicates[0].DedupedTo).To(BeEmpty())
+
+		_, err := otto.New().Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
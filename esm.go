@@ -0,0 +1,512 @@
+package jssquish
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The names of helpers and bindings introduced when lowering an ES module
+const (
+	esmInterop      = "__squish_interop"
+	esmExportStar   = "__squish_export_star"
+	esmDefault      = "__squish_default"
+	esmReexportBase = "__squish_reexport_"
+)
+
+var esmHelpers = map[string]string{
+	esmInterop: "function " + esmInterop + "(m) {" +
+		" return m && m.__esModule ? m[\"default\"] : m; }",
+	esmExportStar: "function " + esmExportStar + "(e, m) {" +
+		" Object.keys(m).forEach(function (k) {" +
+		" if (k !== \"default\" && !Object.prototype.hasOwnProperty.call(e, k))" +
+		" Object.defineProperty(e, k, {enumerable: true," +
+		" get: function () { return m[k]; }}); }); }",
+}
+
+// An ES module rewritten as CommonJS, so the ES5 parser can cope with it
+type loweredModule struct {
+	src []byte
+
+	// Whether the source was an ES module at all. If not, `src` is untouched.
+	esm bool
+
+	// Each export, and where in `src` it's defined
+	exports []loweredExport
+}
+
+// An export of a lowered module. Exports are defined up front as getters, so
+// they're as live as the bindings behind them, and so that `start` to `end`
+// covers everything which needs removing if the export goes unused.
+type loweredExport struct {
+	name       string
+	start, end int
+}
+
+type esmError struct {
+	path   string
+	tok    *token
+	reason string
+}
+
+func (ee *esmError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", ee.path, ee.tok.line+1, ee.tok.col+1,
+		ee.reason)
+}
+
+// Rewrites the `import` and `export` declarations of an ES module in terms of
+// `require` and `exports`. Every line stays where it was, so line numbers in
+// errors and source maps still match the original. The rest of the module is
+// left alone, so it needs to be ES5 all the same.
+// Imported bindings are copied when the import runs rather than being live,
+// which only matters when ES modules import each other in a cycle.
+func lowerModule(src []byte, path string) (*loweredModule, error) {
+	tokens, err := tokenize(string(src), path)
+	if err != nil {
+		// Leave it for the parser to report on
+		return &loweredModule{src: src}, nil
+	}
+
+	lw := &lowering{path: path}
+	for i := range tokens {
+		if !tokens[i].trivia() {
+			lw.toks = append(lw.toks, &tokens[i])
+		}
+	}
+
+	depth := 0
+	for i := 0; i < len(lw.toks); i++ {
+		tok := lw.toks[i]
+		switch {
+		case tok.kind == tokPunctuator && strings.Contains("({[", tok.text):
+			depth++
+		case tok.kind == tokPunctuator && strings.Contains(")}]", tok.text):
+			depth--
+		case depth == 0 && lw.declarationAt(i, "import"):
+			if i, err = lw.lowerImport(i); err != nil {
+				return nil, err
+			}
+		case depth == 0 && lw.declarationAt(i, "export"):
+			if i, err = lw.lowerExport(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(lw.edits) == 0 {
+		return &loweredModule{src: src}, nil
+	}
+	return lw.apply(src), nil
+}
+
+type esmEdit struct {
+	start, end int
+	text       string
+}
+
+type esmExport struct {
+	name  string
+	local string
+}
+
+type lowering struct {
+	path      string
+	toks      []*token
+	edits     []esmEdit
+	exports   []esmExport
+	helpers   map[string]bool
+	reexports int
+}
+
+func (lw *lowering) errorAt(i int, format string, args ...interface{}) error {
+	tok := lw.toks[len(lw.toks)-1]
+	if i < len(lw.toks) {
+		tok = lw.toks[i]
+	}
+	return &esmError{lw.path, tok, fmt.Sprintf(format, args...)}
+}
+
+// Whether token `i` is the given keyword, starting a declaration. Dynamic
+// `import()` and `import.meta` are left alone.
+func (lw *lowering) declarationAt(i int, keyword string) bool {
+	if !lw.toks[i].is(tokIdentifier, keyword) {
+		return false
+	}
+	if i > 0 {
+		prev := lw.toks[i-1]
+		if !prev.is(tokPunctuator, ";") && !prev.is(tokPunctuator, "}") &&
+			!lw.toks[i].newline {
+			return false
+		}
+	}
+	if i+1 < len(lw.toks) {
+		next := lw.toks[i+1]
+		if next.is(tokPunctuator, "(") || next.is(tokPunctuator, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (lw *lowering) is(i int, kind tokenKind, text string) bool {
+	return i < len(lw.toks) && lw.toks[i].is(kind, text)
+}
+
+func (lw *lowering) identifier(i int) (string, bool) {
+	if i < len(lw.toks) && lw.toks[i].kind == tokIdentifier {
+		return lw.toks[i].text, true
+	}
+	return "", false
+}
+
+func (lw *lowering) end(i int) int {
+	return lw.toks[i].offset + len(lw.toks[i].text)
+}
+
+// Replaces tokens `from` through `to` inclusive. A trailing `;` is swallowed
+// too, returning the index of the last token replaced.
+func (lw *lowering) replace(from, to int, text string) int {
+	if lw.is(to+1, tokPunctuator, ";") {
+		to++
+	}
+	lw.edits = append(lw.edits, esmEdit{lw.toks[from].offset, lw.end(to), text})
+	return to
+}
+
+func (lw *lowering) useHelper(name string) string {
+	if lw.helpers == nil {
+		lw.helpers = make(map[string]bool)
+	}
+	lw.helpers[name] = true
+	return name
+}
+
+// Parses `from 'spec'`, returning the quoted specifier as written
+func (lw *lowering) from(i int) (string, int, error) {
+	if !lw.is(i, tokIdentifier, "from") {
+		return "", i, lw.errorAt(i, "expected 'from'")
+	}
+	if i+1 >= len(lw.toks) || lw.toks[i+1].kind != tokString {
+		return "", i, lw.errorAt(i+1, "expected a module specifier")
+	}
+	return lw.toks[i+1].text, i + 1, nil
+}
+
+// Parses `{a, b as c}`, returning pairs of the outer and inner names, along
+// with the index of the closing brace.
+func (lw *lowering) specifiers(i int) ([][2]string, int, error) {
+	var specs [][2]string
+	for i++; !lw.is(i, tokPunctuator, "}"); i++ {
+		name, ok := lw.identifier(i)
+		if !ok {
+			return nil, i, lw.errorAt(i, "expected a name")
+		}
+		alias := name
+		if lw.is(i+1, tokIdentifier, "as") {
+			if alias, ok = lw.identifier(i + 2); !ok {
+				return nil, i, lw.errorAt(i+2, "expected a name")
+			}
+			i += 2
+		}
+		specs = append(specs, [2]string{name, alias})
+		if lw.is(i+1, tokPunctuator, ",") {
+			i++
+		} else if !lw.is(i+1, tokPunctuator, "}") {
+			return nil, i, lw.errorAt(i+1, "expected ',' or '}'")
+		}
+	}
+	return specs, i, nil
+}
+
+// An expression for the export `name` of the module held by `object`
+func member(object, name string) string {
+	if name == "default" {
+		return esmInterop + "(" + object + ")"
+	}
+	if reservedWords[name] {
+		return object + "[" + strconv.Quote(name) + "]"
+	}
+	return object + "." + name
+}
+
+func (lw *lowering) lowerImport(start int) (int, error) {
+	i := start + 1
+
+	// import 'spec'
+	if i < len(lw.toks) && lw.toks[i].kind == tokString {
+		return lw.replace(start, i, "require("+lw.toks[i].text+");"), nil
+	}
+
+	type binding struct {
+		local, name string
+		namespace   bool
+	}
+	var bindings []binding
+
+	if local, ok := lw.identifier(i); ok && local != "from" ||
+		ok && lw.is(i+1, tokIdentifier, "from") {
+		bindings = append(bindings, binding{local: local, name: "default"})
+		i++
+		if lw.is(i, tokPunctuator, ",") {
+			i++
+		}
+	}
+
+	switch {
+	case lw.is(i, tokPunctuator, "*"):
+		local, ok := lw.identifier(i + 2)
+		if !lw.is(i+1, tokIdentifier, "as") || !ok {
+			return 0, lw.errorAt(i, "expected '* as name'")
+		}
+		bindings = append(bindings, binding{local: local, namespace: true})
+		i += 3
+
+	case lw.is(i, tokPunctuator, "{"):
+		specs, close, err := lw.specifiers(i)
+		if err != nil {
+			return 0, err
+		}
+		for _, spec := range specs {
+			bindings = append(bindings, binding{local: spec[1], name: spec[0]})
+		}
+		i = close + 1
+	}
+
+	spec, last, err := lw.from(i)
+	if err != nil {
+		return 0, err
+	}
+
+	required := "require(" + spec + ")"
+	if len(bindings) == 0 {
+		return lw.replace(start, last, required+";"), nil
+	}
+
+	// One statement for each binding keeps each one removable on its own
+	stmts := make([]string, len(bindings))
+	for j, b := range bindings {
+		value := required
+		if !b.namespace {
+			if b.name == "default" {
+				lw.useHelper(esmInterop)
+			}
+			value = member(required, b.name)
+		}
+		stmts[j] = "var " + b.local + " = " + value + ";"
+	}
+	return lw.replace(start, last, strings.Join(stmts, " ")), nil
+}
+
+func (lw *lowering) lowerExport(start int) (int, error) {
+	i := start + 1
+	switch {
+
+	case lw.is(i, tokIdentifier, "default"):
+		if lw.is(i+1, tokIdentifier, "function") {
+			if name, ok := lw.identifier(i + 2); ok {
+				// export default function name() {}
+				lw.replace(start, i, "")
+				lw.exports = append(lw.exports, esmExport{"default", name})
+				return i, nil
+			}
+
+			// An anonymous function becomes an expression, which needs ending
+			// explicitly so it isn't called by whatever follows.
+			if close, ok := lw.functionEnd(i + 1); ok {
+				lw.edits = append(lw.edits,
+					esmEdit{lw.end(close), lw.end(close), ";"})
+			}
+		}
+		lw.edits = append(lw.edits, esmEdit{
+			lw.toks[start].offset, lw.end(i), "var " + esmDefault + " =",
+		})
+		lw.exports = append(lw.exports, esmExport{"default", esmDefault})
+		return i, nil
+
+	case lw.is(i, tokIdentifier, "function"):
+		name, ok := lw.identifier(i + 1)
+		if !ok {
+			return 0, lw.errorAt(i+1, "expected a function name")
+		}
+		lw.replace(start, start, "")
+		lw.exports = append(lw.exports, esmExport{name, name})
+		return start, nil
+
+	case lw.is(i, tokIdentifier, "var"), lw.is(i, tokIdentifier, "let"),
+		lw.is(i, tokIdentifier, "const"):
+		names, err := lw.declaredNames(i)
+		if err != nil {
+			return 0, err
+		}
+		lw.replace(start, start, "")
+		for _, name := range names {
+			lw.exports = append(lw.exports, esmExport{name, name})
+		}
+		return start, nil
+
+	case lw.is(i, tokPunctuator, "{"):
+		specs, close, err := lw.specifiers(i)
+		if err != nil {
+			return 0, err
+		}
+
+		// export {a, b as c}
+		if !lw.is(close+1, tokIdentifier, "from") {
+			for _, spec := range specs {
+				lw.exports = append(lw.exports, esmExport{spec[1], spec[0]})
+			}
+			return lw.replace(start, close, ""), nil
+		}
+
+		// export {a, b as c} from 'spec'
+		spec, last, err := lw.from(close + 1)
+		if err != nil {
+			return 0, err
+		}
+		ns := lw.reexport()
+		for _, s := range specs {
+			if s[0] == "default" {
+				lw.useHelper(esmInterop)
+			}
+			lw.exports = append(lw.exports, esmExport{s[1], member(ns, s[0])})
+		}
+		return lw.replace(start, last,
+			"var "+ns+" = require("+spec+");"), nil
+
+	case lw.is(i, tokPunctuator, "*"):
+		// export * as ns from 'spec'
+		if lw.is(i+1, tokIdentifier, "as") {
+			name, ok := lw.identifier(i + 2)
+			if !ok {
+				return 0, lw.errorAt(i+2, "expected a name")
+			}
+			spec, last, err := lw.from(i + 3)
+			if err != nil {
+				return 0, err
+			}
+			ns := lw.reexport()
+			lw.exports = append(lw.exports, esmExport{name, ns})
+			return lw.replace(start, last,
+				"var "+ns+" = require("+spec+");"), nil
+		}
+
+		// export * from 'spec'
+		spec, last, err := lw.from(i + 1)
+		if err != nil {
+			return 0, err
+		}
+		return lw.replace(start, last,
+			lw.useHelper(esmExportStar)+"(exports, require("+spec+"));"), nil
+	}
+
+	return 0, lw.errorAt(i, "unsupported export")
+}
+
+func (lw *lowering) reexport() string {
+	ns := esmReexportBase + strconv.Itoa(lw.reexports)
+	lw.reexports++
+	return ns
+}
+
+// The names declared by a `var` statement. Without a parser, the end of the
+// statement is taken to be the first `;`, or line break which can't be
+// continuing the statement, outside of any brackets.
+func (lw *lowering) declaredNames(i int) ([]string, error) {
+	var names []string
+	expectName := true
+	depth := 0
+	for i++; i < len(lw.toks); i++ {
+		tok := lw.toks[i]
+		if expectName {
+			if tok.kind != tokIdentifier {
+				return nil, lw.errorAt(i, "expected a name")
+			}
+			names = append(names, tok.text)
+			expectName = false
+			continue
+		}
+		if depth == 0 && (tok.is(tokPunctuator, ";") ||
+			tok.newline && lineBreakSignificant(lw.toks[i-1], tok)) {
+			break
+		}
+		switch {
+		case tok.kind == tokPunctuator && strings.Contains("({[", tok.text):
+			depth++
+		case tok.kind == tokPunctuator && strings.Contains(")}]", tok.text):
+			depth--
+			if depth < 0 {
+				return names, nil
+			}
+		case depth == 0 && tok.is(tokPunctuator, ","):
+			expectName = true
+		}
+	}
+	return names, nil
+}
+
+// Finds the closing brace of the function whose `function` keyword is token
+// `i`.
+func (lw *lowering) functionEnd(i int) (int, bool) {
+	for ; i < len(lw.toks) && !lw.is(i, tokPunctuator, "{"); i++ {
+	}
+	depth := 0
+	for ; i < len(lw.toks); i++ {
+		switch {
+		case lw.is(i, tokPunctuator, "{"):
+			depth++
+		case lw.is(i, tokPunctuator, "}"):
+			depth--
+			if depth == 0 {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Writes out the lowered module. Exports are defined ahead of everything else,
+// on the first line, and helpers are tacked on to the end, leaving every line
+// in between where it was.
+func (lw *lowering) apply(src []byte) *loweredModule {
+	out := &bytes.Buffer{}
+	lowered := &loweredModule{esm: true}
+
+	out.WriteString(`Object.defineProperty(exports, "__esModule", {value: true}); `)
+	for _, exp := range lw.exports {
+		start := out.Len()
+		fmt.Fprintf(out, "Object.defineProperty(exports, %s, {enumerable: true, "+
+			"get: function () { return %s; }}); ", strconv.Quote(exp.name), exp.local)
+		lowered.exports = append(lowered.exports,
+			loweredExport{exp.name, start, out.Len()})
+	}
+
+	sort.SliceStable(lw.edits, func(i, j int) bool {
+		return lw.edits[i].start < lw.edits[j].start
+	})
+
+	pos := 0
+	for _, edit := range lw.edits {
+		out.Write(src[pos:edit.start])
+		out.WriteString(edit.text)
+
+		// Keep the line breaks of whatever was replaced
+		for _, r := range string(src[edit.start:edit.end]) {
+			if isLineTerminator(r) {
+				out.WriteRune(r)
+			}
+		}
+		pos = edit.end
+	}
+	out.Write(src[pos:])
+
+	for _, name := range []string{esmInterop, esmExportStar} {
+		if lw.helpers[name] {
+			out.WriteString("\n" + esmHelpers[name])
+		}
+	}
+
+	lowered.src = out.Bytes()
+	return lowered
+}
@@ -15,3 +15,10 @@ if [ "$twice_output" != "Hello World" ]; then
   echo "Expected 'Hello World', got $twice_output"
   exit 2
 fi
+
+
+minified_output=`$node ./tool/js-squish/example/twice.minified.js`
+if [ "$minified_output" != "Hello World" ]; then
+  echo "Expected 'Hello World', got $minified_output"
+  exit 2
+fi
@@ -1,13 +1,43 @@
 package jssquish
 
 import (
-	"bytes"
+	"io/ioutil"
 	pth "path"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/robertkrimen/otto/ast"
 )
 
 type srcEntry struct {
 	id   int
 	deps map[string]*srcEntry
+
+	path    string
+	src     []byte
+	program *ast.Program
+
+	// Set for ES modules, which have been lowered to CommonJS
+	esm     bool
+	exports []loweredExport
+
+	// Set once tree shaking has been done. A module deduped into another is
+	// dropped too.
+	shake   *moduleShake
+	dropped bool
+
+	// Other files a transform made its source from
+	files []string
+
+	// The CSS of a stylesheet extracted from the bundle, whose module is left
+	// empty
+	css []byte
+
+	// Set once scope hoisting has been done. A hoisted module is written as part
+	// of the module it's been inlined into, whose `body` takes in both.
+	hoisted bool
+	body    *moduleBody
 }
 
 // A `FileSet` maintains a unique set of fully-qualified source files. For each
@@ -19,6 +49,49 @@ type FileSet struct {
 	resolver *Resolver
 	writer   *Writer
 	entries  map[string]*srcEntry
+
+	// How many files may be read and parsed at once, or zero for one per CPU
+	jobs int
+
+	// Where what's known of each file is kept between builds, if anywhere, and
+	// whether files found there still need parsing
+	cache  *buildCache
+	parsed *ParseCache
+	parse  bool
+
+	// Every file read, or tried to be, whether or not it made it into the
+	// bundle
+	loaded []string
+
+	// Every entry, in the order they were finished, which is the order they're
+	// written in
+	order []*srcEntry
+
+	// Remove unused exports before writing
+	treeShake   bool
+	sideEffects map[string][]string
+
+	// Inline modules into the modules requiring them where possible
+	scopeHoist bool
+
+	// Run on each file before it's parsed
+	transforms []TransformRule
+
+	// How files are made into modules after they're transformed, by
+	// extension, and the largest file inlined as a data URI
+	loaders     map[string]Loader
+	inlineLimit int
+
+	// Where the CSS of stylesheets is written instead of bundling them, if
+	// anywhere, and the stylesheets which were
+	css         *cssWriter
+	stylesheets []string
+
+	// Write modules with identical contents only once
+	deduplicate bool
+
+	// What's bundled more than once, found once every file is placed
+	dups []Duplicate
 }
 
 // Creates a `FileSet` with the given starting point to walk files. The value
@@ -30,83 +103,360 @@ func (fs *FileSet) Create(impt string) error {
 }
 
 func (fs *FileSet) CreateWithNodeEnv(impt string, environment *string) error {
-	if err := fs.writer.OpenWithEnvironment(environment); err != nil {
+	root, err := fs.add(impt, ".")
+	if err != nil {
 		return err
 	}
 
-	if _, err := fs.add(impt, "."); err != nil {
+	fs.dups = fs.duplicates()
+	if fs.deduplicate {
+		fs.dups = fs.dedupe(root, fs.dups)
+	}
+
+	if fs.treeShake {
+		if fs.sideEffects == nil {
+			fs.sideEffects = make(map[string][]string)
+		}
+		if err := fs.shake(root); err != nil {
+			return err
+		}
+	}
+
+	if fs.scopeHoist {
+		if err := fs.hoist(root); err != nil {
+			return err
+		}
+	}
+
+	// The preamble defines the helpers of what's written, so it's written
+	// once what will be is known
+	for _, entry := range fs.order {
+		if !entry.dropped {
+			fs.writer.useHelpers(entry.src)
+		}
+	}
+	if err := fs.writer.OpenWithEnvironment(environment); err != nil {
 		return err
 	}
 
-	return fs.writer.Close()
+	var sheets []*srcEntry
+	for _, entry := range fs.order {
+		if err := fs.write(entry); err != nil {
+			return err
+		}
+		if entry.css != nil {
+			sheets = append(sheets, entry)
+			fs.stylesheets = append(fs.stylesheets, entry.path)
+		}
+	}
+
+	if err := fs.writer.Close(); err != nil {
+		return err
+	}
+	if fs.css != nil {
+		return fs.css.Write(sheets)
+	}
+	return nil
 }
 
 // Internally adds a import to this `FileSet` from the perspective of the
-// directory `from`.
+// directory `from`, along with everything it depends on. Files are read and
+// parsed concurrently, then placed in the same order, with the same ids, as if
+// they'd been read one after another.
 func (fs *FileSet) add(impt, from string) (*srcEntry, error) {
-	// Determine an id for this import
-	id := fs.nextId
-	fs.nextId++
-
-	// Resolve the import
 	path, err := fs.resolver.Resolve(impt, from)
 	if err != nil {
 		return nil, err
 	}
 
+	files := fs.load(path)
+	loaded := make(map[string]bool, len(files))
+	for path, file := range files {
+		loaded[path] = true
+		if file.entry != nil {
+			for _, read := range file.entry.files {
+				loaded[read] = true
+			}
+		}
+	}
+	for path := range loaded {
+		fs.loaded = append(fs.loaded, path)
+	}
+	sort.Strings(fs.loaded)
+
+	return fs.place(path, files)
+}
+
+// A file as it's been loaded, with each of its imports resolved. Any error
+// is held on to until the file is placed, so that which error is reported
+// doesn't depend on timing.
+type loadedFile struct {
+	entry   *srcEntry
+	imports []string
+	paths   []string
+	err     error
+}
+
+// Reads, parses, and resolves the imports of every file reachable from the
+// given one, on as many goroutines as `jobs` allows.
+func (fs *FileSet) load(root string) map[string]*loadedFile {
+	jobs := fs.jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		tokens = make(chan struct{}, jobs)
+		files  = make(map[string]*loadedFile)
+	)
+
+	var visit func(path string)
+	visit = func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := files[path]; ok {
+			return
+		}
+		file := &loadedFile{}
+		files[path] = file
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tokens <- struct{}{}
+			fs.loadFile(path, file)
+			<-tokens
+
+			for _, dep := range file.paths {
+				visit(dep)
+			}
+		}()
+	}
+
+	visit(root)
+	wg.Wait()
+	return files
+}
+
+// Reads a file and resolves its imports, stopping at the first error
+func (fs *FileSet) loadFile(path string, file *loadedFile) {
+	file.entry, file.imports, file.err = fs.read(path)
+	if file.err != nil {
+		return
+	}
+
+	pwd := pth.Dir(path)
+	for _, impt := range file.imports {
+		dep, err := fs.resolver.Resolve(impt, pwd)
+		if err != nil {
+			file.err = err
+			return
+		}
+		file.paths = append(file.paths, dep)
+	}
+}
+
+// Gives a loaded file and its dependencies their ids and place in the order,
+// depth first. An id is used up for every import, even of a file which has
+// already been placed. A file is known as soon as it's reached, so that
+// imports which go round in a cycle end there.
+func (fs *FileSet) place(path string,
+	files map[string]*loadedFile) (*srcEntry, error) {
+
+	id := fs.nextId
+	fs.nextId++
+
 	// If it's already known, we're done!
 	if entry, ok := fs.entries[path]; ok {
 		return entry, nil
 	}
 
-	// Resolve all imports
-	src, imports, err := fs.read(path)
-	if err != nil {
-		return nil, err
+	file := files[path]
+	if file.entry == nil {
+		return nil, file.err
 	}
+	entry := file.entry
+	fs.entries[path] = entry
 
-	// Ensure each dependency is fully resolved, and add it as a dependency to the
+	// Ensure each dependency is placed, and add it as a dependency to the
 	// current import
-	pwd := pth.Dir(path)
 	deps := make(map[string]*srcEntry)
-	for _, impt := range imports {
-		if entry, err := fs.add(impt, pwd); err != nil {
+	for i, impt := range file.imports {
+		// Imports past the last one resolved are where resolving went wrong
+		if i == len(file.paths) {
+			return nil, file.err
+		}
+		dep, err := fs.place(file.paths[i], files)
+		if err != nil {
 			return nil, err
-		} else {
-			deps[impt] = entry
 		}
+		deps[impt] = dep
 	}
 
-	entry := &srcEntry{
-		id:   id,
-		deps: deps,
+	entry.id = id
+	entry.deps = deps
+	fs.order = append(fs.order, entry)
+
+	return entry, nil
+}
+
+// Writes an entry out, unless it's been shaken out of the bundle altogether or
+// inlined into another
+func (fs *FileSet) write(entry *srcEntry) error {
+	if entry.dropped || entry.hoisted {
+		return nil
 	}
-	fs.entries[path] = entry
 
-	// Write the contents out to the file
-	if err := fs.writer.Write(src, id, deps); err != nil {
-		return nil, err
+	body := entry.body
+	if body == nil {
+		src := entry.src
+		if entry.shake != nil {
+			src = blank(src, entry.shake.removed)
+		}
+		body = &moduleBody{
+			src:     src,
+			program: entry.program,
+			sources: []bodySource{{entry.path, entry.src}},
+		}
 	}
 
-	return entry, nil
+	deps := make(map[string]*srcEntry, len(entry.deps))
+	for impt, dep := range entry.deps {
+		if !dep.dropped && !dep.hoisted {
+			deps[impt] = dep
+		}
+	}
+
+	return fs.writer.WriteBody(body, entry.id, deps)
 }
 
-func (fs *FileSet) read(path string) (*bytes.Buffer, []string, error) {
+// Reads a source file, runs any transforms which apply to it, makes it into a
+// module by its loader, and parses it
+func (fs *FileSet) read(path string) (*srcEntry, []string, error) {
 	r, err := fs.repo.Open(path)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer r.Close()
 
-	src := &bytes.Buffer{}
-	if _, err := src.ReadFrom(r); err != nil {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
 		return nil, nil, err
 	}
 
-	imports, err := ParseRequires(src, path)
+	src, files, err := transform(fs.transforms, path, src)
 	if err != nil {
 		return nil, nil, err
 	}
+	// A stylesheet extracted from the bundle leaves an empty module behind
+	var css []byte
+	if fs.css != nil && loaderOf(fs.loaders, path) == LoaderCSS {
+		css, src = append([]byte{}, src...), nil
+	} else if src, err = load(fs.loaders, fs.inlineLimit, path, src); err != nil {
+		return nil, nil, err
+	}
 
-	return src, imports, nil
+	entry, imports, err := fs.parseSource(path, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry.files = files
+	entry.css = css
+	return entry, imports, nil
+}
+
+// Parses a source file, lowering it first if it's an ES module. The parsed
+// program is kept along with the source, so it needn't be parsed again to
+// shake or minify. A file found in a cache is only parsed if the program is
+// needed, and hasn't been kept.
+func (fs *FileSet) parseSource(path string, src []byte) (*srcEntry,
+	[]string, error) {
+
+	var key string
+	if fs.parsed != nil {
+		key = fs.parsed.key(src)
+		if cm, program, ok := fs.parsed.Get(key); ok {
+			return fs.readCached(path, src, key, cm, program)
+		}
+	}
+	if fs.cache != nil {
+		key = fs.cache.key(src)
+		if cm, ok := fs.cache.Get(key); ok {
+			return fs.readCached(path, src, key, cm, nil)
+		}
+	}
+
+	lowered, err := lowerModule(src, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	program, err := parseProgram(lowered.src, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	imports, err := programRequires(program)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &srcEntry{
+		path:    path,
+		src:     lowered.src,
+		program: program,
+		esm:     lowered.esm,
+		exports: lowered.exports,
+	}
+
+	if fs.cache != nil || fs.parsed != nil {
+		cm := &cachedModule{Requires: imports, ESM: lowered.esm}
+		if lowered.esm {
+			cm.Src = string(lowered.src)
+			for _, exp := range lowered.exports {
+				cm.Exports = append(cm.Exports,
+					cachedExport{exp.name, exp.start, exp.end})
+			}
+		}
+		if fs.cache != nil {
+			fs.cache.Put(key, cm)
+		}
+		if fs.parsed != nil {
+			fs.parsed.Put(key, cm, program)
+		}
+	}
+	return entry, imports, nil
+}
+
+func (fs *FileSet) readCached(path string, src []byte, key string,
+	cm *cachedModule, program *ast.Program) (*srcEntry, []string, error) {
+
+	entry := &srcEntry{
+		path:    path,
+		src:     src,
+		program: program,
+		esm:     cm.ESM,
+	}
+	if cm.ESM {
+		entry.src = []byte(cm.Src)
+		for _, exp := range cm.Exports {
+			entry.exports = append(entry.exports,
+				loweredExport{exp.Name, exp.Start, exp.End})
+		}
+	}
+
+	if fs.parse && program == nil {
+		program, err := parseProgram(entry.src, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.program = program
+	}
+	if fs.parsed != nil {
+		fs.parsed.Put(key, cm, entry.program)
+	}
+	return entry, cm.Requires, nil
 }
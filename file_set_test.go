@@ -0,0 +1,146 @@
+package jssquish
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileSet", func() {
+
+	bundle := func(files map[string]string, opts Options) (string, error) {
+		repo := memoryRepository(files)
+		defer repo.Close()
+
+		out := &bytes.Buffer{}
+		err := MainWithOptions(repo, "index.js", out, opts)
+		return out.String(), err
+	}
+
+	It("should write the same bundle however many files are read at once", func() {
+		// Each module requires the two after it, making plenty of diamonds
+		files := map[string]string{"index.js": "require('./m0'); require('./m1')"}
+		for i := 0; i < 30; i++ {
+			files[fmt.Sprintf("m%d.js", i)] = fmt.Sprintf(
+				"require('./m%d'); require('./m%d')", (i+1)%30+30*((i+1)/30),
+				(i+2)%32)
+		}
+		files["m30.js"] = ""
+		files["m31.js"] = ""
+
+		expected, err := bundle(files, Options{Jobs: 1})
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 5; i++ {
+			out, err := bundle(files, Options{Jobs: 8})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(Equal(expected))
+		}
+	})
+
+	It("should bundle modules which require each other", func() {
+		out, err := bundle(map[string]string{
+			"index.js": "require('./a')",
+			"a.js":     "exports.a = 'a'; require('./b')",
+			"b.js":     "require('./a')",
+		}, Options{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(ContainSubstring(`{"./b":`))
+		Expect(out).To(ContainSubstring(`{"./a":`))
+	})
+
+	It("should report the error it would have reached first", func() {
+		files := map[string]string{
+			"index.js": "require('./a'); require('./missing-b')",
+			"a.js":     "require('./missing-a')",
+		}
+		for i := 0; i < 5; i++ {
+			_, err := bundle(files, Options{Jobs: 8})
+			Expect(err).To(MatchError("Could not resolve './missing-a' from '.'"))
+		}
+	})
+
+	Describe("with a cache", func() {
+
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "js-squish-cache")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		files := map[string]string{
+			"index.js": "import {a} from './a'; console.log(a)",
+			"a.js":     "export var a = require('./b')",
+			"b.js":     "module.exports = 'b'",
+		}
+
+		cached := func() []string {
+			found, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+			Expect(err).ToNot(HaveOccurred())
+			return found
+		}
+
+		It("should write the same bundle from the cache", func() {
+			for _, opts := range []Options{{}, {Minify: true, TreeShake: true}} {
+				expected, err := bundle(files, opts)
+				Expect(err).ToNot(HaveOccurred())
+
+				opts.CacheDir = dir
+				for i := 0; i < 2; i++ {
+					out, err := bundle(files, opts)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(out).To(Equal(expected))
+				}
+			}
+			Expect(cached()).To(HaveLen(3))
+		})
+
+		It("should use what it's cached rather than parsing again", func() {
+			_, err := bundle(files, Options{CacheDir: dir})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Forget every require, which only a cached read would believe
+			for _, path := range cached() {
+				Expect(ioutil.WriteFile(path, []byte(`{"requires": []}`), 0644)).
+					To(Succeed())
+			}
+			out, err := bundle(files, Options{CacheDir: dir})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).ToNot(ContainSubstring("module.exports = 'b'"))
+		})
+
+		It("should read a changed file afresh", func() {
+			_, err := bundle(files, Options{CacheDir: dir})
+			Expect(err).ToNot(HaveOccurred())
+
+			files := map[string]string{
+				"index.js": files["index.js"],
+				"a.js":     files["a.js"],
+				"b.js":     "module.exports = 'changed'",
+			}
+			out, err := bundle(files, Options{CacheDir: dir})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(ContainSubstring("'changed'"))
+			Expect(cached()).To(HaveLen(4))
+		})
+
+		It("should not trust a cache from another version", func() {
+			cache, err := newBuildCache(dir)
+			Expect(err).ToNot(HaveOccurred())
+			key := cache.key([]byte("src"))
+
+			cache.salt = "js-squish 0.0.0"
+			Expect(cache.key([]byte("src"))).ToNot(Equal(key))
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// The modules of a bundle, and the requires between them
+type Graph struct {
+	// Ordered by id
+	Nodes []GraphNode `json:"nodes"`
+
+	// Ordered by the id of the module requiring, then by specifier
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	Path string `json:"path"`
+	Id   int    `json:"id"`
+
+	// The size of the module's source in bytes. An ES module is measured after
+	// it's been lowered to CommonJS.
+	Size int `json:"size"`
+}
+
+// A require of `Specifier` from the module at `From`, which resolved to `To`
+type GraphEdge struct {
+	From      string `json:"from"`
+	Specifier string `json:"specifier"`
+	To        string `json:"to"`
+}
+
+// Builds a bundle, throwing it away, to give its dependency graph
+func DependencyGraph(repo Repository, entrypoint string,
+	opts Options) (*Graph, error) {
+
+	opts.SourceMap = nil
+	result, err := Build(repo, entrypoint, ioutil.Discard, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Graph, nil
+}
+
+// Gives the graph of every module placed, including any tree shaking dropped
+// or scope hoisting inlined
+func (fs *FileSet) graph() *Graph {
+	g := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	for _, entry := range fs.byId() {
+		g.Nodes = append(g.Nodes, GraphNode{entry.path, entry.id, len(entry.src)})
+
+		specifiers := make([]string, 0, len(entry.deps))
+		for specifier := range entry.deps {
+			specifiers = append(specifiers, specifier)
+		}
+		sort.Strings(specifiers)
+		for _, specifier := range specifiers {
+			g.Edges = append(g.Edges,
+				GraphEdge{entry.path, specifier, entry.deps[specifier].path})
+		}
+	}
+	return g
+}
+
+// Writes the graph as indented JSON
+func (g *Graph) WriteJSON(w io.Writer) error {
+	bs, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+// Writes the graph in Graphviz's DOT language. Each module is labelled with
+// its path, id and size, and each require with its specifier.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("digraph modules {\n  node [shape=box];\n")
+	for _, node := range g.Nodes {
+		fmt.Fprintf(buf, "  %s [label=%s];\n", dotQuote(node.Path),
+			dotQuote(fmt.Sprintf("%s\n#%d, %d bytes", node.Path, node.Id, node.Size)))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(buf, "  %s -> %s [label=%s];\n", dotQuote(edge.From),
+			dotQuote(edge.To), dotQuote(edge.Specifier))
+	}
+	buf.WriteString("}\n")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
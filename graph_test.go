@@ -0,0 +1,87 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dependency graph", func() {
+
+	graph := func(files map[string]string) *Graph {
+		repo := memoryRepository(files)
+		defer repo.Close()
+		g, err := DependencyGraph(repo, "index.js", Options{})
+		Expect(err).ToNot(HaveOccurred())
+		return g
+	}
+
+	files := map[string]string{
+		"index.js":  "require('./b'); require('./a')",
+		"a.js":      "require('./shared')",
+		"b.js":      "require('./shared.js')",
+		"shared.js": "module.exports = 1",
+	}
+
+	It("should give each module, and each require between them", func() {
+		g := graph(files)
+		Expect(g.Nodes).To(Equal([]GraphNode{
+			{"index.js", 0, 30},
+			{"b.js", 1, 22},
+			{"shared.js", 2, 18},
+			{"a.js", 3, 19},
+		}))
+		Expect(g.Edges).To(Equal([]GraphEdge{
+			{"index.js", "./a", "a.js"},
+			{"index.js", "./b", "b.js"},
+			{"b.js", "./shared.js", "shared.js"},
+			{"a.js", "./shared", "shared.js"},
+		}))
+	})
+
+	It("should write the graph as JSON", func() {
+		out := &bytes.Buffer{}
+		Expect(graph(files).WriteJSON(out)).To(Succeed())
+
+		var decoded struct {
+			Nodes []map[string]interface{}
+			Edges []map[string]string
+		}
+		Expect(json.Unmarshal(out.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded.Nodes[0]).To(Equal(map[string]interface{}{
+			"path": "index.js", "id": 0.0, "size": 30.0,
+		}))
+		Expect(decoded.Edges[0]).To(Equal(map[string]string{
+			"from": "index.js", "specifier": "./a", "to": "a.js",
+		}))
+	})
+
+	It("should write the graph as DOT", func() {
+		out := &bytes.Buffer{}
+		Expect(graph(map[string]string{
+			"index.js":    `require('./"quoted"')`,
+			`"quoted".js`: "",
+		}).WriteDOT(out)).To(Succeed())
+		Expect(out.String()).To(Equal(`digraph modules {
+  node [shape=box];
+  "index.js" [label="index.js\n#0, 21 bytes"];
+  "\"quoted\".js" [label="\"quoted\".js\n#1, 0 bytes"];
+  "index.js" -> "\"quoted\".js" [label="./\"quoted\""];
+}
+`))
+	})
+
+	It("should keep modules tree shaking dropped", func() {
+		repo := memoryRepository(map[string]string{
+			"index.js":     "import './unused'",
+			"unused.js":    "export var x = 1",
+			"package.json": `{"sideEffects": false}`,
+		})
+		defer repo.Close()
+		g, err := DependencyGraph(repo, "index.js", Options{TreeShake: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g.Nodes).To(HaveLen(2))
+	})
+})
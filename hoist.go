@@ -0,0 +1,446 @@
+package jssquish
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	"github.com/robertkrimen/otto/ast"
+)
+
+// A `require` call with a string literal, as far as scope hoisting cares
+type hoistCall struct {
+	spec       string
+	start, end int
+
+	// Where the string literal argument is
+	argStart, argEnd int
+}
+
+// What scope hoisting knows of a module
+type moduleHoist struct {
+	ms    *moduleShake
+	calls []*hoistCall
+
+	// The start of each top-level statement which does nothing but require a
+	// module, keyed by the offset of its `require` call. A module can be
+	// inlined in place of any of these.
+	statements map[int]int
+
+	// Whether the module can be inlined into another at all
+	hoistable bool
+	strict    bool
+
+	// Once hoisted, the module it's inlined into, and the new names of its top
+	// level, including `module` and `exports`
+	parent          *srcEntry
+	renames         map[int]string
+	module, exports string
+}
+
+// Inlines modules into the module requiring them where it's safe to, so that
+// they share its scope rather than each having a wrapper of their own. A
+// module can be hoisted when a single other module requires it, only from
+// top-level statements which do nothing else, as it can then be run just
+// before the first of them, exactly as it would have been. It also mustn't
+// require anything dynamically, or be able to tell it's been moved: the
+// top-level `this`, `arguments`, `eval`, and `with` are all out. Every
+// top-level name of a hoisted module is given a new name nothing else in the
+// bundle uses.
+func (fs *FileSet) hoist(root *srcEntry) error {
+	var live []*srcEntry
+	hoists := make(map[*srcEntry]*moduleHoist)
+	for _, entry := range fs.order {
+		if entry.dropped {
+			continue
+		}
+		mh, err := analyzeHoist(entry)
+		if err != nil {
+			return err
+		}
+		live = append(live, entry)
+		hoists[entry] = mh
+	}
+
+	// Work out where each module is required from
+	type importer struct {
+		entry *srcEntry
+		call  *hoistCall
+	}
+	importers := make(map[*srcEntry][]importer)
+	for _, entry := range live {
+		for _, call := range hoists[entry].calls {
+			if dep := entry.deps[call.spec]; dep != nil && !dep.dropped {
+				importers[dep] = append(importers[dep], importer{entry, call})
+			}
+		}
+	}
+	for _, entry := range live {
+		mh := hoists[entry]
+		if entry == root || !mh.hoistable || len(importers[entry]) == 0 {
+			mh.hoistable = false
+			continue
+		}
+		for _, imp := range importers[entry] {
+			_, top := hoists[imp.entry].statements[imp.call.start]
+			if !top || imp.entry != importers[entry][0].entry {
+				mh.hoistable = false
+			}
+		}
+		if mh.hoistable {
+			mh.parent = importers[entry][0].entry
+		}
+	}
+
+	// Each hoisted module ends up in the scope of the closest module above it
+	// which isn't hoisted itself. It has to agree with that module on strict
+	// mode, and mustn't use any global that module declares. Giving up on one
+	// module can change where others end up, so this goes until it settles.
+	groupOf := func(entry *srcEntry) *srcEntry {
+		seen := make(map[*srcEntry]bool)
+		for hoists[entry].hoistable {
+			if seen[entry] {
+				return nil
+			}
+			seen[entry] = true
+			entry = hoists[entry].parent
+		}
+		return entry
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, entry := range live {
+			mh := hoists[entry]
+			if !mh.hoistable {
+				continue
+			}
+			group := groupOf(entry)
+			if group == nil || hoists[group].strict != mh.strict ||
+				shadowsGlobal(hoists[group].ms.tree.root, mh.ms.tree.root) {
+				mh.hoistable = false
+				changed = true
+			}
+		}
+	}
+
+	// New names can't be anything already used anywhere
+	taken := make(map[string]bool)
+	for _, entry := range live {
+		for _, ref := range hoists[entry].ms.tree.refs {
+			taken[ref.name] = true
+		}
+	}
+	for _, entry := range live {
+		mh := hoists[entry]
+		if !mh.hoistable {
+			continue
+		}
+		entry.hoisted = true
+		mh.renames = make(map[int]string)
+		for name, b := range mh.ms.tree.root.bindings {
+			if name == "require" {
+				continue
+			}
+			newName := name + "$" + strconv.Itoa(entry.id)
+			for taken[newName] {
+				newName += "$"
+			}
+			taken[newName] = true
+			for _, site := range b.sites {
+				if !mh.ms.isRemoved(site) {
+					mh.renames[site] = newName
+				}
+			}
+			switch name {
+			case "module":
+				mh.module = newName
+			case "exports":
+				mh.exports = newName
+			}
+		}
+	}
+
+	for _, entry := range live {
+		if entry.hoisted || !hasInlined(entry, hoists) {
+			continue
+		}
+		hb := &hoistBuilder{hoists: hoists, origins: []lineOrigin{{0, 0}}}
+		hb.build(entry, hb.add(entry))
+
+		src := hb.buf.Bytes()
+		program, err := parseProgram(src, entry.path)
+		if err != nil {
+			return err
+		}
+		entry.body = &moduleBody{
+			src:     src,
+			program: program,
+			sources: hb.sources,
+			origins: hb.origins,
+		}
+	}
+	return nil
+}
+
+// Finds what scope hoisting needs to know of a module
+func analyzeHoist(entry *srcEntry) (*moduleHoist, error) {
+	ms := entry.shake
+	if ms == nil {
+		var err error
+		if ms, err = analyzeModule(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	mh := &moduleHoist{
+		ms:         ms,
+		statements: make(map[int]int),
+		strict:     isStrict(entry.program),
+	}
+	hv := &hoistVisitor{mh: mh}
+	for _, stmt := range entry.program.Body {
+		if err := WalkNode(hv, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	body := entry.program.Body
+	for i, stmt := range body {
+		s := span{int(stmt.Idx0()) - 1, len(entry.src), true}
+		if i+1 < len(body) {
+			s.end = int(body[i+1].Idx0()) - 1
+		}
+
+		only := false
+		switch t := stmt.(type) {
+		case *ast.VariableStatement:
+			if len(t.List) == 1 {
+				if ve, ok := t.List[0].(*ast.VariableExpression); ok {
+					_, only = ms.requireExpression(ve.Initializer)
+				}
+			}
+		case *ast.ExpressionStatement:
+			_, _, only = ms.requireCall(t.Expression)
+		}
+		if !only {
+			continue
+		}
+		for _, call := range mh.calls {
+			if s.contains(call.start) {
+				mh.statements[call.start] = s.start
+			}
+		}
+	}
+
+	// Every use of `require` has to be a call we know the module for, and
+	// every top-level name has to be one we can rename
+	root := ms.tree.root
+	mh.hoistable = !root.frozen && !hv.thisAtTop
+	calls := make(map[int]bool, len(mh.calls))
+	for _, call := range mh.calls {
+		calls[call.start] = true
+	}
+	for _, site := range root.bindings["require"].sites {
+		if !calls[site] && !ms.isRemoved(site) {
+			mh.hoistable = false
+		}
+	}
+	for _, b := range root.bindings {
+		if b.pinned {
+			mh.hoistable = false
+		}
+	}
+	for _, ref := range root.outerRefs {
+		if ref.name == "arguments" && ref.scope.functionScope() == root &&
+			!ms.isRemoved(ref.offset) {
+			mh.hoistable = false
+		}
+	}
+	return mh, nil
+}
+
+// Whether a module inlined into `group` would find one of its globals declared
+// there instead
+func shadowsGlobal(group, inlined *scope) bool {
+	for _, ref := range inlined.outerRefs {
+		if _, ok := group.bindings[ref.name]; ok && ref.binding == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func hasInlined(entry *srcEntry, hoists map[*srcEntry]*moduleHoist) bool {
+	for _, dep := range entry.deps {
+		if dep.hoisted && hoists[dep].parent == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a program starts with a "use strict" directive
+func isStrict(program *ast.Program) bool {
+	for _, stmt := range program.Body {
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !ok {
+			return false
+		}
+		str, ok := es.Expression.(*ast.StringLiteral)
+		if !ok {
+			return false
+		}
+		if str.Literal[1:len(str.Literal)-1] == "use strict" {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds every `require` call of a module, and whether it uses `this` at the
+// top level
+type hoistVisitor struct {
+	mh        *moduleHoist
+	depth     int
+	thisAtTop bool
+}
+
+func (hv *hoistVisitor) Visit(n ast.Node) bool {
+	switch t := n.(type) {
+	case *ast.CallExpression:
+		if spec, offset, ok := hv.mh.ms.requireCall(t); ok &&
+			!hv.mh.ms.isRemoved(offset) {
+			arg := t.ArgumentList[0].(*ast.StringLiteral)
+			hv.mh.calls = append(hv.mh.calls, &hoistCall{
+				spec:     spec,
+				start:    offset,
+				end:      int(t.RightParenthesis),
+				argStart: int(arg.Idx) - 1,
+				argEnd:   int(arg.Idx) - 1 + len(arg.Literal),
+			})
+		}
+
+	case *ast.ThisExpression:
+		if hv.depth == 0 && !hv.mh.ms.isRemoved(int(t.Idx)-1) {
+			hv.thisAtTop = true
+		}
+
+	case *ast.FunctionLiteral:
+		inner := *hv
+		inner.depth++
+		if err := WalkNode(&inner, t.Body); err != nil {
+			return false
+		}
+		hv.thisAtTop = inner.thisAtTop
+		return false
+	}
+	return true
+}
+
+// Puts a module and everything hoisted into it together, keeping track of
+// where each line came from
+type hoistBuilder struct {
+	hoists  map[*srcEntry]*moduleHoist
+	buf     bytes.Buffer
+	sources []bodySource
+	origins []lineOrigin
+}
+
+// A change to make to a module's source as it's copied
+type hoistEdit struct {
+	start, end int
+	text       string
+	inline     *srcEntry
+}
+
+func (hb *hoistBuilder) add(entry *srcEntry) int {
+	hb.sources = append(hb.sources, bodySource{entry.path, entry.src})
+	return len(hb.sources) - 1
+}
+
+// Starts a new line, which came from the given line of a source
+func (hb *hoistBuilder) newline(source, line int) {
+	hb.buf.WriteByte('\n')
+	hb.origins = append(hb.origins, lineOrigin{source, line})
+}
+
+// Copies part of a source, which starts on the given line, returning the line
+// it finishes on
+func (hb *hoistBuilder) copy(src []byte, source, line int) int {
+	for {
+		i := bytes.IndexByte(src, '\n')
+		if i < 0 {
+			hb.buf.Write(src)
+			return line
+		}
+		hb.buf.Write(src[:i])
+		line++
+		hb.newline(source, line)
+		src = src[i+1:]
+	}
+}
+
+func (hb *hoistBuilder) build(entry *srcEntry, source int) {
+	mh := hb.hoists[entry]
+	src := entry.src
+	if entry.shake != nil {
+		src = blank(src, entry.shake.removed)
+	}
+
+	var edits []hoistEdit
+	if entry.hoisted {
+		hb.buf.WriteString("var " + mh.module + " = {exports: {}}, " +
+			mh.exports + " = " + mh.module + ".exports; ")
+		for site, name := range mh.renames {
+			oldName := mh.ms.refs[site].name
+			edits = append(edits, hoistEdit{start: site, end: site + len(oldName),
+				text: name})
+		}
+	}
+
+	inlined := make(map[*srcEntry]bool)
+	for _, call := range mh.calls {
+		dep := entry.deps[call.spec]
+		if dep == nil || dep.dropped {
+			continue
+		}
+		if dep.hoisted && hb.hoists[dep].parent == entry {
+			if !inlined[dep] {
+				inlined[dep] = true
+				at := mh.statements[call.start]
+				edits = append(edits, hoistEdit{start: at, end: at, inline: dep})
+			}
+			edits = append(edits, hoistEdit{start: call.start, end: call.end,
+				text: hb.hoists[dep].module + ".exports"})
+		} else if entry.hoisted {
+			// The `require` given to the module being inlined into doesn't know
+			// this module's names for things, but does know every module's id
+			edits = append(edits, hoistEdit{start: call.argStart,
+				end: call.argEnd, text: strconv.Itoa(dep.id)})
+		}
+	}
+
+	// Modules are inlined in the order they're first required, ahead of the
+	// `require` call which may start the same statement
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].inline != nil && edits[j].inline == nil
+	})
+
+	pos, line := 0, 0
+	for _, edit := range edits {
+		line = hb.copy(src[pos:edit.start], source, line)
+		if edit.inline != nil {
+			inlined := hb.add(edit.inline)
+			hb.newline(inlined, 0)
+			hb.build(edit.inline, inlined)
+			hb.newline(source, line)
+		} else {
+			hb.buf.WriteString(edit.text)
+		}
+		pos = edit.end
+	}
+	hb.copy(src[pos:], source, line)
+}
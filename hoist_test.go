@@ -0,0 +1,176 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scope hoisting", func() {
+
+	hoisted := func(files map[string]string) string {
+		return squish(files, Options{ScopeHoist: true})
+	}
+
+	// Runs a bundle, returning what it left in the global `result`
+	run := func(bundle string) interface{} {
+		vm := otto.New()
+		_, err := vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		result, err := vm.Get("result")
+		Expect(err).ToNot(HaveOccurred())
+		value, err := result.Export()
+		Expect(err).ToNot(HaveOccurred())
+		return value
+	}
+
+	It("should inline a module required from one place", func() {
+		out := hoisted(map[string]string{
+			"index.js": "var helper = 3;\nvar lib = require('./lib');\n" +
+				"result = lib.twice(helper)",
+			"lib.js": "var helper = 2;\nexports.twice = function (x) { return x * helper }",
+		})
+		Expect(out).To(ContainSubstring("var helper$1 = 2;"))
+		Expect(out).To(ContainSubstring("var lib = module$1.exports;"))
+		Expect(out).ToNot(ContainSubstring(`"./lib"`))
+		Expect(run(out)).To(BeEquivalentTo(6))
+	})
+
+	It("should run inlined modules when they'd have been required", func() {
+		out := hoisted(map[string]string{
+			"index.js": "result = ['index'];\nrequire('./a');\nresult.push('middle');\n" +
+				"require('./b');",
+			"a.js": "result.push('a');\nrequire('./c');",
+			"b.js": "result.push('b');",
+			"c.js": "result.push('c');",
+		})
+		Expect(out).ToNot(ContainSubstring(`"./`))
+		Expect(run(out)).To(Equal([]string{"index", "a", "c", "middle", "b"}))
+	})
+
+	It("should inline ES modules", func() {
+		out := hoisted(map[string]string{
+			"index.js": "import answer, {half} from './lib'; result = half(answer)",
+			"lib.js":   "export default 42; export function half(n) { return n / 2 }",
+		})
+		Expect(out).ToNot(ContainSubstring(`"./lib"`))
+		Expect(run(out)).To(BeEquivalentTo(21))
+	})
+
+	It("should keep a module required from several places wrapped", func() {
+		out := hoisted(map[string]string{
+			"index.js":  "var a = require('./a'); result = a + require('./shared')",
+			"a.js":      "module.exports = require('./shared') * 2",
+			"shared.js": "module.exports = 1",
+		})
+		Expect(out).ToNot(ContainSubstring(`"./a"`))
+		Expect(out).To(ContainSubstring(`"./shared"`))
+		Expect(out).To(MatchRegexp(`module\$\d+\.exports = require\(\d+\) \* 2`))
+		Expect(run(out)).To(BeEquivalentTo(3))
+	})
+
+	It("should keep a module required from inside a function wrapped", func() {
+		out := hoisted(map[string]string{
+			"index.js": "function load() { return require('./lib') }; result = load()",
+			"lib.js":   "module.exports = 'lib'",
+		})
+		Expect(out).To(ContainSubstring(`"./lib"`))
+		Expect(run(out)).To(Equal("lib"))
+	})
+
+	It("should keep modules which could tell they'd moved wrapped", func() {
+		for _, src := range []string{
+			"var name = './other'; module.exports = require(name)",
+			"this.a = 1",
+			"module.exports = arguments.length",
+			"module.exports = eval('1')",
+			"'use strict'; module.exports = 1",
+		} {
+			out := hoisted(map[string]string{
+				"index.js": "result = require('./lib')",
+				"lib.js":   src,
+				"other.js": "",
+			})
+			Expect(out).To(ContainSubstring(`"./lib"`), src)
+		}
+	})
+
+	It("should keep a module using a global the importer declares wrapped", func() {
+		out := hoisted(map[string]string{
+			"index.js": "var seen = require('./lib'); var name = 'local'; result = seen",
+			"lib.js":   "module.exports = typeof name",
+		})
+		Expect(out).To(ContainSubstring(`"./lib"`))
+		Expect(run(out)).To(Equal("undefined"))
+	})
+
+	It("should map inlined lines back to their own sources", func() {
+		files := map[string]string{
+			"index.js": "var lib = require('./lib');\nresult = lib",
+			"lib.js":   "// lib\nmodule.exports = 'lib'",
+		}
+		repo := memoryRepository(files)
+		defer repo.Close()
+
+		out, sourceMap := &bytes.Buffer{}, &bytes.Buffer{}
+		Expect(MainWithOptions(repo, "index.js", out, Options{
+			ScopeHoist: true,
+			SourceMap:  sourceMap,
+		})).To(Succeed())
+
+		var decoded struct {
+			Sources  []string
+			Mappings string
+		}
+		Expect(json.Unmarshal(sourceMap.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded.Sources).To(Equal([]string{"index.js", "lib.js"}))
+
+		// Find the generated line of the inlined `module.exports`, which should
+		// map to the second line of lib.js
+		lines := strings.Split(out.String(), "\n")
+		mappings := strings.Split(decoded.Mappings, ";")
+		source, line := 0, 0
+		for i, segment := range mappings {
+			if segment == "" {
+				continue
+			}
+			var fields []int
+			for rest := segment; rest != ""; {
+				var n int
+				n, rest = decodeVLQ(rest)
+				fields = append(fields, n)
+			}
+			source += fields[1]
+			line += fields[2]
+			if strings.Contains(lines[i], "module$1.exports = 'lib'") {
+				Expect(source).To(Equal(1))
+				Expect(line).To(Equal(1))
+				return
+			}
+		}
+		Fail("no mapping for the inlined module")
+	})
+})
+
+// Reads a single base64 VLQ from the start of a source map segment
+func decodeVLQ(s string) (int, string) {
+	v, shift := 0, uint(0)
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(vlqBase64, s[i])
+		v |= (digit & 31) << shift
+		shift += 5
+		if digit&32 == 0 {
+			s = s[i+1:]
+			break
+		}
+	}
+	if v&1 != 0 {
+		return -(v >> 1), s
+	}
+	return v >> 1, s
+}
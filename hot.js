@@ -0,0 +1,122 @@
+  // Hot module replacement. Updated modules are read from an event stream, as
+  // an object of module wrappers keyed by id, just like `modules`. Each one is
+  // swapped in, and every module it invalidates is run again, up to the modules
+  // which accept the change.
+  var hotURL = {{.HotURL}};
+  var hotParents = {}, hotStates = {}, hotData = {};
+
+  // Remembers that `parent` requires `id`, so a change can be passed up to it
+  function hotRequired(id, parent) {
+    (hotParents[id] = hotParents[id] || {})[parent] = true;
+  }
+
+  // Creates the `module.hot` of a module as it's run
+  function hotModule(name) {
+    var state = hotStates[name] = {self: false, deps: {}, dispose: []};
+    var data = hotData[name];
+    delete hotData[name];
+
+    return {
+      // Data passed on by the dispose handlers of the module's last instance
+      data: data,
+
+      // With no dependencies, accepts changes to this module, which is then run
+      // again. Otherwise, accepts changes to the required dependencies, which
+      // are run again before calling `callback`.
+      accept: function(deps, callback) {
+        if (deps === undefined || typeof deps === 'function') {
+          state.self = true;
+          return;
+        }
+        if (typeof deps === 'string') deps = [deps];
+        for (var i = 0; i < deps.length; i++) {
+          var id = modules[name][1][deps[i]];
+          if (id !== undefined) state.deps[id] = callback || function() {};
+        }
+      },
+
+      // Calls `callback` with an object to pass to the module's next instance,
+      // when this one's replaced
+      dispose: function(callback) {
+        state.dispose.push(callback);
+      }
+    };
+  }
+
+  // Applies an update, returning whether it could be without reloading
+  function hotApply(updates) {
+    var stale = {}, boundaries = [], accepted = [], queue = [], id, parent;
+    for (id in updates) {
+      modules[id] = updates[id];
+      if (cache[id]) queue.push(id);
+    }
+
+    // Find every module which needs running again, and what accepts them
+    while (queue.length) {
+      id = queue.shift();
+      if (stale[id]) continue;
+      stale[id] = true;
+
+      if (hotStates[id] && hotStates[id].self) {
+        boundaries.push(id);
+        continue;
+      }
+      var required = false;
+      for (parent in hotParents[id]) {
+        if (!cache[parent]) continue;
+        required = true;
+        var callback = hotStates[parent] && hotStates[parent].deps[id];
+        if (callback) accepted.push([parent, id, callback]);
+        else queue.push(parent);
+      }
+      if (!required) return false;
+    }
+
+    for (id in stale) {
+      var state = hotStates[id], data = {};
+      for (var i = 0; state && i < state.dispose.length; i++) {
+        state.dispose[i](data);
+      }
+      hotData[id] = data;
+      delete hotStates[id];
+      delete cache[id];
+      for (var dep in hotParents) delete hotParents[dep][id];
+    }
+
+    for (i = 0; i < boundaries.length; i++) newRequire(boundaries[i]);
+    for (i = 0; i < accepted.length; i++) {
+      if (stale[accepted[i][0]]) continue;
+      newRequire(accepted[i][1]);
+      accepted[i][2]();
+    }
+    return true;
+  }
+
+  function hotReload(reason) {
+    console.warn('[js-squish] ' + reason + ', reloading');
+    if (typeof location !== 'undefined') location.reload();
+  }
+
+  if (typeof EventSource !== 'undefined') {
+    var script = typeof document !== 'undefined' && document.currentScript;
+    if (script && script.src) hotURL = new URL(hotURL, script.src).href;
+
+    var hotEvents = new EventSource(hotURL);
+    hotEvents.addEventListener('update', function(e) {
+      var updates = (0, eval)('({' + e.data + '})'), ids = [];
+      for (var id in updates) ids.push(id);
+      try {
+        if (!hotApply(updates)) return hotReload('nothing accepted the update');
+      } catch (err) {
+        console.error(err);
+        return hotReload('the update failed');
+      }
+      console.log('[js-squish] updated modules ' + ids.join(', '));
+    });
+    hotEvents.addEventListener('failed', function(e) {
+      console.error('[js-squish] ' + e.data);
+    });
+    hotEvents.addEventListener('reload', function() {
+      hotReload('missed an update');
+    });
+  }
@@ -0,0 +1,292 @@
+package jssquish
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Location of a file's contents within an archive. For tars, `offset` is into
+// the decompressed stream, which for uncompressed tars is the file itself.
+type indexEntry struct {
+	offset int64
+	size   int64
+	zf     *zip.File
+}
+
+// `Repository` implementation which scans an archive once to build an index of
+// where each file lives, and reads files on demand. Uncompressed tars are read
+// by seeking straight to a file's contents. Compressed tars can't be seeked,
+// so their contents are decompressed on demand, and kept in a bounded LRU for
+// repeat reads. Either way, memory use scales with the files actually opened,
+// rather than with the size of the archive.
+//
+// Reading a compressed tar is cheapest in archive order. A read which falls
+// behind the previous one has to start decompressing from the beginning.
+//
+// The repository takes ownership of the given file, and closes it on `Close`.
+type IndexedRepository struct {
+	f      *os.File
+	format archiveFormat
+	index  map[string]*indexEntry
+
+	mu     sync.Mutex
+	cache  *lruCache
+	cursor *streamCursor
+}
+
+// Creates a new `IndexedRepository` from a `js_tar`, or any other archive
+// `iterateArchive` understands. `cacheSize` bounds the number of decompressed
+// bytes kept around for compressed tars.
+func NewIndexedJsTarRepository(f *os.File,
+	cacheSize int64) (*IndexedRepository, error) {
+
+	format, err := detectArchive(f)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &IndexedRepository{
+		f:      f,
+		format: format,
+		index:  make(map[string]*indexEntry),
+		cache:  newLRUCache(cacheSize),
+	}
+
+	if format == formatZip {
+		err = repo.indexZip()
+	} else {
+		err = repo.indexTar()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Checks the index to see if the requested path is in the archive
+func (ir *IndexedRepository) IsFile(path string) bool {
+	_, ok := ir.index[path]
+	return ok
+}
+
+// Returns a reader over the requested file's contents. It's safe to have many
+// of these open at once.
+func (ir *IndexedRepository) Open(path string) (io.ReadCloser, error) {
+	entry, ok := ir.index[path]
+	if !ok {
+		return nil, fmt.Errorf("Could not open path: %s", path)
+	}
+
+	switch {
+	case entry.zf != nil:
+		return entry.zf.Open()
+
+	case ir.format == formatTar:
+		section := io.NewSectionReader(ir.f, entry.offset, entry.size)
+		return ioutil.NopCloser(section), nil
+	}
+
+	contents, err := ir.decompress(path, entry)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// Releases any decompressor state, and closes the underlying archive.
+func (ir *IndexedRepository) Close() error {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	if ir.cursor != nil {
+		ir.cursor.release()
+		ir.cursor = nil
+	}
+	ir.cache = newLRUCache(0)
+	return ir.f.Close()
+}
+
+// Records the offset and size of every regular file in a tar. The offsets are
+// taken from how much of the (decompressed) stream the tar reader has consumed
+// when it hands back a header, which is exactly where the contents begin.
+func (ir *IndexedRepository) indexTar() error {
+	stream, release, err := openTarStream(ir.f, ir.format)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	counter := &countingReader{r: stream}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg || isSparse(hdr) {
+			continue
+		}
+
+		ir.index[filepath.Clean(hdr.Name)] = &indexEntry{
+			offset: counter.n,
+			size:   hdr.Size,
+		}
+	}
+}
+
+// Sparse files don't have their contents laid out contiguously, and aren't
+// worth the trouble to index.
+func isSparse(hdr *tar.Header) bool {
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (ir *IndexedRepository) indexZip() error {
+	fi, err := ir.f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(ir.f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if zf.Mode().IsRegular() {
+			ir.index[filepath.Clean(zf.Name)] = &indexEntry{
+				size: int64(zf.UncompressedSize64),
+				zf:   zf,
+			}
+		}
+	}
+	return nil
+}
+
+// Reads a file's contents out of a compressed tar, consulting the cache first.
+func (ir *IndexedRepository) decompress(path string,
+	entry *indexEntry) ([]byte, error) {
+
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	if contents, ok := ir.cache.Get(path); ok {
+		return contents, nil
+	}
+
+	// The stream only goes forward. If we're already past this file, start
+	// over from the top.
+	if ir.cursor == nil || ir.cursor.n > entry.offset {
+		if ir.cursor != nil {
+			ir.cursor.release()
+			ir.cursor = nil
+		}
+		stream, release, err := openTarStream(ir.f, ir.format)
+		if err != nil {
+			return nil, err
+		}
+		ir.cursor = &streamCursor{
+			countingReader: countingReader{r: stream},
+			release:        release,
+		}
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, ir.cursor,
+		entry.offset-ir.cursor.n); err != nil {
+		return nil, err
+	}
+	contents := make([]byte, entry.size)
+	if _, err := io.ReadFull(ir.cursor, contents); err != nil {
+		return nil, err
+	}
+
+	ir.cache.Put(path, contents)
+	return contents, nil
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// A decompressed stream left open between reads, and how far into it we are
+type streamCursor struct {
+	countingReader
+	release func()
+}
+
+// Least-recently-used cache of file contents, bounded by their total size.
+// Contents larger than the whole cache are never kept. It is not safe for
+// concurrent use.
+type lruCache struct {
+	capacity int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	contents []byte
+}
+
+func newLRUCache(capacity int64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (lc *lruCache) Get(key string) ([]byte, bool) {
+	elem, ok := lc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	lc.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).contents, true
+}
+
+func (lc *lruCache) Put(key string, contents []byte) {
+	if int64(len(contents)) > lc.capacity {
+		return
+	}
+	if elem, ok := lc.entries[key]; ok {
+		lc.size -= int64(len(elem.Value.(*lruEntry).contents))
+		lc.order.Remove(elem)
+	}
+
+	lc.entries[key] = lc.order.PushFront(&lruEntry{key, contents})
+	lc.size += int64(len(contents))
+
+	for lc.size > lc.capacity {
+		oldest := lc.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		lc.order.Remove(oldest)
+		delete(lc.entries, entry.key)
+		lc.size -= int64(len(entry.contents))
+	}
+}
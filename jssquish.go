@@ -4,14 +4,147 @@ import (
 	"io"
 )
 
+// The version of js-squish. Cached builds are only reused by the same version,
+// so this must change whenever a change to js-squish changes what's cached.
+const Version = "0.5.1"
+
+// Options controlling how a bundle is written
+type Options struct {
+	// The value given to `process.env.NODE_ENV`, or nil to leave it undefined
+	Environment *string
+
+	// Strip comments and whitespace, and shorten local names
+	Minify bool
+
+	// Remove exports which nothing uses, and modules nothing needs
+	TreeShake bool
+
+	// Inline modules into the module requiring them, sharing its scope, wherever
+	// that's safe
+	ScopeHoist bool
+
+	// How many files to read and parse at once. Zero means one per CPU.
+	Jobs int
+
+	// A directory to keep what's known of each file in between builds, so that
+	// unchanged files needn't be compiled or parsed again. Empty means no
+	// cache. Only the built in transforms are cached; `Transforms` are run on
+	// every build.
+	CacheDir string
+
+	// Parsed modules kept in memory between builds, for a process which makes
+	// many bundles
+	ParseCache *ParseCache
+
+	// When set, a source map for the bundle is written here
+	SourceMap io.Writer
+
+	// Where the source map can be found relative to the bundle. When set, the
+	// bundle ends with a `//# sourceMappingURL` comment pointing to it.
+	SourceMapURL string
+
+	// Trace how each require is resolved, so that an error resolving one says
+	// every path that was tried
+	Verbose bool
+
+	// Transforms run on each file they apply to before it's parsed, in order.
+	// A source map maps the bundle to what the transforms gave. The built in
+	// transforms compiling JSX and TypeScript run first, unless placed
+	// elsewhere with `BuiltinTransforms`.
+	Transforms []TransformRule
+
+	// How `.jsx` files, and any others with JSX in them, are compiled
+	JSX JSXOptions
+
+	// The loader making files of each extension, such as ".svg", into modules,
+	// over the defaults. Text files are exported as strings, CSS is added to
+	// the page, and images and fonts are inlined as data URIs. Loaders run
+	// after any transforms.
+	Loaders map[string]Loader
+
+	// The largest file, in bytes, inlined as a data URI. Zero means 32 KB.
+	InlineLimit int
+
+	// When set, the CSS of every stylesheet required is written here, in the
+	// order they're required, rather than being added to the page by the
+	// bundle. Each stylesheet's module is left empty.
+	CSS io.Writer
+
+	// The directory `CSS` is written to, relative to the root of the
+	// repository. Relative `url()`s in stylesheets are rewritten to be
+	// relative to it.
+	CSSDir string
+
+	// When set, a source map for `CSS` is written here, and when
+	// `CSSSourceMapURL` is set too, `CSS` ends with a comment pointing to it
+	CSSSourceMap    io.Writer
+	CSSSourceMapURL string
+
+	// Write modules with identical contents only once, where they require the
+	// same modules, giving every require of any of them the same module. See
+	// `BuildResult.Duplicates`.
+	Dedupe bool
+
+	// Work out how big each module would be minified, even when the bundle
+	// isn't, for `NewStats`
+	Stats bool
+
+	// When set, the bundle includes a hot module replacement runtime, which
+	// reads updated modules from the event stream at this URL, relative to the
+	// bundle. See `DevServer`.
+	HotURL string
+}
+
 func Main(
 	repo Repository,
 	entrypoint string,
 	environment *string,
 	out io.Writer) error {
+	return MainWithOptions(repo, entrypoint, out, Options{
+		Environment: environment,
+	})
+}
+
+func MainWithOptions(
+	repo Repository,
+	entrypoint string,
+	out io.Writer,
+	opts Options) error {
+	_, err := Build(repo, entrypoint, out, opts)
+	return err
+}
+
+// What went into a bundle
+type BuildResult struct {
+	// Every file read from the repository, sorted, including those transforms
+	// read. When a build fails, these are the files read before it did, which
+	// are what need to change to fix it.
+	Files []string
+
+	// Each module written, in the order it was
+	Modules []WrittenModule
+
+	// The dependency graph of the bundle, or nil if the build failed
+	Graph *Graph
+
+	// Packages bundled at more than one version, and modules bundled more than
+	// once with identical contents
+	Duplicates []Duplicate
+
+	// The stylesheets written to `Options.CSS`, in the order they were
+	Stylesheets []string
+}
+
+// Writes a bundle, like `MainWithOptions`, also describing what went into it.
+// The result is given even if the build fails.
+func Build(
+	repo Repository,
+	entrypoint string,
+	out io.Writer,
+	opts Options) (*BuildResult, error) {
 	var (
-		resolver = NewResolver(repo)
-		writer   = NewWriter(out)
+		resolver = NewResolverWithOptions(repo, opts)
+		writer   = NewWriterWithOptions(out, opts)
 	)
 
 	fs := &FileSet{
@@ -19,11 +152,32 @@ func Main(
 		resolver: resolver,
 		writer:   writer,
 		entries:  make(map[string]*srcEntry),
+
+		jobs:        opts.Jobs,
+		parsed:      opts.ParseCache,
+		parse:       opts.Minify || opts.TreeShake || opts.ScopeHoist || opts.Stats,
+		treeShake:   opts.TreeShake,
+		scopeHoist:  opts.ScopeHoist,
+		loaders:     loaders(opts.Loaders),
+		inlineLimit: opts.InlineLimit,
+		css:         newCSSWriter(opts),
+		deduplicate: opts.Dedupe,
+	}
+
+	if opts.CacheDir != "" {
+		cache, err := newBuildCache(opts.CacheDir)
+		if err != nil {
+			return &BuildResult{}, err
+		}
+		fs.cache = cache
 	}
+	fs.transforms = buildTransforms(opts, fs.cache)
 
-	if environment == nil {
-		return fs.Create(entrypoint)
-	} else {
-		return fs.CreateWithNodeEnv(entrypoint, environment)
+	err := fs.CreateWithNodeEnv(entrypoint, opts.Environment)
+	result := &BuildResult{Files: fs.loaded, Modules: writer.modules,
+		Duplicates: fs.dups, Stylesheets: fs.stylesheets}
+	if err == nil {
+		result.Graph = fs.graph()
 	}
+	return result, err
 }
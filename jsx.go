@@ -0,0 +1,701 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// How JSX is compiled. The zero value compiles elements to
+// `React.createElement` calls.
+type JSXOptions struct {
+	// The function called to make each element. Defaults to
+	// `React.createElement`.
+	Factory string
+
+	// What fragments are made from. Defaults to `React.Fragment`.
+	Fragment string
+
+	// Make elements with the `jsx` and `jsxs` functions of the automatic
+	// runtime, required from `ImportSource + "/jsx-runtime"`, rather than by
+	// calling `Factory`
+	Automatic bool
+
+	// Where the automatic runtime is required from. Defaults to `react`.
+	ImportSource string
+
+	// Also compile `.js` files which have an `@jsx` pragma comment
+	Pragma bool
+}
+
+// The name of the helper merging props given with spread attributes, as
+// `Object.assign` isn't in ES5. It's defined once, by the preamble of a bundle
+// which spreads props.
+const jsxAssign = "__squish_jsx_assign"
+
+var jsxAssignHelper = "function " + jsxAssign + "(target) {" +
+	" for (var i = 1; i < arguments.length; i++) {" +
+	" for (var key in arguments[i]) {" +
+	" if (Object.prototype.hasOwnProperty.call(arguments[i], key))" +
+	" target[key] = arguments[i][key]; } } return target; }"
+
+// Pragma comments, such as `/** @jsx h */`, which set how a file's JSX is
+// compiled
+var jsxPragma = regexp.MustCompile(
+	`(?:^|[\s*/])@(jsx|jsxFrag|jsxRuntime|jsxImportSource)[ \t]+([^\s*]+)`)
+
+// The transforms compiling JSX: every `.jsx` and `.tsx` file, and `.js` files
+// with a pragma if the options ask for it
+func jsxTransforms(opts JSXOptions) []TransformRule {
+	compile := TransformFunc(func(path string, src []byte) ([]byte, []string,
+		error) {
+		out, err := compileJSX(src, path, opts)
+		return out, nil, err
+	})
+	rules := []TransformRule{{"*.jsx", compile}, {"*.tsx", compile}}
+
+	if opts.Pragma {
+		rules = append(rules, TransformRule{"*.js", TransformFunc(
+			func(path string, src []byte) ([]byte, []string, error) {
+				if !jsxPragma.Match(src) {
+					return src, nil, nil
+				}
+				out, err := compileJSX(src, path, opts)
+				return out, nil, err
+			})})
+	}
+	return rules
+}
+
+type jsxCompiler struct {
+	path string
+	src  string
+	opts JSXOptions
+
+	// Whether the source is TypeScript, which has type parameters to tell
+	// from elements
+	typescript bool
+}
+
+// Compiles the JSX in a source to plain JavaScript. Elements which span lines
+// are written across as many, so that the lines after them stay where they
+// were.
+func compileJSX(src []byte, path string, opts JSXOptions) ([]byte, error) {
+	for _, match := range jsxPragma.FindAllSubmatch(src, -1) {
+		value := string(match[2])
+		switch string(match[1]) {
+		case "jsx":
+			opts.Factory = value
+		case "jsxFrag":
+			opts.Fragment = value
+		case "jsxRuntime":
+			opts.Automatic = value == "automatic"
+		case "jsxImportSource":
+			opts.ImportSource = value
+		}
+	}
+	if opts.Factory == "" {
+		opts.Factory = "React.createElement"
+	}
+	if opts.Fragment == "" {
+		opts.Fragment = "React.Fragment"
+	}
+	if opts.ImportSource == "" {
+		opts.ImportSource = "react"
+	}
+
+	jc := &jsxCompiler{path: path, src: string(src), opts: opts,
+		typescript: strings.HasSuffix(path, ".tsx")}
+	out, err := jc.js(&lexer{path: path, src: jc.src}, false)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// Tokenizes a source which may have JSX in it, giving each element as one
+// token. What's tokenized before an error is given along with it.
+func tokenizeJSX(src, path string) ([]token, error) {
+	jc := &jsxCompiler{path: path, src: src,
+		typescript: strings.HasSuffix(path, ".tsx")}
+	lx := &lexer{path: path, src: src}
+	_, err := jc.js(lx, false)
+	return lx.tokens, err
+}
+
+// Compiles JavaScript from the lexer's position, along with any JSX in it, to
+// the end of the source. Nested in a JSX expression container, this instead
+// stops before the `}` closing it.
+func (jc *jsxCompiler) js(lx *lexer, nested bool) (string, error) {
+	buf := &bytes.Buffer{}
+	depth := 0
+	for lx.pos < len(lx.src) {
+		rest := lx.src[lx.pos:]
+		if nested && rest[0] == '}' && depth == 0 {
+			return buf.String(), nil
+		}
+
+		// A `<` where an expression may start can't be a comparison
+		if rest[0] == '<' && (lx.regExpAllowed() ||
+			lx.last.is(tokIdentifier, "default")) && jsxStarts(rest[1:]) &&
+			!(jc.typescript && tsxTypeParameters.MatchString(rest[1:])) {
+			jp := &jsxParser{jc: jc, pos: lx.pos}
+			element, err := jp.element()
+			if err != nil {
+				return "", err
+			}
+			lx.emit(tokJSX, jp.pos-lx.pos)
+			buf.WriteString(element)
+			continue
+		}
+
+		if err := lx.next(); err != nil {
+			return "", err
+		}
+		tok := &lx.tokens[len(lx.tokens)-1]
+		switch {
+		case tok.is(tokPunctuator, "{"):
+			depth++
+		case tok.is(tokPunctuator, "}"):
+			depth--
+		}
+		buf.WriteString(tok.text)
+	}
+	if nested {
+		return "", lx.errorf("unterminated JSX expression")
+	}
+	return buf.String(), nil
+}
+
+// Whether what follows a `<` is an element's name, or a fragment
+func jsxStarts(rest string) bool {
+	r, _ := utf8.DecodeRuneInString(rest)
+	return r == '>' || isIdentifierStart(r)
+}
+
+// Parses a single element, reading the source directly, as the text of JSX
+// isn't JavaScript
+type jsxParser struct {
+	jc  *jsxCompiler
+	pos int
+
+	// Line breaks read which are yet to be written
+	newlines int
+}
+
+func (jp *jsxParser) errorf(format string, args ...interface{}) error {
+	line, col := jp.jc.position(jp.pos)
+	return &lexError{jp.jc.path, line, col, fmt.Sprintf(format, args...)}
+}
+
+// The zero-based line and column of an offset in the source, with columns
+// counted as the lexer does
+func (jc *jsxCompiler) position(offset int) (int, int) {
+	line, col := 0, 0
+	for _, r := range jc.src[:offset] {
+		switch {
+		case r == '\n':
+			line, col = line+1, 0
+		case r > 0xffff:
+			col += 2
+		default:
+			col++
+		}
+	}
+	return line, col
+}
+
+func (jp *jsxParser) rest() string {
+	return jp.jc.src[jp.pos:]
+}
+
+// Moves past `n` bytes which aren't written out as they are, keeping track of
+// the line breaks in them
+func (jp *jsxParser) skip(n int) {
+	jp.newlines += strings.Count(jp.jc.src[jp.pos:jp.pos+n], "\n")
+	jp.pos += n
+}
+
+// Gives the line breaks skipped since they were last given
+func (jp *jsxParser) breaks() string {
+	breaks := strings.Repeat("\n", jp.newlines)
+	jp.newlines = 0
+	return breaks
+}
+
+// Skips whitespace and comments within a tag
+func (jp *jsxParser) space() error {
+	for jp.pos < len(jp.jc.src) {
+		rest := jp.rest()
+		r, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case isJSWhitespace(r) || isLineTerminator(r):
+			jp.skip(size)
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexAny(rest, lineTerminators)
+			if end < 0 {
+				end = len(rest)
+			}
+			jp.skip(end)
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return jp.errorf("unterminated comment")
+			}
+			jp.skip(end + 4)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Expects the given text next, after any space
+func (jp *jsxParser) expect(text string) error {
+	if err := jp.space(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(jp.rest(), text) {
+		return jp.errorf("expected %q in JSX", text)
+	}
+	jp.skip(len(text))
+	return nil
+}
+
+// Reads an identifier, which in JSX may also contain dashes
+func (jp *jsxParser) identifier() (string, error) {
+	rest := jp.rest()
+	n := 0
+	for n < len(rest) {
+		r, size := utf8.DecodeRuneInString(rest[n:])
+		if !(n == 0 && isIdentifierStart(r) ||
+			n > 0 && (isIdentifierPart(r) || r == '-')) {
+			break
+		}
+		n += size
+	}
+	if n == 0 {
+		return "", jp.errorf("expected a name in JSX")
+	}
+	jp.skip(n)
+	return rest[:n], nil
+}
+
+// Reads an element's name, which may be namespaced, as in `svg:rect`, or a
+// member, as in `Foo.Bar`
+func (jp *jsxParser) name() (string, error) {
+	if err := jp.space(); err != nil {
+		return "", err
+	}
+	name, err := jp.identifier()
+	if err != nil {
+		return "", err
+	}
+	for {
+		rest := jp.rest()
+		if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, ":") {
+			return name, nil
+		}
+		jp.skip(1)
+		part, err := jp.identifier()
+		if err != nil {
+			return "", err
+		}
+		name += rest[:1] + part
+	}
+}
+
+// The expression for the type of an element of the given name. Names starting
+// with a lowercase letter are intrinsic elements, given by name.
+func (jp *jsxParser) elementType(name string) string {
+	r, _ := utf8.DecodeRuneInString(name)
+	switch {
+	case strings.Contains(name, ":"), !strings.Contains(name, ".") &&
+		(r >= 'a' && r <= 'z' || strings.Contains(name, "-")):
+		return jsString(name)
+	}
+	return name
+}
+
+// Compiles the JavaScript in an expression container, having read its `{`,
+// reading up to and including its `}`. Also gives whether there was anything
+// in it besides comments.
+func (jp *jsxParser) expression() (string, bool, error) {
+	lx := &lexer{path: jp.jc.path, src: jp.jc.src, pos: jp.pos}
+	lx.line, lx.col = jp.jc.position(jp.pos)
+	js, err := jp.jc.js(lx, true)
+	if err != nil {
+		return "", false, err
+	}
+	jp.pos = lx.pos + 1
+	return js, lx.last != nil, nil
+}
+
+// Parses an element, or a fragment, starting at its `<`, giving the call
+// which makes it
+func (jp *jsxParser) element() (string, error) {
+	jp.skip(1)
+	if err := jp.space(); err != nil {
+		return "", err
+	}
+
+	var (
+		name, typ string
+		fragment  = strings.HasPrefix(jp.rest(), ">")
+		props     = &jsxProps{jc: jp.jc}
+		key       string
+	)
+	if fragment {
+		typ = jp.jc.opts.Fragment
+		if jp.jc.opts.Automatic {
+			typ = jp.jc.runtime() + ".Fragment"
+		}
+	} else {
+		var err error
+		if name, err = jp.name(); err != nil {
+			return "", err
+		}
+		typ = jp.elementType(name)
+		if key, err = jp.attributes(props); err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(jp.rest(), "/") {
+			if err := jp.expect("/>"); err != nil {
+				return "", err
+			}
+			return jp.call(typ, props, key, nil), nil
+		}
+	}
+	jp.skip(1)
+
+	children, err := jp.children()
+	if err != nil {
+		return "", err
+	}
+	closing, err := jp.closingTag()
+	if err != nil {
+		return "", err
+	}
+	if closing != name {
+		if fragment {
+			return "", jp.errorf("expected </> to close a fragment")
+		}
+		return "", jp.errorf("expected </%s> to close <%s>", name, name)
+	}
+	return jp.call(typ, props, key, children), nil
+}
+
+// Reads the attributes of an element, up to the `/>` or `>` ending its opening
+// tag. With the automatic runtime, a `key` is given back rather than being
+// added to the props.
+func (jp *jsxParser) attributes(props *jsxProps) (string, error) {
+	var key string
+	for {
+		if err := jp.space(); err != nil {
+			return "", err
+		}
+		rest := jp.rest()
+		switch {
+		case rest == "":
+			return "", jp.errorf("unterminated JSX tag")
+		case rest[0] == '/' || rest[0] == '>':
+			return key, nil
+		case rest[0] == '{':
+			if err := jp.expect("{"); err != nil {
+				return "", err
+			}
+			if err := jp.expect("..."); err != nil {
+				return "", err
+			}
+			spread, _, err := jp.expression()
+			if err != nil {
+				return "", err
+			}
+			props.addSpread(jp.breaks() + spread)
+			continue
+		}
+
+		name, err := jp.identifier()
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(jp.rest(), ":") {
+			jp.skip(1)
+			local, err := jp.identifier()
+			if err != nil {
+				return "", err
+			}
+			name += ":" + local
+		}
+
+		if err := jp.space(); err != nil {
+			return "", err
+		}
+		value := "true"
+		if strings.HasPrefix(jp.rest(), "=") {
+			jp.skip(1)
+			if value, err = jp.attributeValue(); err != nil {
+				return "", err
+			}
+		}
+
+		if name == "key" && jp.jc.opts.Automatic {
+			key = value
+		} else {
+			props.add(jp.breaks(), name, value)
+		}
+	}
+}
+
+// Reads the value given to an attribute after its `=`
+func (jp *jsxParser) attributeValue() (string, error) {
+	if err := jp.space(); err != nil {
+		return "", err
+	}
+	rest := jp.rest()
+	switch {
+	case strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'"):
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end < 0 {
+			return "", jp.errorf("unterminated JSX attribute")
+		}
+		value := jsxAttributeSpace.ReplaceAllString(rest[1:end+1], " ")
+		jp.skip(end + 2)
+		return jsString(html.UnescapeString(value)), nil
+
+	case strings.HasPrefix(rest, "{"):
+		jp.skip(1)
+		value, any, err := jp.expression()
+		if err != nil {
+			return "", err
+		}
+		if !any {
+			return "", jp.errorf("JSX attributes must be given an expression")
+		}
+		return value, nil
+
+	case strings.HasPrefix(rest, "<"):
+		return jp.element()
+	}
+	return "", jp.errorf("expected a JSX attribute value")
+}
+
+var jsxAttributeSpace = regexp.MustCompile(`\n\s+`)
+
+// Reads the children of an element, up to its closing tag
+func (jp *jsxParser) children() ([]string, error) {
+	var children []string
+	for {
+		rest := jp.rest()
+		switch {
+		case rest == "":
+			return nil, jp.errorf("unterminated JSX element")
+
+		case strings.HasPrefix(rest, "<"):
+			closing := &jsxParser{jc: jp.jc, pos: jp.pos + 1}
+			if err := closing.space(); err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(closing.rest(), "/") {
+				return children, nil
+			}
+			child, err := jp.element()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, jp.breaks()+child)
+
+		case strings.HasPrefix(rest, "{"):
+			jp.skip(1)
+			if err := jp.space(); err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(jp.rest(), "...") {
+				return nil, jp.errorf("spread children aren't supported")
+			}
+			child, any, err := jp.expression()
+			if err != nil {
+				return nil, err
+			}
+			if any {
+				children = append(children, jp.breaks()+child)
+			}
+
+		default:
+			end := strings.IndexAny(rest, "<{")
+			if end < 0 {
+				end = len(rest)
+			}
+			text := jsxText(rest[:end])
+			jp.skip(end)
+			if text != "" {
+				children = append(children, jp.breaks()+jsString(text))
+			}
+		}
+	}
+}
+
+// Reads a closing tag, giving its name, which is empty for a fragment's
+func (jp *jsxParser) closingTag() (string, error) {
+	if err := jp.expect("<"); err != nil {
+		return "", err
+	}
+	if err := jp.expect("/"); err != nil {
+		return "", err
+	}
+	if err := jp.space(); err != nil {
+		return "", err
+	}
+	var name string
+	if !strings.HasPrefix(jp.rest(), ">") {
+		var err error
+		if name, err = jp.name(); err != nil {
+			return "", err
+		}
+	}
+	return name, jp.expect(">")
+}
+
+// Cleans up the text of an element as React does. Lines are trimmed, other
+// than the start of the first and the end of the last, lines left empty are
+// dropped, and the rest are joined by spaces. Entities are then decoded.
+func jsxText(text string) string {
+	lines := strings.Split(strings.Replace(text, "\t", " ", -1), "\n")
+	last := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			last = i
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if i > 0 {
+			line = strings.TrimLeft(line, " ")
+		}
+		if i < len(lines)-1 {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" {
+			continue
+		}
+		buf.WriteString(line)
+		if i != last {
+			buf.WriteString(" ")
+		}
+	}
+	return html.UnescapeString(buf.String())
+}
+
+// Gives the call making an element, with any line breaks read since the last
+// argument before its closing parenthesis
+func (jp *jsxParser) call(typ string, props *jsxProps, key string,
+	children []string) string {
+
+	opts := jp.jc.opts
+	if !opts.Automatic {
+		args := append([]string{typ, props.String()}, children...)
+		return opts.Factory + "(" + strings.Join(args, ", ") + jp.breaks() + ")"
+	}
+
+	fn := "jsx"
+	switch len(children) {
+	case 0:
+	case 1:
+		props.add("", "children", children[0])
+	default:
+		fn = "jsxs"
+		props.add("", "children", "["+strings.Join(children, ", ")+"]")
+	}
+
+	args := []string{typ, props.String()}
+	if args[1] == "null" {
+		args[1] = "{}"
+	}
+	if key != "" {
+		args = append(args, key)
+	}
+	return jp.jc.runtime() + "." + fn + "(" + strings.Join(args, ", ") +
+		jp.breaks() + ")"
+}
+
+// The expression giving the automatic runtime
+func (jc *jsxCompiler) runtime() string {
+	return "require(" + jsString(jc.opts.ImportSource+"/jsx-runtime") + ")"
+}
+
+// The props of an element, as an object literal, or merged with
+// `jsxAssign` where any are spread
+type jsxProps struct {
+	jc *jsxCompiler
+
+	// Objects, and spread expressions, in order
+	parts  []string
+	spread bool
+
+	// Properties of the object being built
+	props []string
+}
+
+// Adds a property, after the given line breaks
+func (jp *jsxProps) add(breaks, name, value string) {
+	if !isPlainIdentifier(name) || reservedWords[name] {
+		name = jsString(name)
+	}
+	jp.props = append(jp.props, breaks+name+": "+value)
+}
+
+// Adds the properties of an expression, as `{...expr}` does
+func (jp *jsxProps) addSpread(expr string) {
+	jp.flush()
+	jp.parts = append(jp.parts, expr)
+	jp.spread = true
+}
+
+func (jp *jsxProps) flush() {
+	if jp.props != nil {
+		jp.parts = append(jp.parts, "{"+strings.Join(jp.props, ", ")+"}")
+		jp.props = nil
+	}
+}
+
+// Gives the props as an expression, or `null` if there aren't any
+func (jp *jsxProps) String() string {
+	jp.flush()
+	switch {
+	case len(jp.parts) == 0:
+		return "null"
+	case !jp.spread:
+		return jp.parts[0]
+	}
+
+	parts := jp.parts
+	if !strings.HasPrefix(parts[0], "{") {
+		parts = append([]string{"{}"}, parts...)
+	}
+	return jsxAssign + "(" + strings.Join(parts, ", ") + ")"
+}
+
+// Whether a name can be used as a property name without quoting it
+func isPlainIdentifier(name string) bool {
+	for i, r := range name {
+		if !(i == 0 && isIdentifierStart(r) || i > 0 && isIdentifierPart(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Quotes a string as a JavaScript string literal
+func jsString(s string) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,138 @@
+package jssquish
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSX", func() {
+
+	compile := func(src string, opts JSXOptions) string {
+		out, err := compileJSX([]byte(src), "app.jsx", opts)
+		Expect(err).ToNot(HaveOccurred())
+		return string(out)
+	}
+
+	It("should compile elements to factory calls", func() {
+		Expect(compile(`var a = <div className="app" hidden />;`,
+			JSXOptions{})).To(Equal(
+			`var a = React.createElement("div", {className: "app", hidden: true});`))
+		Expect(compile(`f(<Foo.Bar x={1 + 2}>hi</Foo.Bar>)`, JSXOptions{})).
+			To(Equal(`f(React.createElement(Foo.Bar, {x: 1 + 2}, "hi"))`))
+		Expect(compile(`x = <my-el aria-label='a &amp; b' class="c" />`,
+			JSXOptions{})).To(Equal(`x = React.createElement("my-el",` +
+			` {"aria-label": "a & b", "class": "c"})`))
+		Expect(compile(`x = <svg:rect />`, JSXOptions{})).
+			To(Equal(`x = React.createElement("svg:rect", null)`))
+	})
+
+	It("should leave comparisons alone", func() {
+		src := "if (a < b && c<d) { x = 1 <2 }\nfor (;i < n;) f() < g"
+		Expect(compile(src, JSXOptions{})).To(Equal(src))
+	})
+
+	It("should compile children, cleaning up their text", func() {
+		Expect(compile(`x = <p>
+			  Hello, {name}!
+			  <b>{/* nothing */}</b>  &copy; {}
+			</p>`, JSXOptions{})).To(Equal(`x = React.createElement("p", null, ` +
+			"\n" + `"Hello, ", name, ` + "\n" + `"!", ` +
+			`React.createElement("b", null), "  © "` + "\n)"))
+	})
+
+	It("should compile JSX nested in expressions", func() {
+		Expect(compile(
+			`x = <ul>{items.map(function (i) { return <li key={i}>{i}</li> })}</ul>`,
+			JSXOptions{})).To(Equal(`x = React.createElement("ul", null,` +
+			` items.map(function (i) { return React.createElement("li",` +
+			` {key: i}, i) }))`))
+		Expect(compile(`export default <a />`, JSXOptions{})).To(Equal(
+			`export default React.createElement("a", null)`))
+		Expect(compile(`x = <a b={<c />} />`, JSXOptions{})).To(Equal(
+			`x = React.createElement("a", {b: React.createElement("c", null)})`))
+	})
+
+	It("should compile fragments", func() {
+		Expect(compile(`x = <><a /></>`, JSXOptions{})).To(Equal(
+			`x = React.createElement(React.Fragment, null,` +
+				` React.createElement("a", null))`))
+	})
+
+	It("should merge spread props", func() {
+		Expect(compile(`x = <a {...p} b="1" {...q} />; y = <a {...p} />`,
+			JSXOptions{})).To(Equal(
+			`x = React.createElement("a", __squish_jsx_assign({}, p, {b: "1"}, q));` +
+				` y = React.createElement("a", __squish_jsx_assign({}, p))`))
+	})
+
+	It("should use a given factory, or one from a pragma", func() {
+		Expect(compile(`x = <><a /></>`, JSXOptions{Factory: "h",
+			Fragment: "Fragment"})).To(Equal(
+			`x = h(Fragment, null, h("a", null))`))
+		Expect(compile("/** @jsx preact.h */\nx = <a />", JSXOptions{})).To(Equal(
+			"/** @jsx preact.h */\nx = preact.h(\"a\", null)"))
+	})
+
+	It("should use the automatic runtime when asked", func() {
+		runtime := `require("react/jsx-runtime")`
+		Expect(compile(`x = <a key="k" b={1}><c /></a>`,
+			JSXOptions{Automatic: true})).To(Equal(`x = ` + runtime +
+			`.jsx("a", {b: 1, children: ` + runtime + `.jsx("c", {})}, "k")`))
+		Expect(compile(`x = <>{a}{b}</>`, JSXOptions{Automatic: true})).To(Equal(
+			`x = ` + runtime + `.jsxs(` + runtime + `.Fragment,` +
+				` {children: [a, b]})`))
+		Expect(compile("// @jsxImportSource preact\n// @jsxRuntime automatic\n"+
+			"x = <a />", JSXOptions{})).To(HaveSuffix(
+			`x = require("preact/jsx-runtime").jsx("a", {})`))
+	})
+
+	It("should keep every line where it was", func() {
+		src := "x = <div\n  a=\"1\"\n>\n  <b>\n    text\n  </b>\n</div>;\ny = 1"
+		out := compile(src, JSXOptions{})
+		Expect(strings.Count(out, "\n")).To(Equal(strings.Count(src, "\n")))
+		Expect(out).To(HaveSuffix("\ny = 1"))
+	})
+
+	It("should say where JSX is wrong", func() {
+		_, err := compileJSX([]byte("x = 1\ny = <a><b></a>"), "app.jsx",
+			JSXOptions{})
+		Expect(err).To(MatchError("app.jsx:2:15: expected </b> to close <b>"))
+		_, err = compileJSX([]byte("x = <a b={} />"), "app.jsx", JSXOptions{})
+		Expect(err).To(MatchError(
+			"app.jsx:1:12: JSX attributes must be given an expression"))
+		_, err = compileJSX([]byte("x = <a>"), "app.jsx", JSXOptions{})
+		Expect(err).To(MatchError("app.jsx:1:8: unterminated JSX element"))
+	})
+
+	It("should bundle .jsx files, and .js files with a pragma if asked", func() {
+		files := map[string]string{
+			"index.js": "/** @jsx h */\n" +
+				"function h(t, p, c) { return t + ':' + p.n + ':' + c }\n" +
+				"result = [require('./view'), <b n=\"2\">js</b>]",
+			"view.jsx": "function h(t, p, c) { return t + p.n + c }\n" +
+				"module.exports = <a n=\"1\">jsx</a>",
+		}
+		repo := memoryRepository(files)
+		defer repo.Close()
+
+		out := &bytes.Buffer{}
+		_, err := Build(repo, "index.js", out, Options{
+			JSX: JSXOptions{Factory: "h", Pragma: true}})
+		Expect(err).ToNot(HaveOccurred())
+
+		vm := otto.New()
+		_, err = vm.Run(out.String())
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result.join()")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("a1jsx,b:2:js"))
+
+		_, err = Build(repo, "index.js", &bytes.Buffer{}, Options{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,439 @@
+package jssquish
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind uint8
+
+const (
+	tokWhitespace tokenKind = iota
+	tokComment
+	tokIdentifier
+	tokPunctuator
+	tokNumber
+	tokString
+	tokTemplate
+	tokRegExp
+
+	// A whole JSX element, only seen when compiling JSX
+	tokJSX
+)
+
+// A single lexical token of a JavaScript source. Whitespace and comments are
+// kept as tokens of their own, so that concatenating the text of every token
+// reproduces the source exactly.
+// `line` and `col` are zero-based, with columns counted in UTF-16 code units
+// as source maps expect. `newline` records whether a line terminator separates
+// this token from the previous significant (non-whitespace, non-comment) one,
+// which matters for automatic semicolon insertion.
+type token struct {
+	kind    tokenKind
+	text    string
+	offset  int
+	line    int
+	col     int
+	newline bool
+}
+
+// Whitespace and comments
+func (t *token) trivia() bool {
+	return t.kind == tokWhitespace || t.kind == tokComment
+}
+
+func (t *token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+type lexError struct {
+	path   string
+	line   int
+	col    int
+	reason string
+}
+
+func (le *lexError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", le.path, le.line+1, le.col+1, le.reason)
+}
+
+// Punctuators, longest first within each leading character so the first match
+// is the longest.
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--", "+=", "-=",
+	"*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>", "**",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/", "%",
+	"&", "|", "^", "!", "~", "?", ":", "=", ".", "@", "#",
+}
+
+// Keywords after which a `/` begins a regular expression rather than a
+// division.
+var regExpKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true,
+	"new": true, "delete": true, "void": true, "throw": true, "case": true,
+	"do": true, "else": true, "yield": true, "await": true,
+}
+
+const lineTerminators = "\n\r\u2028\u2029"
+
+type lexer struct {
+	path    string
+	src     string
+	pos     int
+	line    int
+	col     int
+	tokens  []token
+	newline bool
+
+	// The last significant token, used to tell regular expressions from
+	// division.
+	last *token
+}
+
+// Splits a JavaScript source into tokens. This is a lexer only, with no
+// understanding of the grammar beyond what's needed to tell a regular
+// expression from a division.
+func tokenize(src, path string) ([]token, error) {
+	lx := &lexer{path: path, src: src}
+	for lx.pos < len(lx.src) {
+		if err := lx.next(); err != nil {
+			return nil, err
+		}
+	}
+	return lx.tokens, nil
+}
+
+func (lx *lexer) errorf(format string, args ...interface{}) error {
+	return &lexError{lx.path, lx.line, lx.col, fmt.Sprintf(format, args...)}
+}
+
+// Emits the `n` bytes at the current position as a token, advancing the line
+// and column as it goes.
+func (lx *lexer) emit(kind tokenKind, n int) {
+	tok := token{
+		kind:   kind,
+		text:   lx.src[lx.pos : lx.pos+n],
+		offset: lx.pos,
+		line:   lx.line,
+		col:    lx.col,
+	}
+
+	for i, r := range tok.text {
+		switch {
+		case r == '\r' && strings.HasPrefix(tok.text[i:], "\r\n"):
+			// A CRLF pair is a single line terminator, counted at the LF
+		case isLineTerminator(r):
+			lx.col = 0
+			lx.line++
+		case r > 0xffff:
+			lx.col += 2
+		default:
+			lx.col++
+		}
+	}
+	lx.pos += n
+
+	if tok.trivia() {
+		if strings.ContainsAny(tok.text, lineTerminators) {
+			lx.newline = true
+		}
+	} else {
+		tok.newline = lx.newline
+		lx.newline = false
+	}
+	lx.tokens = append(lx.tokens, tok)
+	if !tok.trivia() {
+		lx.last = &tok
+	}
+}
+
+func (lx *lexer) next() error {
+	rest := lx.src[lx.pos:]
+	r, _ := utf8.DecodeRuneInString(rest)
+
+	switch {
+	case isJSWhitespace(r) || isLineTerminator(r):
+		n := 0
+		for n < len(rest) {
+			r, size := utf8.DecodeRuneInString(rest[n:])
+			if !isJSWhitespace(r) && !isLineTerminator(r) {
+				break
+			}
+			n += size
+		}
+		lx.emit(tokWhitespace, n)
+
+	case strings.HasPrefix(rest, "//"):
+		n := len(rest)
+		if i := strings.IndexAny(rest, lineTerminators); i >= 0 {
+			n = i
+		}
+		lx.emit(tokComment, n)
+
+	case strings.HasPrefix(rest, "/*"):
+		i := strings.Index(rest[2:], "*/")
+		if i < 0 {
+			return lx.errorf("unterminated comment")
+		}
+		lx.emit(tokComment, i+4)
+
+	case isIdentifierStart(r) || r == '\\':
+		n, err := lx.scanIdentifier(rest)
+		if err != nil {
+			return err
+		}
+		lx.emit(tokIdentifier, n)
+
+	case r >= '0' && r <= '9' ||
+		r == '.' && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9':
+		lx.emit(tokNumber, lx.scanNumber(rest))
+
+	case r == '"' || r == '\'':
+		n, err := lx.scanString(rest, byte(r))
+		if err != nil {
+			return err
+		}
+		lx.emit(tokString, n)
+
+	case r == '`':
+		n, err := lx.scanTemplate(rest)
+		if err != nil {
+			return err
+		}
+		lx.emit(tokTemplate, n)
+
+	case r == '/' && lx.regExpAllowed():
+		n, err := lx.scanRegExp(rest)
+		if err != nil {
+			return err
+		}
+		lx.emit(tokRegExp, n)
+
+	default:
+		for _, p := range punctuators {
+			if strings.HasPrefix(rest, p) {
+				// `?.5` is a conditional followed by a number
+				if p == "?." && len(rest) > 2 && rest[2] >= '0' && rest[2] <= '9' {
+					continue
+				}
+				lx.emit(tokPunctuator, len(p))
+				return nil
+			}
+		}
+		return lx.errorf("unexpected character %q", r)
+	}
+	return nil
+}
+
+// Whether a `/` at this point begins a regular expression. This is decided by
+// the previous significant token, which gets the overwhelming majority of real
+// code right without a parser.
+func (lx *lexer) regExpAllowed() bool {
+	if lx.last == nil {
+		return true
+	}
+	switch lx.last.kind {
+	case tokIdentifier:
+		return regExpKeywords[lx.last.text]
+	case tokPunctuator:
+		switch lx.last.text {
+		case ")", "]", "++", "--":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (lx *lexer) scanIdentifier(rest string) (int, error) {
+	n := 0
+	for n < len(rest) {
+		r, size := utf8.DecodeRuneInString(rest[n:])
+		switch {
+		case r == '\\':
+			// Unicode escape, either \uXXXX or \u{X...}
+			if !strings.HasPrefix(rest[n:], "\\u") {
+				return 0, lx.errorf("invalid escape in identifier")
+			}
+			end := n + 6
+			if strings.HasPrefix(rest[n:], "\\u{") {
+				end = strings.IndexByte(rest[n:], '}') + n + 1
+			}
+			if end <= n || end > len(rest) {
+				return 0, lx.errorf("invalid escape in identifier")
+			}
+			n = end
+		case n == 0 && isIdentifierStart(r), n > 0 && isIdentifierPart(r):
+			n += size
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (lx *lexer) scanNumber(rest string) int {
+	n := 0
+	if len(rest) > 1 && rest[0] == '0' &&
+		strings.ContainsRune("xXoObB", rune(rest[1])) {
+		n = 2
+		for n < len(rest) && (isHexDigit(rest[n]) || rest[n] == '_') {
+			n++
+		}
+	} else {
+		for n < len(rest) && (isDigit(rest[n]) || rest[n] == '_') {
+			n++
+		}
+		if n < len(rest) && rest[n] == '.' {
+			n++
+			for n < len(rest) && (isDigit(rest[n]) || rest[n] == '_') {
+				n++
+			}
+		}
+		if n < len(rest) && (rest[n] == 'e' || rest[n] == 'E') {
+			m := n + 1
+			if m < len(rest) && (rest[m] == '+' || rest[m] == '-') {
+				m++
+			}
+			if m < len(rest) && isDigit(rest[m]) {
+				n = m
+				for n < len(rest) && isDigit(rest[n]) {
+					n++
+				}
+			}
+		}
+	}
+	// BigInt
+	if n < len(rest) && rest[n] == 'n' {
+		n++
+	}
+	return n
+}
+
+func (lx *lexer) scanString(rest string, quote byte) (int, error) {
+	for n := 1; n < len(rest); n++ {
+		switch rest[n] {
+		case '\\':
+			n++
+			// An escaped CRLF is a single line continuation
+			if n+1 < len(rest) && rest[n] == '\r' && rest[n+1] == '\n' {
+				n++
+			}
+		case quote:
+			return n + 1, nil
+		case '\n', '\r':
+			return 0, lx.errorf("unterminated string")
+		}
+	}
+	return 0, lx.errorf("unterminated string")
+}
+
+// Scans a whole template literal, including any substitutions, as one token.
+// Substitutions are lexed properly so that braces, strings, and nested
+// templates inside of them don't confuse things.
+func (lx *lexer) scanTemplate(rest string) (int, error) {
+	for n := 1; n < len(rest); n++ {
+		switch rest[n] {
+		case '\\':
+			n++
+		case '`':
+			return n + 1, nil
+		case '$':
+			if n+1 < len(rest) && rest[n+1] == '{' {
+				m, err := lx.scanSubstitution(rest[n+2:])
+				if err != nil {
+					return 0, err
+				}
+				n += 1 + m
+			}
+		}
+	}
+	return 0, lx.errorf("unterminated template")
+}
+
+// Scans the expression inside a template's `${...}`, returning the length up
+// to and including the closing brace.
+func (lx *lexer) scanSubstitution(rest string) (int, error) {
+	sub := &lexer{path: lx.path, src: rest, line: lx.line, col: lx.col}
+	depth := 0
+	for sub.pos < len(sub.src) {
+		if sub.src[sub.pos] == '}' && depth == 0 {
+			return sub.pos + 1, nil
+		}
+		if err := sub.next(); err != nil {
+			return 0, err
+		}
+		switch last := &sub.tokens[len(sub.tokens)-1]; {
+		case last.is(tokPunctuator, "{"):
+			depth++
+		case last.is(tokPunctuator, "}"):
+			depth--
+		}
+	}
+	return 0, lx.errorf("unterminated template")
+}
+
+func (lx *lexer) scanRegExp(rest string) (int, error) {
+	inClass := false
+	for n := 1; n < len(rest); n++ {
+		switch rest[n] {
+		case '\\':
+			n++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if inClass {
+				continue
+			}
+			n++
+			for n < len(rest) {
+				r, size := utf8.DecodeRuneInString(rest[n:])
+				if !isIdentifierPart(r) {
+					break
+				}
+				n += size
+			}
+			return n, nil
+		case '\n', '\r':
+			return 0, lx.errorf("unterminated regular expression")
+		}
+	}
+	return 0, lx.errorf("unterminated regular expression")
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isHexDigit(b byte) bool {
+	return isDigit(b) || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+func isJSWhitespace(r rune) bool {
+	switch r {
+	case ' ', '\t', '\v', '\f', '\u00a0', '\ufeff':
+		return true
+	}
+	return r > 0x7f && unicode.Is(unicode.Zs, r)
+}
+
+func isLineTerminator(r rune) bool {
+	return r == '\n' || r == '\r' || r == '\u2028' || r == '\u2029'
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '$' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+		r > 0x7f && unicode.IsLetter(r)
+}
+
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) || r >= '0' && r <= '9' ||
+		r > 0x7f && (unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r) ||
+			unicode.Is(unicode.Nd, r) || unicode.Is(unicode.Pc, r)) ||
+		r == '\u200c' || r == '\u200d'
+}
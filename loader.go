@@ -0,0 +1,178 @@
+package jssquish
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	pth "path"
+	"strings"
+)
+
+// How a file is made into a module
+type Loader string
+
+const (
+	// Parsed as JavaScript, which every file without a loader is
+	LoaderJS Loader = "js"
+
+	// Exported as its value
+	LoaderJSON Loader = "json"
+
+	// Exported as a string
+	LoaderText Loader = "text"
+
+	// Added to the page in a `<style>` tag when the module runs, and exported
+	// as a string
+	LoaderCSS Loader = "css"
+
+	// Exported as a base64 `data:` URI, for images and fonts small enough to
+	// inline
+	LoaderDataURL Loader = "dataurl"
+)
+
+// The loader used for each extension, unless `Options.Loaders` says otherwise
+var defaultLoaders = map[string]Loader{
+	".json": LoaderJSON,
+
+	".html": LoaderText,
+	".htm":  LoaderText,
+	".txt":  LoaderText,
+
+	".css": LoaderCSS,
+
+	".png":   LoaderDataURL,
+	".jpg":   LoaderDataURL,
+	".jpeg":  LoaderDataURL,
+	".gif":   LoaderDataURL,
+	".webp":  LoaderDataURL,
+	".svg":   LoaderDataURL,
+	".ico":   LoaderDataURL,
+	".woff":  LoaderDataURL,
+	".woff2": LoaderDataURL,
+	".ttf":   LoaderDataURL,
+	".otf":   LoaderDataURL,
+	".eot":   LoaderDataURL,
+}
+
+// Media types of files inlined as data URIs, which the `mime` package may not
+// know of on every system
+var dataURLTypes = map[string]string{
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".svg":   "image/svg+xml",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+}
+
+// The largest file inlined as a data URI, unless `Options.InlineLimit` says
+// otherwise
+const defaultInlineLimit = 32 << 10
+
+// The name of the helper adding CSS to the page
+const styleHelper = "__squish_style"
+
+// Adds CSS to the page in a `<style>` tag, giving it back. The tag a module
+// added before is reused, as when the module is hot replaced. Outside of a
+// browser, this does nothing. It's defined once, by the preamble of a bundle
+// with any CSS in it.
+var styleHelperSrc = "function " + styleHelper + "(id, css) {" +
+	" if (typeof document === \"undefined\") return css;" +
+	" var style = document.querySelector(" +
+	"\"style[data-squish=\\\"\" + id + \"\\\"]\");" +
+	" if (!style) { style = document.createElement(\"style\");" +
+	" style.setAttribute(\"data-squish\", id);" +
+	" document.head.appendChild(style); }" +
+	" style.textContent = css; return css; }"
+
+// Gives the loader of each extension, from the defaults and those given
+func loaders(given map[string]Loader) map[string]Loader {
+	all := make(map[string]Loader, len(defaultLoaders)+len(given))
+	for ext, loader := range defaultLoaders {
+		all[ext] = loader
+	}
+	for ext, loader := range given {
+		all[strings.ToLower(ext)] = loader
+	}
+	return all
+}
+
+// Whether `loader` is one `load` knows how to run
+func (loader Loader) valid() bool {
+	switch loader {
+	case LoaderJS, LoaderJSON, LoaderText, LoaderCSS, LoaderDataURL:
+		return true
+	}
+	return false
+}
+
+// Parses the name of a loader
+func ParseLoader(name string) (Loader, error) {
+	if loader := Loader(name); loader.valid() {
+		return loader, nil
+	}
+	return "", fmt.Errorf("unknown loader %q", name)
+}
+
+// Makes a file into the source of a module, by the loader for its extension.
+// The source of a file without one is given back as it is, to be parsed as
+// JavaScript. What a loader gives starts with all of the file on its first
+// line, so errors and source maps point there.
+func load(loaders map[string]Loader, inlineLimit int, path string,
+	src []byte) ([]byte, error) {
+
+	ext := strings.ToLower(pth.Ext(path))
+	switch loaderOf(loaders, path) {
+	case LoaderJSON:
+		if !json.Valid(src) {
+			return nil, fmt.Errorf("%s: invalid JSON", path)
+		}
+		return []byte("module.exports = " + strings.TrimSpace(string(src)) +
+			";"), nil
+
+	case LoaderText:
+		return []byte("module.exports = " + jsString(string(src)) + ";"), nil
+
+	case LoaderCSS:
+		return []byte("module.exports = " + styleHelper + "(" + jsString(path) +
+			", " + jsString(string(src)) + ");"), nil
+
+	case LoaderDataURL:
+		if inlineLimit == 0 {
+			inlineLimit = defaultInlineLimit
+		}
+		if len(src) > inlineLimit {
+			return nil, fmt.Errorf("%s is %s, too big to inline (the limit is %s)",
+				path, FormatSize(len(src)), FormatSize(inlineLimit))
+		}
+		return []byte("module.exports = \"" + dataURL(ext, src) + "\";"), nil
+	}
+	return src, nil
+}
+
+// The loader of the file at `path`, if it has one
+func loaderOf(loaders map[string]Loader, path string) Loader {
+	return loaders[strings.ToLower(pth.Ext(path))]
+}
+
+// A base64 `data:` URI of a file's contents
+func dataURL(ext string, src []byte) string {
+	mediaType := dataURLTypes[ext]
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(ext)
+	}
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	// Parameters, such as a charset, are written without spaces
+	mediaType = strings.Replace(mediaType, " ", "", -1)
+	return "data:" + mediaType + ";base64," +
+		base64.StdEncoding.EncodeToString(src)
+}
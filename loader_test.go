@@ -0,0 +1,131 @@
+package jssquish
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Loaders", func() {
+
+	build := func(files map[string]string, opts Options) (string, error) {
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		_, err := Build(repo, "index.js", out, opts)
+		return out.String(), err
+	}
+
+	run := func(bundle, setup, expr string) interface{} {
+		vm := otto.New()
+		_, err := vm.Run(setup)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run(expr)
+		Expect(err).ToNot(HaveOccurred())
+		exported, err := value.Export()
+		Expect(err).ToNot(HaveOccurred())
+		return exported
+	}
+
+	It("should export JSON, text and data URIs", func() {
+		bundle, err := build(map[string]string{
+			"index.js": "result = [require('./data.json').a," +
+				" require('./page.html'), require('./logo.png')," +
+				" require('./notes.TXT')]",
+			"data.json": "{\"a\": [1, \"two\"]}\n",
+			"page.html": "<p class=\"x\">\n  it's \u2028here</p>",
+			"logo.png":  "\x89PNG\x00\xff",
+			"notes.TXT": "",
+		}, Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(run(bundle, "", "result[0].join() + '|' + result.slice(1).join('|')")).
+			To(Equal("1,two|<p class=\"x\">\n  it's \u2028here</p>|" +
+				"data:image/png;base64,iVBORwD/|"))
+	})
+
+	It("should add CSS to the page, once", func() {
+		bundle, err := build(map[string]string{
+			"index.js":       "result = require('./styles/app.css')",
+			"styles/app.css": "body {\n  content: \"\\201C\";\n}",
+		}, Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(run(bundle, "", "result")).To(Equal(
+			"body {\n  content: \"\\201C\";\n}"))
+
+		document := "var styles = []; document = {" +
+			" head: {appendChild: function (s) { styles.push(s) }}," +
+			" createElement: function (tag) { return {tag: tag," +
+			"   setAttribute: function (k, v) { this[k] = v }} }," +
+			" querySelector: function (q) { return styles[0] || null } }"
+		Expect(run(bundle, document,
+			"styles.length + ' ' + styles[0].tag + ' ' + styles[0]['data-squish']"+
+				" + ' ' + styles[0].textContent")).To(Equal(
+			"1 style styles/app.css body {\n  content: \"\\201C\";\n}"))
+	})
+
+	It("should define the helpers modules call once, before the modules", func() {
+		bundle, err := build(map[string]string{
+			"index.js": "result = [require('./a.css'), require('./b.css')," +
+				" require('./view').n, require('./list').n].join()",
+			"a.css":    "a {}",
+			"b.css":    "b {}",
+			"view.jsx": "module.exports = <a {...{n: 1}} />",
+			"list.jsx": "module.exports = <ul {...{n: 2}} />",
+		}, Options{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(strings.Count(bundle, "function "+styleHelper)).To(Equal(1))
+		Expect(strings.Count(bundle, "function "+jsxAssign)).To(Equal(1))
+		Expect(strings.Index(bundle, "function "+styleHelper)).To(
+			BeNumerically("<", strings.Index(bundle, "(function outer")))
+		Expect(run(bundle, "React = {createElement: function (t, p) { return p }}",
+			"result")).To(Equal("a {},b {},1,2"))
+
+		bundle, err = build(map[string]string{"index.js": "result = 1"},
+			Options{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bundle).ToNot(ContainSubstring(styleHelper))
+		Expect(bundle).ToNot(ContainSubstring(jsxAssign))
+	})
+
+	It("should use the loaders given over the defaults", func() {
+		bundle, err := build(map[string]string{
+			"index.js": "result = [require('./icon.svg'), require('./view.tpl')]",
+			"icon.svg": "<svg/>",
+			"view.tpl": "<b></b>",
+		}, Options{Loaders: map[string]Loader{".svg": LoaderText,
+			".TPL": LoaderDataURL}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(run(bundle, "", "result.join()")).To(Equal(
+			"<svg/>,data:application/octet-stream;base64,PGI+PC9iPg=="))
+
+		_, err = build(map[string]string{
+			"index.js":  "require('./data.json')",
+			"data.json": "module.exports = 1",
+		}, Options{Loaders: map[string]Loader{".json": LoaderJS}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should refuse to inline big files, or load invalid JSON", func() {
+		_, err := build(map[string]string{
+			"index.js": "require('./big.png')",
+			"big.png":  strings.Repeat("x", 2048),
+		}, Options{InlineLimit: 1024})
+		Expect(err).To(MatchError(
+			"big.png is 2.0 KB, too big to inline (the limit is 1.0 KB)"))
+
+		_, err = build(map[string]string{
+			"index.js": "require('./bad.json')",
+			"bad.json": "{a: 1}",
+		}, Options{})
+		Expect(err).To(MatchError("bad.json: invalid JSON"))
+	})
+})
@@ -1,60 +1,792 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"vistarmedia.com/tool/js-squish"
 )
 
+// A flag which may be given more than once, collecting each value in order
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 var (
-	jsTarName   string
-	entrypoint  string
-	outputName  string
-	environment string
+	jsTarNames     stringList
+	rootDir        string
+	followSymlinks bool
+	lazy           bool
+	lazyCacheMB    int64
+	entrypoint     string
+	outputName     string
+	environment    string
+	minify         bool
+	treeShake      bool
+	scopeHoist     bool
+	dedupe         bool
+	jsxFactory     string
+	jsxFragment    string
+	jsxRuntime     string
+	jsxImport      string
+	jsxPragma      bool
+	jobs           int
+	cacheDir       string
+	sourceMapName  string
+	cssName        string
+	cssDir         string
+	cssMapName     string
+	graphName      string
+	graphFormat    string
+	statsName      string
+	statsHTMLName  string
+	watch          bool
+	watchInterval  time.Duration
+	listenAddr     string
+	bundlePath     string
+	hot            bool
+	verbose        bool
+	resolveFrom    string
+	maxSize        string
+	maxGzipped     string
+	packageBudgets stringList
+	loaderFlags    stringList
+	inlineLimit    string
 )
 
-func init() {
-	flag.StringVar(&jsTarName, "jstar", "", "Path to JSTar")
-	flag.StringVar(&entrypoint, "entrypoint", "index.js", "Entrypoint")
-	flag.StringVar(&outputName, "output", "", "Squished JS Output")
-	flag.StringVar(&environment, "environment", "", "NODE_ENV")
+// How many builds a persistent worker keeps parsed modules around for, after
+// the last build which used them
+const workerKeepBuilds = 4
+
+// Parsed modules kept between the builds of a persistent worker
+var parseCache *jssquish.ParseCache
+
+// Creates the flags for one build, resetting each to its default. Usage and
+// errors are written to `output`.
+func newFlagSet(output io.Writer) *flag.FlagSet {
+	jsTarNames = nil
+	packageBudgets = nil
+	loaderFlags = nil
+
+	flags := flag.NewFlagSet("js-squish", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Var(&jsTarNames, "jstar",
+		"Path to JSTar. May be repeated, with later JSTars shadowing earlier ones")
+	flags.StringVar(&rootDir, "root", "",
+		"Source directory, layered on top of any JSTars")
+	flags.BoolVar(&followSymlinks, "follow-symlinks", false,
+		"Follow symlinks under -root")
+	flags.BoolVar(&lazy, "lazy", false,
+		"Index JSTars and read files on demand, rather than loading them into memory")
+	flags.Int64Var(&lazyCacheMB, "lazy-cache-mb", 64,
+		"Megabytes of decompressed files to cache with -lazy")
+	flags.StringVar(&entrypoint, "entrypoint", "index.js", "Entrypoint")
+	flags.StringVar(&outputName, "output", "", "Squished JS Output")
+	flags.StringVar(&environment, "environment", "", "NODE_ENV")
+	flags.BoolVar(&minify, "minify", false,
+		"Strip comments and whitespace, and shorten local names")
+	flags.BoolVar(&treeShake, "tree-shake", false,
+		"Remove unused exports, and modules nothing needs")
+	flags.BoolVar(&scopeHoist, "scope-hoist", false,
+		"Inline modules into the module requiring them where it's safe to")
+	flags.BoolVar(&dedupe, "dedupe", false,
+		"Write modules with identical contents only once")
+	flags.StringVar(&jsxFactory, "jsx-factory", "React.createElement",
+		"Function JSX elements are made with")
+	flags.StringVar(&jsxFragment, "jsx-fragment", "React.Fragment",
+		"What JSX fragments are made from")
+	flags.StringVar(&jsxRuntime, "jsx-runtime", "classic",
+		"How JSX elements are made, either classic, calling -jsx-factory, or automatic")
+	flags.StringVar(&jsxImport, "jsx-import-source", "react",
+		"Where the automatic JSX runtime is required from")
+	flags.BoolVar(&jsxPragma, "jsx-pragma", false,
+		"Also compile JSX in .js files with an @jsx comment")
+	flags.Var(&loaderFlags, "loader",
+		"Load files of an extension with a loader, as .ext=js, json, text, css or dataurl. May be repeated")
+	flags.StringVar(&inlineLimit, "inline-limit", "32KB",
+		"Largest file the dataurl loader inlines")
+	flags.IntVar(&jobs, "jobs", 0,
+		"Files to read and parse at once. Defaults to one per CPU")
+	flags.StringVar(&cacheDir, "cache-dir", "",
+		"Directory to cache parsed files in between builds")
+	flags.StringVar(&sourceMapName, "sourcemap", "",
+		"Source map output, expected alongside the squished JS")
+	flags.StringVar(&cssName, "css", "",
+		"Output for the CSS of required stylesheets, leaving them out of the squished JS")
+	flags.StringVar(&cssDir, "css-dir", "",
+		"Directory of -css, relative to the root, which url()s are rewritten against. Defaults to where -css is under -root")
+	flags.StringVar(&cssMapName, "css-sourcemap", "",
+		"Source map output for -css, expected alongside it")
+	flags.StringVar(&graphName, "graph", "",
+		"Dependency graph output")
+	flags.StringVar(&graphFormat, "graph-format", "json",
+		"Format of -graph, either json or dot")
+	flags.StringVar(&statsName, "stats", "",
+		"Output for the size of each module and package, as JSON")
+	flags.StringVar(&statsHTMLName, "stats-html", "",
+		"Output for a page showing the size of each module and package")
+	flags.StringVar(&maxSize, "max-size", "",
+		"Fail if the bundle is bigger than this, in bytes or with a KB or MB suffix")
+	flags.StringVar(&maxGzipped, "max-gzipped-size", "",
+		"Fail if the bundle is bigger than this once gzipped")
+	flags.Var(&packageBudgets, "max-package-size",
+		"Fail if a package is bigger than a size, given as name=size. May be repeated")
+	flags.BoolVar(&watch, "watch", false,
+		"Keep running, building again whenever a file under -root changes")
+	flags.DurationVar(&watchInterval, "watch-interval", 250*time.Millisecond,
+		"How often to check for changes with -watch")
+	flags.BoolVar(&verbose, "verbose", false,
+		"Say every path tried when a require can't be resolved")
+	return flags
+}
+
+// Bad or missing flags, which have already been reported along with the usage
+type usageError struct {
+	error
+}
+
+// Subcommands, run by giving their name as the first argument
+var commands = map[string]func(args []string) error{
+	"resolve": resolve,
+	"serve":   serve,
+	"why":     why,
 }
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+			if _, ok := err.(usageError); ok {
+				os.Exit(2)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, arg := range os.Args[1:] {
+		if arg == "--persistent_worker" {
+			if err := work(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
-	if jsTarName == "" || entrypoint == "" || outputName == "" {
-		flag.PrintDefaults()
-		os.Exit(2)
+	args, err := jssquish.ExpandArgFiles(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := build(args, os.Stderr, nil); err != nil {
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
+		}
+		log.Fatal(err)
+	}
+}
+
+// Parses the flags for a build, and runs it. A persistent worker passes the
+// JSTars it has kept open as `repos`.
+func build(args []string, output io.Writer, repos *repoCache) error {
+	flags := newFlagSet(output)
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if (len(jsTarNames) == 0 && rootDir == "") || entrypoint == "" ||
+		outputName == "" {
+		flags.PrintDefaults()
+		return usageError{errors.New("missing -jstar or -root, or -output")}
 	}
+	if graphFormat != "json" && graphFormat != "dot" {
+		flags.PrintDefaults()
+		return usageError{fmt.Errorf("unknown -graph-format %q", graphFormat)}
+	}
+	if jsxRuntime != "classic" && jsxRuntime != "automatic" {
+		flags.PrintDefaults()
+		return usageError{fmt.Errorf("unknown -jsx-runtime %q", jsxRuntime)}
+	}
+	budget, err := parseBudget()
+	if err != nil {
+		flags.PrintDefaults()
+		return usageError{err}
+	}
+	loaders, limit, err := parseLoaders()
+	if err != nil {
+		flags.PrintDefaults()
+		return usageError{err}
+	}
+
 	var env *string
 	if environment != "" {
 		env = &environment
 	}
 
-	repoFile, err := os.Open(jsTarName)
+	repo, release, err := openRepository(repos)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer release()
 
-	// Note: This will keep the entire source in memory. the `DiskJsTarRepository`
-	// implementation is very close to the same speed, but runs afowl of Bazel's
-	// sandboxing rules. If you're having memory issues running this probably,
-	// this is the likely culprit. See `repository.go` for more details.
-	repo, err := jssquish.NewMemoryJsTarRepository(repoFile)
+	opts := jssquish.Options{
+		Environment: env,
+		Minify:      minify,
+		TreeShake:   treeShake,
+		ScopeHoist:  scopeHoist,
+		Dedupe:      dedupe,
+		JSX:         jsxOptions(),
+		Loaders:     loaders,
+		InlineLimit: limit,
+		Jobs:        jobs,
+		CacheDir:    cacheDir,
+		ParseCache:  parseCache,
+		Verbose:     verbose,
+	}
+	if watch {
+		return watchBuild(repo, opts, budget)
+	}
+	_, err = bundle(repo, opts, budget)
+	return err
+}
+
+func jsxOptions() jssquish.JSXOptions {
+	return jssquish.JSXOptions{
+		Factory:      jsxFactory,
+		Fragment:     jsxFragment,
+		Automatic:    jsxRuntime == "automatic",
+		ImportSource: jsxImport,
+		Pragma:       jsxPragma,
+	}
+}
+
+// Reads the loaders of each extension, and the inline limit, from the flags
+func parseLoaders() (map[string]jssquish.Loader, int, error) {
+	limit, err := jssquish.ParseSize(inlineLimit)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, fmt.Errorf("-inline-limit: %s", err)
 	}
-	defer repo.Close()
 
-	out, err := os.Create(outputName)
+	loaders := make(map[string]jssquish.Loader)
+	for _, lf := range loaderFlags {
+		eq := strings.LastIndex(lf, "=")
+		if eq <= 0 || !strings.HasPrefix(lf, ".") {
+			return nil, 0, fmt.Errorf("-loader: expected .ext=loader, got %q", lf)
+		}
+		loader, err := jssquish.ParseLoader(lf[eq+1:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("-loader: %s", err)
+		}
+		loaders[lf[:eq]] = loader
+	}
+	return loaders, limit, nil
+}
+
+// Reads the size budget from the flags, giving nil if there isn't one
+func parseBudget() (*jssquish.Budget, error) {
+	if maxSize == "" && maxGzipped == "" && len(packageBudgets) == 0 {
+		return nil, nil
+	}
+
+	budget := &jssquish.Budget{Packages: make(map[string]int)}
+	var err error
+	if maxSize != "" {
+		if budget.Size, err = jssquish.ParseSize(maxSize); err != nil {
+			return nil, fmt.Errorf("-max-size: %s", err)
+		}
+	}
+	if maxGzipped != "" {
+		if budget.Gzipped, err = jssquish.ParseSize(maxGzipped); err != nil {
+			return nil, fmt.Errorf("-max-gzipped-size: %s", err)
+		}
+	}
+	for _, pb := range packageBudgets {
+		eq := strings.LastIndex(pb, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("-max-package-size: expected name=size, got %q", pb)
+		}
+		size, err := jssquish.ParseSize(pb[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("-max-package-size: %s", err)
+		}
+		budget.Packages[pb[:eq]] = size
+	}
+	return budget, nil
+}
+
+// Builds the bundle, and its source map, CSS, graph and stats if asked for. None
+// are written unless the build succeeds. A bundle over its budget is still
+// written, but fails the build afterwards.
+func bundle(repo jssquish.Repository, opts jssquish.Options,
+	budget *jssquish.Budget) (*jssquish.BuildResult, error) {
+
+	out, sourceMap := &bytes.Buffer{}, &bytes.Buffer{}
+	if sourceMapName != "" {
+		opts.SourceMap = sourceMap
+		opts.SourceMapURL = filepath.Base(sourceMapName)
+	}
+	css, cssMap := &bytes.Buffer{}, &bytes.Buffer{}
+	if cssName != "" {
+		opts.CSS = css
+		opts.CSSDir = cssOutputDir()
+		if cssMapName != "" {
+			opts.CSSSourceMap = cssMap
+			opts.CSSSourceMapURL = filepath.Base(cssMapName)
+		}
+	}
+	opts.Stats = statsName != "" || statsHTMLName != ""
+
+	result, err := jssquish.Build(repo, entrypoint, out, opts)
 	if err != nil {
-		log.Fatal(err)
+		return result, err
+	}
+	for _, dup := range result.Duplicates {
+		log.Printf("warning: %s", dup)
+	}
+	if err := ioutil.WriteFile(outputName, out.Bytes(), 0644); err != nil {
+		return result, err
+	}
+	if sourceMapName != "" {
+		err := ioutil.WriteFile(sourceMapName, sourceMap.Bytes(), 0644)
+		if err != nil {
+			return result, err
+		}
+	}
+	if cssName != "" {
+		if err := ioutil.WriteFile(cssName, css.Bytes(), 0644); err != nil {
+			return result, err
+		}
+		if cssMapName != "" {
+			err := ioutil.WriteFile(cssMapName, cssMap.Bytes(), 0644)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	if graphName != "" {
+		if err := writeGraph(result.Graph); err != nil {
+			return result, err
+		}
+	}
+	if !opts.Stats && budget == nil {
+		return result, nil
 	}
 
-	if err := jssquish.Main(repo, entrypoint, env, out); err != nil {
-		log.Fatal(err)
+	stats := jssquish.NewStats(out.Bytes(), result.Modules)
+	if opts.Stats {
+		if err := writeStats(stats); err != nil {
+			return result, err
+		}
+	}
+	if budget != nil {
+		return result, stats.CheckBudget(*budget)
+	}
+	return result, nil
+}
+
+// The directory the CSS is written to, relative to the root of the repository.
+// Without -css-dir, that's where -css is under -root, or the root itself.
+func cssOutputDir() string {
+	if cssDir != "" || rootDir == "" {
+		return filepath.ToSlash(cssDir)
+	}
+	root, err := filepath.Abs(rootDir)
+	if err != nil {
+		return ""
+	}
+	dir, err := filepath.Abs(filepath.Dir(cssName))
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func writeStats(stats *jssquish.Stats) error {
+	for _, output := range []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{statsName, stats.WriteJSON},
+		{statsHTMLName, stats.WriteHTML},
+	} {
+		if output.name == "" {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := output.write(buf); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(output.name, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeGraph(graph *jssquish.Graph) error {
+	buf := &bytes.Buffer{}
+	var err error
+	if graphFormat == "dot" {
+		err = graph.WriteDOT(buf)
+	} else {
+		err = graph.WriteJSON(buf)
+	}
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(graphName, buf.Bytes(), 0644)
+}
+
+// Builds the bundle over and over, each time any file it was built from
+// changes. Each build reads and resolves every file again, but parsed modules
+// are kept between builds, so only files which have changed are parsed again. This never returns, unless there's no -root to watch.
+func watchBuild(repo jssquish.Repository, opts jssquish.Options,
+	budget *jssquish.Budget) error {
+
+	if rootDir == "" {
+		return errors.New("-watch needs -root, as JSTars never change")
+	}
+	opts.ParseCache = jssquish.NewParseCache()
+
+	for {
+		start := time.Now()
+		result, err := bundle(repo, opts, budget)
+		took := time.Since(start)
+		if err != nil {
+			log.Printf("build failed after %s: %s", took, err)
+		} else {
+			log.Printf("wrote %s in %s", outputName, took)
+		}
+		opts.ParseCache.Prune(0)
+
+		watcher := jssquish.NewFileWatcher(repo,
+			append(result.Files, path.Clean(entrypoint)))
+		changed := watcher.Wait(watchInterval)
+		log.Printf("changed: %s", strings.Join(changed, ", "))
+	}
+}
+
+// Runs `js-squish serve`, serving the bundle over HTTP and building it on
+// request, for local development
+func serve(args []string) error {
+	flags := newFlagSet(os.Stderr)
+	flags.StringVar(&listenAddr, "addr", "localhost:8080",
+		"Address to serve on")
+	flags.StringVar(&bundlePath, "path", "/bundle.js",
+		"Where the bundle is served, with its source map alongside")
+	flags.BoolVar(&hot, "hot", false,
+		"Push changed modules to the page as they're made, replacing them in place")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if rootDir == "" || entrypoint == "" ||
+		!strings.HasPrefix(bundlePath, "/") {
+		flags.PrintDefaults()
+		return usageError{
+			errors.New("missing -root, or -path doesn't start with /")}
+	}
+	if jsxRuntime != "classic" && jsxRuntime != "automatic" {
+		flags.PrintDefaults()
+		return usageError{fmt.Errorf("unknown -jsx-runtime %q", jsxRuntime)}
+	}
+	loaders, limit, err := parseLoaders()
+	if err != nil {
+		flags.PrintDefaults()
+		return usageError{err}
+	}
+
+	var env *string
+	if environment != "" {
+		env = &environment
+	}
+
+	repo, release, err := openRepository(nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	server := jssquish.NewDevServer(repo, entrypoint, bundlePath,
+		jssquish.Options{
+			Environment: env,
+			Minify:      minify,
+			TreeShake:   treeShake,
+			ScopeHoist:  scopeHoist,
+			Dedupe:      dedupe,
+			JSX:         jsxOptions(),
+			Loaders:     loaders,
+			InlineLimit: limit,
+			Jobs:        jobs,
+			CacheDir:    cacheDir,
+			Verbose:     verbose,
+		})
+	if hot {
+		server.EnableHot()
+		go server.Poll(watchInterval)
+	}
+	log.Printf("serving %s at http://%s%s", entrypoint, listenAddr, bundlePath)
+	return http.ListenAndServe(listenAddr, server)
+}
+
+// Runs `js-squish why <path>`, printing every shortest chain of requires from
+// the entrypoint to a module
+func why(args []string) error {
+	flags := newFlagSet(os.Stderr)
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if (len(jsTarNames) == 0 && rootDir == "") || entrypoint == "" ||
+		flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: js-squish why [flags] <path>")
+		flags.PrintDefaults()
+		return usageError{errors.New("missing -jstar or -root, or a path")}
+	}
+	loaders, limit, err := parseLoaders()
+	if err != nil {
+		flags.PrintDefaults()
+		return usageError{err}
+	}
+
+	var env *string
+	if environment != "" {
+		env = &environment
+	}
+
+	repo, release, err := openRepository(nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	chains, err := jssquish.RequireChains(repo, entrypoint, flags.Arg(0),
+		jssquish.Options{
+			Environment: env,
+			TreeShake:   treeShake,
+			JSX:         jsxOptions(),
+			Loaders:     loaders,
+			InlineLimit: limit,
+			Jobs:        jobs,
+			Verbose:     verbose,
+		})
+	if err != nil {
+		return err
+	}
+
+	if len(chains) == 1 && len(chains[0]) == 0 {
+		fmt.Printf("%s is the entrypoint\n", flags.Arg(0))
+		return nil
+	}
+	for i, chain := range chains {
+		if i > 0 {
+			fmt.Println()
+		}
+		for depth, hop := range chain {
+			fmt.Printf("%s%s:%d:%d: %q -> %s\n", strings.Repeat("  ", depth),
+				hop.From, hop.Line, hop.Column, hop.Specifier, hop.To)
+		}
+	}
+	return nil
+}
+
+// Runs `js-squish resolve -from <dir> <require>`, printing each step taken to
+// resolve a require, and what it resolved to
+func resolve(args []string) error {
+	flags := newFlagSet(os.Stderr)
+	flags.StringVar(&resolveFrom, "from", ".",
+		"Directory the require is made from")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err}
+	}
+	if (len(jsTarNames) == 0 && rootDir == "") || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr,
+			"Usage: js-squish resolve [flags] [-from <dir>] <require>")
+		flags.PrintDefaults()
+		return usageError{errors.New("missing -jstar or -root, or a require")}
+	}
+
+	repo, release, err := openRepository(nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	fq, steps, err := jssquish.NewResolverWithOptions(repo, jssquish.Options{}).
+		Trace(flags.Arg(0), resolveFrom)
+	for _, step := range steps {
+		fmt.Println(step)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not resolve '%s' from '%s'", flags.Arg(0),
+			resolveFrom)
+	}
+	fmt.Println(fq)
+	return nil
+}
+
+// Runs as a Bazel persistent worker, building a bundle for each request read
+// from stdin. Parsed modules and open JSTars are kept between requests, keyed
+// on the digests of their contents, so only what's changed is read again.
+func work() error {
+	repos := newRepoCache()
+	parseCache = jssquish.NewParseCache()
+
+	return jssquish.ServeWorker(os.Stdin, os.Stdout,
+		func(req *jssquish.WorkRequest) *jssquish.WorkResponse {
+			output := &bytes.Buffer{}
+			log.SetOutput(output)
+			defer log.SetOutput(os.Stderr)
+
+			resp := &jssquish.WorkResponse{}
+			repos.start(req.Inputs)
+			if err := build(req.Arguments, output, repos); err != nil {
+				fmt.Fprintln(output, err)
+				resp.ExitCode = 1
+			}
+			repos.finish()
+			parseCache.Prune(workerKeepBuilds)
+
+			resp.Output = output.String()
+			return resp
+		})
+}
+
+// JSTars kept open by a persistent worker, keyed by their path and digest. One
+// is closed as soon as a request goes by without using it.
+type repoCache struct {
+	digests map[string][]byte
+	repos   map[string]jssquish.Repository
+	used    map[string]bool
+}
+
+func newRepoCache() *repoCache {
+	return &repoCache{repos: make(map[string]jssquish.Repository)}
+}
+
+// Starts a request with the given inputs
+func (rc *repoCache) start(inputs []jssquish.WorkInput) {
+	rc.digests = make(map[string][]byte, len(inputs))
+	for _, input := range inputs {
+		rc.digests[input.Path] = input.Digest
+	}
+	rc.used = make(map[string]bool)
+}
+
+// Opens a JSTar, or finds it already open. The JSTar is only the caller's to
+// close when `owned` is set, which is when there's no digest to know it by.
+func (rc *repoCache) open(name string) (repo jssquish.Repository, owned bool,
+	err error) {
+
+	digest, ok := rc.digests[name]
+	if !ok || len(digest) == 0 {
+		repo, err := openJsTar(name)
+		return repo, true, err
+	}
+
+	key := fmt.Sprintf("%s %x %t %d", name, digest, lazy, lazyCacheMB)
+	rc.used[key] = true
+	if repo, ok := rc.repos[key]; ok {
+		return repo, false, nil
+	}
+	if repo, err = openJsTar(name); err != nil {
+		return nil, false, err
+	}
+	rc.repos[key] = repo
+	return repo, false, nil
+}
+
+// Ends a request, closing every JSTar it didn't use
+func (rc *repoCache) finish() {
+	for key, repo := range rc.repos {
+		if !rc.used[key] {
+			repo.Close()
+			delete(rc.repos, key)
+		}
+	}
+}
+
+// Opens each JSTar, and the root directory if given, as layers of one
+// repository. A single layer is used as-is. The returned function closes every
+// layer which isn't being kept open in `repos`.
+func openRepository(repos *repoCache) (jssquish.Repository, func(), error) {
+	var layers, owned []jssquish.Repository
+	release := func() {
+		for _, layer := range owned {
+			layer.Close()
+		}
+	}
+
+	for _, name := range jsTarNames {
+		var (
+			layer jssquish.Repository
+			err   error
+			own   = true
+		)
+		if repos != nil {
+			layer, own, err = repos.open(name)
+		} else {
+			layer, err = openJsTar(name)
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		layers = append(layers, layer)
+		if own {
+			owned = append(owned, layer)
+		}
+	}
+
+	if rootDir != "" {
+		layer, err := jssquish.NewDirRepository(rootDir, followSymlinks)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		layers = append(layers, layer)
+		owned = append(owned, layer)
+	}
+
+	if len(layers) == 1 {
+		return layers[0], release, nil
+	}
+	return jssquish.NewOverlayRepository(layers...), release, nil
+}
+
+func openJsTar(name string) (jssquish.Repository, error) {
+	repoFile, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if lazy {
+		return jssquish.NewIndexedJsTarRepository(repoFile, lazyCacheMB<<20)
+	}
+	defer repoFile.Close()
+
+	// Note: This will keep the entire source in memory. the `DiskJsTarRepository`
+	// implementation is very close to the same speed, but runs afowl of Bazel's
+	// sandboxing rules. If you're having memory issues running this probably,
+	// this is the likely culprit, and `-lazy` is worth a try. See `repository.go`
+	// and `indexed_repository.go` for more details.
+	return jssquish.NewMemoryJsTarRepository(repoFile)
 }
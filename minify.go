@@ -0,0 +1,228 @@
+package jssquish
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/robertkrimen/otto/ast"
+)
+
+// The parameters every module is wrapped with, in order
+var wrapperParams = []string{"require", "module", "exports"}
+
+// A source which has been minified, ready to be written out
+type minified struct {
+	tokens  []token
+	renames map[int]string
+
+	// Names for the wrapper's parameters, with any unused trailing ones dropped
+	params []string
+}
+
+// Minifies a module body. When the module has been parsed, its local names,
+// including the wrapper's parameters, are shortened. Otherwise, or if the
+// module uses `eval` or `with` in a way which makes renaming unsafe, names are
+// left alone and only comments and whitespace are stripped.
+func minifyModule(src []byte, path string, program *ast.Program) (*minified,
+	error) {
+
+	tokens, err := tokenize(string(src), path)
+	if err != nil {
+		return nil, err
+	}
+
+	min := &minified{
+		tokens: tokens,
+		params: wrapperParams,
+	}
+	if program == nil {
+		return min, nil
+	}
+
+	tree, err := analyzeScopes(program, wrapperParams)
+	if err != nil {
+		return nil, err
+	}
+	min.renames = tree.mangle()
+
+	// Trailing parameters the module never mentions don't need declaring,
+	// unless it might be counting them through `arguments`
+	params := make([]string, len(wrapperParams))
+	used := 0
+	keepAll := tree.root.frozen
+	for _, ref := range tree.root.outerRefs {
+		keepAll = keepAll || ref.name == "arguments" &&
+			ref.scope.functionScope() == tree.root
+	}
+	for i, param := range wrapperParams {
+		b := tree.root.bindings[param]
+		params[i] = b.newName
+		if len(b.sites) > 0 || keepAll {
+			used = i + 1
+		}
+	}
+	min.params = params[:used]
+	return min, nil
+}
+
+// Minifies a script which runs in the global scope, such as the preamble.
+// Top-level names are global, and so are kept as-is.
+func minifyScript(src []byte, path string, program *ast.Program) ([]byte,
+	error) {
+
+	tokens, err := tokenize(string(src), path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := analyzeScopes(program, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	printer := &compactPrinter{w: &positionWriter{w: buf}, source: -1}
+	if err := printer.Print(tokens, tree.mangle()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes tokens back out with as little space between them as possible,
+// optionally recording a source mapping for each.
+type compactPrinter struct {
+	w      *positionWriter
+	sm     *sourceMap
+	source int
+
+	// For tokens put together from several sources, the source index and line
+	// each line of tokens came from
+	sources []int
+	origins []lineOrigin
+
+	// The last token written, and what was written for it
+	prev     *token
+	prevText string
+}
+
+func (cp *compactPrinter) Print(tokens []token, renames map[int]string) error {
+	for i := range tokens {
+		tok := &tokens[i]
+		if tok.trivia() {
+			continue
+		}
+
+		text, name := tok.text, ""
+		if renamed, ok := renames[tok.offset]; ok && tok.kind == tokIdentifier {
+			text, name = renamed, tok.text
+		}
+
+		if cp.prev != nil {
+			if sep := separator(cp.prev, cp.prevText, tok, text); sep != "" {
+				if _, err := io.WriteString(cp.w, sep); err != nil {
+					return err
+				}
+			}
+		}
+
+		if cp.sm != nil && cp.source >= 0 {
+			source, line := cp.source, tok.line
+			if tok.line < len(cp.origins) {
+				origin := cp.origins[tok.line]
+				source, line = cp.sources[origin.source], origin.line
+			}
+			cp.sm.AddMapping(cp.w.line, cp.w.col, source, line, tok.col, name)
+		}
+		if _, err := io.WriteString(cp.w, text); err != nil {
+			return err
+		}
+		cp.prev, cp.prevText = tok, text
+	}
+	return nil
+}
+
+// What has to go between two adjacent tokens. A line break is kept wherever
+// automatic semicolon insertion might have been relied on, and a space wherever
+// the two would otherwise run together into something else.
+func separator(prev *token, prevText string, next *token, nextText string) string {
+	if next.newline && lineBreakSignificant(prev, next) {
+		return "\n"
+	}
+
+	last, _ := utf8.DecodeLastRuneInString(prevText)
+	first, _ := utf8.DecodeRuneInString(nextText)
+
+	switch {
+	// `a in b`, `return x`, `1 instanceof Number`, `/re/g in x`
+	case isIdentifierPart(last) && (isIdentifierPart(first) || first == '\\'):
+		return " "
+
+	// `/re/ in x`, which would otherwise run into the flags
+	case prev.kind == tokRegExp && (isIdentifierPart(first) || first == '\\'):
+		return " "
+
+	// `1 .toString()`
+	case prev.kind == tokNumber && first == '.':
+		return " "
+
+	// `a + +b`, `a - --b`
+	case (last == '+' || last == '-') && first == last:
+		return " "
+
+	// `a / /re/`, which would otherwise start a comment
+	case last == '/' && (first == '/' || first == '*'):
+		return " "
+
+	// `<!--` and `-->` start comments in browsers
+	case last == '<' && first == '!', strings.HasSuffix(prevText, "--") &&
+		first == '>':
+		return " "
+	}
+	return ""
+}
+
+// Punctuators after which a statement can't end, so a following line break
+// can never stand in for a semicolon.
+var continuesAfter = map[string]bool{
+	"{": true, "(": true, "[": true, ",": true, ";": true, ":": true, "?": true,
+	".": true, "?.": true, "=": true, "==": true, "===": true, "!=": true,
+	"!==": true, "<": true, ">": true, "<=": true, ">=": true, "+": true,
+	"-": true, "*": true, "/": true, "%": true, "**": true, "&": true, "|": true,
+	"^": true, "!": true, "~": true, "&&": true, "||": true, "??": true,
+	"<<": true, ">>": true, ">>>": true, "+=": true, "-=": true, "*=": true,
+	"/=": true, "%=": true, "**=": true, "&=": true, "|=": true, "^=": true,
+	"<<=": true, ">>=": true, ">>>=": true, "&&=": true, "||=": true,
+	"??=": true, "=>": true, "...": true,
+}
+
+// Punctuators which can't start a statement, so a line break before them never
+// ends one.
+var continuesBefore = map[string]bool{
+	"}": true, ")": true, "]": true, ",": true, ";": true, ":": true, "?": true,
+	".": true, "?.": true, "=": true, "==": true, "===": true, "!=": true,
+	"!==": true, ">": true, "<=": true, ">=": true, "*": true, "%": true,
+	"**": true, "&": true, "|": true, "^": true, "&&": true, "||": true,
+	"??": true, "<<": true, ">>": true, ">>>": true, "+=": true, "-=": true,
+	"*=": true, "/=": true, "%=": true, "**=": true, "&=": true, "|=": true,
+	"^=": true, "<<=": true, ">>=": true, ">>>=": true, "&&=": true,
+	"||=": true, "??=": true, "=>": true,
+}
+
+// Keywords which may not be followed by a line break without ending their
+// statement
+var restricted = map[string]bool{
+	"return": true, "break": true, "continue": true, "throw": true,
+	"yield": true,
+}
+
+func lineBreakSignificant(prev, next *token) bool {
+	if prev.kind == tokPunctuator && continuesAfter[prev.text] {
+		return false
+	}
+	if next.kind == tokPunctuator && continuesBefore[next.text] &&
+		!(prev.kind == tokIdentifier && restricted[prev.text]) {
+		return false
+	}
+	return true
+}
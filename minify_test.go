@@ -0,0 +1,197 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lexer", func() {
+
+	texts := func(src string) []string {
+		tokens, err := tokenize(src, "test.js")
+		Expect(err).ToNot(HaveOccurred())
+
+		var texts []string
+		for _, tok := range tokens {
+			if !tok.trivia() {
+				texts = append(texts, tok.text)
+			}
+		}
+		return texts
+	}
+
+	It("should reproduce the source exactly", func() {
+		src := "var a = `x${ {b: '}'}.b }y` // done\r\n/* c */ a /= 2;"
+		tokens, err := tokenize(src, "test.js")
+		Expect(err).ToNot(HaveOccurred())
+
+		joined := ""
+		for _, tok := range tokens {
+			joined += tok.text
+		}
+		Expect(joined).To(Equal(src))
+	})
+
+	It("should tell regular expressions from division", func() {
+		Expect(texts("a = b / c / d")).To(Equal(
+			[]string{"a", "=", "b", "/", "c", "/", "d"}))
+		Expect(texts("return /[/]+/g.test(x)")).To(Equal(
+			[]string{"return", "/[/]+/g", ".", "test", "(", "x", ")"}))
+		Expect(texts("f(x) / 2")).To(Equal(
+			[]string{"f", "(", "x", ")", "/", "2"}))
+	})
+
+	It("should track lines and UTF-16 columns", func() {
+		tokens, err := tokenize("'\U0001F600' +\n  b", "test.js")
+		Expect(err).ToNot(HaveOccurred())
+
+		plus, b := tokens[2], tokens[4]
+		Expect(plus.text).To(Equal("+"))
+		Expect(plus.col).To(Equal(5))
+		Expect(b.line).To(Equal(1))
+		Expect(b.col).To(Equal(2))
+		Expect(b.newline).To(BeTrue())
+	})
+
+	It("should fail on an unterminated string", func() {
+		_, err := tokenize("var a = 'oops\n", "test.js")
+		Expect(err).To(MatchError("test.js:1:9: unterminated string"))
+	})
+})
+
+var _ = Describe("Minify", func() {
+
+	minify := func(src string) (string, []string) {
+		program, err := parseProgram(src, "test.js")
+		Expect(err).ToNot(HaveOccurred())
+		min, err := minifyModule([]byte(src), "test.js", program)
+		Expect(err).ToNot(HaveOccurred())
+
+		buf := &bytes.Buffer{}
+		printer := &compactPrinter{w: &positionWriter{w: buf}, source: -1}
+		Expect(printer.Print(min.tokens, min.renames)).To(Succeed())
+		return buf.String(), min.params
+	}
+
+	It("should strip comments and whitespace", func() {
+		out, _ := minify("/* hi */ if (x) {\n  // there\n  y( 1 , 2 );\n}")
+		Expect(out).To(Equal("if(x){y(1,2);}"))
+	})
+
+	It("should keep tokens from running together", func() {
+		out, _ := minify("x = a + +b; y = a - -b; z = 1 .toString(); w = /a/ in q")
+		Expect(out).To(Equal(
+			"x=a+ +b;y=a- -b;z=1 .toString();w=/a/ in q"))
+	})
+
+	It("should keep line breaks which end statements", func() {
+		out, _ := minify("var a = 1\nvar b = a\n++b\nfunction f() { return\n1 }")
+		Expect(out).To(Equal("var a=1\nvar b=a\n++b\nfunction c(){return\n1}"))
+	})
+
+	It("should drop line breaks which can't end statements", func() {
+		out, _ := minify("foo(1,\n2)\n.bar(\n3\n)")
+		Expect(out).To(Equal("foo(1,2).bar(3)"))
+	})
+
+	It("should shorten local names, but not globals or properties", func() {
+		out, _ := minify(
+			"var first = window.x; function f(second) { return second.first }")
+		Expect(out).To(Equal("var b=window.x;function a(a){return a.first}"))
+	})
+
+	It("should shorten the wrapper's parameters, dropping unused ones", func() {
+		out, params := minify("module.exports = require('x')")
+		Expect(out).To(Equal("a.exports=b('x')"))
+		Expect(params).To(Equal([]string{"b", "a"}))
+	})
+
+	It("should keep the wrapper's parameters when counting arguments", func() {
+		_, params := minify("console.log(arguments.length)")
+		Expect(params).To(HaveLen(3))
+	})
+
+	It("should leave names alone around eval", func() {
+		out, _ := minify(
+			"var outer = 1; function f(inner) { return eval('inner + outer') }")
+		Expect(out).To(Equal(
+			"var outer=1;function f(inner){return eval('inner + outer')}"))
+	})
+
+	It("should leave names alone around with", func() {
+		out, _ := minify("function f(obj, key) { with (obj) { return key } }")
+		Expect(out).To(Equal("function f(obj,key){with(obj){return key}}"))
+	})
+
+	It("should rename a catch parameter apart from its function", func() {
+		out, _ := minify(
+			"function f(arg) { try { g(arg) } catch (err) { h(err, arg) } }")
+		Expect(out).To(Equal("function a(a){try{g(a)}catch(b){h(b,a)}}"))
+	})
+
+	It("should not shadow names used from an inner scope", func() {
+		out, _ := minify(
+			"function f(x) { var y = x; return function () { return a + y } }")
+		Expect(out).ToNot(ContainSubstring("var a"))
+		Expect(out).To(ContainSubstring("return a+"))
+	})
+})
+
+var _ = Describe("Source maps", func() {
+
+	It("should encode VLQs", func() {
+		for n, expected := range map[int]string{
+			0: "A", 1: "C", -1: "D", 15: "e", 16: "gB", -17: "jB", 1000: "w+B",
+		} {
+			buf := &bytes.Buffer{}
+			writeVLQ(buf, n)
+			Expect(buf.String()).To(Equal(expected))
+		}
+	})
+
+	It("should map minified output back to the source", func() {
+		sm := newSourceMap("out.js")
+		src := "var long = 1;\nlong++"
+		source := sm.AddSource("in.js", []byte(src))
+
+		tokens, err := tokenize(src, "in.js")
+		Expect(err).ToNot(HaveOccurred())
+		buf := &bytes.Buffer{}
+		printer := &compactPrinter{
+			w:      &positionWriter{w: buf},
+			sm:     sm,
+			source: source,
+		}
+		renames := map[int]string{4: "a", 14: "a"}
+		Expect(printer.Print(tokens, renames)).To(Succeed())
+		Expect(buf.String()).To(Equal("var a=1;a++"))
+
+		out := &bytes.Buffer{}
+		_, err = sm.WriteTo(out)
+		Expect(err).ToNot(HaveOccurred())
+
+		var decoded struct {
+			Version        int
+			File           string
+			Sources        []string
+			SourcesContent []string
+			Names          []string
+			Mappings       string
+		}
+		Expect(json.Unmarshal(out.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded.Version).To(Equal(3))
+		Expect(decoded.File).To(Equal("out.js"))
+		Expect(decoded.Sources).To(Equal([]string{"in.js"}))
+		Expect(decoded.SourcesContent).To(Equal([]string{src}))
+		Expect(decoded.Names).To(Equal([]string{"long"}))
+
+		// var, a (long), =, 1, ;, a (long, next line), ++
+		Expect(strings.Split(decoded.Mappings, ",")).To(Equal([]string{
+			"AAAA", "IAAIA", "CAAK", "CAAE", "CAAC", "CACZA", "CAAI",
+		}))
+	})
+})
@@ -0,0 +1,72 @@
+package jssquish
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// `Repository` implementation which stacks several others into one logical
+// tree. Layers are given bottom to top, so when more than one layer has a file
+// at the same path, the last one wins. This makes it cheap to combine, say, a
+// vendored `js_tar`, an application `js_tar`, and a small directory of
+// per-environment overrides without re-tarring the lot.
+type OverlayRepository struct {
+	layers []Repository
+}
+
+// Creates a new `OverlayRepository` from the given layers, bottom-most first.
+// The overlay takes ownership of the layers, and will close them when it is
+// closed.
+func NewOverlayRepository(layers ...Repository) *OverlayRepository {
+	return &OverlayRepository{layers}
+}
+
+// Checks each layer for the requested file.
+func (or *OverlayRepository) IsFile(path string) bool {
+	return or.layerFor(path) != nil
+}
+
+// Opens the requested file from the top-most layer that has it.
+func (or *OverlayRepository) Open(path string) (io.ReadCloser, error) {
+	layer := or.layerFor(path)
+	if layer == nil {
+		return nil, fmt.Errorf("Could not open path: %s", path)
+	}
+	return layer.Open(path)
+}
+
+// Closes every layer, even if some fail. The first error encountered is
+// returned.
+func (or *OverlayRepository) Close() error {
+	var first error
+	for _, layer := range or.layers {
+		if err := layer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Describes a file or directory from the top-most layer which can, and has it.
+// Layers which can't change are skipped.
+func (or *OverlayRepository) Stat(path string) (os.FileInfo, error) {
+	for i := len(or.layers) - 1; i >= 0; i-- {
+		if layer, ok := or.layers[i].(StatRepository); ok {
+			if fi, err := layer.Stat(path); err == nil {
+				return fi, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Could not stat path: %s", path)
+}
+
+// Finds the top-most layer containing the given path, or nil if none do.
+func (or *OverlayRepository) layerFor(path string) Repository {
+	for i := len(or.layers) - 1; i >= 0; i-- {
+		if or.layers[i].IsFile(path) {
+			return or.layers[i]
+		}
+	}
+	return nil
+}
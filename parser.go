@@ -9,11 +9,20 @@ import (
 )
 
 func ParseRequires(r io.Reader, path string) ([]string, error) {
-	program, err := parser.ParseFile(nil, path, r, parser.IgnoreRegExpErrors)
+	program, err := parseProgram(r, path)
 	if err != nil {
 		return nil, err
 	}
+	return programRequires(program)
+}
+
+// Parses a source, which may be anything `parser.ParseFile` accepts
+func parseProgram(src interface{}, path string) (*ast.Program, error) {
+	return parser.ParseFile(nil, path, src, parser.IgnoreRegExpErrors)
+}
 
+// Finds the requires of an already parsed program
+func programRequires(program *ast.Program) ([]string, error) {
 	visitor := NewRequireVisitor()
 	for _, stmt := range program.Body {
 		if err := WalkNode(visitor, stmt); err != nil {
@@ -25,6 +34,7 @@ func ParseRequires(r io.Reader, path string) ([]string, error) {
 
 type RequireVisitor struct {
 	requires map[string]bool
+	order    []string
 }
 
 func NewRequireVisitor() *RequireVisitor {
@@ -58,16 +68,17 @@ func (rv *RequireVisitor) visitCallExpression(ce *ast.CallExpression) bool {
 			log.Printf("require statement with non-string argument found")
 			return false
 		} else {
-			rv.requires[str.Value] = true
+			if !rv.requires[str.Value] {
+				rv.requires[str.Value] = true
+				rv.order = append(rv.order, str.Value)
+			}
 		}
 	}
 	return true
 }
 
+// The distinct modules required, in the order they're first required, so that
+// bundling the same sources always gives the same result
 func (rv *RequireVisitor) Requires() []string {
-	requires := make([]string, 0, len(rv.requires))
-	for k := range rv.requires {
-		requires = append(requires, k)
-	}
-	return requires
+	return rv.order
 }
@@ -1,8 +1,15 @@
 var process = {env: {NODE_ENV: {{.Environment}}}};
+{{- range .Helpers}}
+{{.}}
+{{- end}}
 
 (function outer (modules, cache, entry) {
   // Save the require from previous bundle to this closure if any
   var previousRequire = typeof require === "function" && require;
+{{- if .Hot}}
+
+{{template "hot" .}}
+{{- end}}
 
   function newRequire(name, jumped){
     if(!cache[name]) {
@@ -23,8 +30,14 @@ var process = {env: {NODE_ENV: {{.Environment}}}};
         throw err;
       }
       var m = cache[name] = {exports:{}};
+{{- if .Hot}}
+      m.hot = hotModule(name);
+{{- end}}
       modules[name][0].call(m.exports, function(x) {
         var id = modules[name][1][x];
+{{- if .Hot}}
+        if (id) hotRequired(id, name);
+{{- end}}
         return newRequire(id ? id : x);
       }, m, m.exports, outer, modules, cache, entry);
     }
@@ -3,38 +3,50 @@ package jssquish
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	pth "path"
 	"path/filepath"
+	"strings"
 )
 
 // A `Repository` is a collection of files. The node resolution algorithm will
 // make many checks to see if various files exist, so it's assume the `IsFile`
-// implementation will be fast.
+// implementation will be fast. Files are read from many goroutines at once, so
+// implementations must be safe for concurrent use.
 type Repository interface {
 	IsFile(path string) bool
 	Open(path string) (io.ReadCloser, error)
 	Close() error
 }
 
+// A `Repository` whose files can change, which can tell when they have. `Stat`
+// works for directories as well as files.
+type StatRepository interface {
+	Repository
+	Stat(path string) (os.FileInfo, error)
+}
+
 // `Repository` implementation which loads the contents of all files into memory
 // on construction. Because consumers will also likely copy the contents into
 // memory, this will not work for repositories which have a deflated size
 // larger than a gig or two.
 type MemoryRepository map[string]*bytes.Buffer
 
-// Creates a new `MemoryRepository` from a `js_tar`. It will load the entire
-// decompressed contents of the repository into memory.
+// Creates a new `MemoryRepository` from a `js_tar`, or any other archive
+// `iterateArchive` understands. It will load the entire decompressed contents
+// of the repository into memory.
 func NewMemoryJsTarRepository(f *os.File) (MemoryRepository, error) {
 	repo := make(MemoryRepository)
 
-	err := iterateTar(f, func(hdr *tar.Header, fi os.FileInfo,
+	err := iterateArchive(f, func(hdr *tar.Header, fi os.FileInfo,
 		r io.Reader) error {
 
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
 		buf := &bytes.Buffer{}
 		if _, err := buf.ReadFrom(r); err != nil {
 			return err
@@ -56,12 +68,12 @@ func (repo MemoryRepository) IsFile(path string) bool {
 	return ok
 }
 
-// Returns the contents of the in-memory `bytes.Buffer` for the requested file,
-// or errors. Note that it's safe to read from this buffer multiple times, which
-// is not the case for general `Repository` implementations.
+// Returns a reader over the in-memory contents of the requested file, or
+// errors. Each reader starts from the beginning, so a file can be read any
+// number of times, and from many goroutines at once.
 func (repo MemoryRepository) Open(path string) (io.ReadCloser, error) {
 	if buf, ok := repo[path]; ok {
-		return ioutil.NopCloser(buf), nil
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
 	} else {
 		return nil, fmt.Errorf("Could not open path: %s", path)
 	}
@@ -79,70 +91,102 @@ func (mr MemoryRepository) Close() error {
 // It will not preserve ownership, mode, or other metadata when expanding a
 // file.
 // When expanding, it will create a cache of filenames to keep `IsFile` snappy.
+//
+// Archives are treated as untrusted. Entries with absolute names, or names
+// which walk up and out of the archive, are rejected outright. Symlinks and
+// hard links are never created on disk. Instead, they're recorded as aliases
+// and resolved on lookup, and must point at somewhere inside the archive.
 type DiskRepository struct {
 	root  string
 	cache map[string]bool
+	links map[string]string
 }
 
-// Creates a new `DiskRepository` by expanding the contents of a `js_tar` to a
-// temporary directory.
+// The most links followed resolving a single path before giving up on it as a
+// cycle. This matches Linux's limit.
+const maxLinkHops = 40
+
+// Creates a new `DiskRepository` by expanding the contents of a `js_tar`, or
+// any other archive `iterateArchive` understands, to a temporary directory.
 func NewDiskJsTarRepository(f *os.File) (*DiskRepository, error) {
 	dir, err := ioutil.TempDir(os.Getenv("TMPDIR"), "js-squish")
 	if err != nil {
 		return nil, err
 	}
 
-	files := make(map[string]bool)
-	err = iterateTar(f, func(hdr *tar.Header, fi os.FileInfo, r io.Reader) error {
+	repo := &DiskRepository{
+		root:  dir,
+		cache: make(map[string]bool),
+		links: make(map[string]string),
+	}
 
-		dstPath := pth.Join(dir, hdr.Name)
-		if dstPath == dir {
-			return nil
+	err = iterateArchive(f, func(hdr *tar.Header, fi os.FileInfo,
+		r io.Reader) error {
+
+		name, ok := cleanPath(hdr.Name)
+		if !ok {
+			return fmt.Errorf("Archive entry escapes its root: %s", hdr.Name)
 		}
-		if fi.IsDir() {
+		if name == "." {
 			return nil
 		}
-		if os.MkdirAll(pth.Dir(dstPath), 0); err != nil {
-			return err
-		} else {
-			files[filepath.Clean(hdr.Name)] = true
-		}
 
-		if dst, err := os.Create(dstPath); err != nil {
-			return err
-		} else if _, err := io.Copy(dst, r); err != nil {
-			return err
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			return repo.extract(name, r)
+
+		case tar.TypeSymlink:
+			// Symlink targets are relative to the link, and may not be absolute
+			target, ok := "", false
+			if !pth.IsAbs(hdr.Linkname) {
+				target, ok = cleanPath(pth.Join(pth.Dir(name), hdr.Linkname))
+			}
+			if !ok {
+				return fmt.Errorf("Archive symlink %s escapes its root: %s",
+					hdr.Name, hdr.Linkname)
+			}
+			repo.link(name, target)
+
+		case tar.TypeLink:
+			// Hard link targets are relative to the root of the archive
+			target, ok := cleanPath(hdr.Linkname)
+			if !ok {
+				return fmt.Errorf("Archive hard link %s escapes its root: %s",
+					hdr.Name, hdr.Linkname)
+			}
+			repo.link(name, target)
 		}
+
+		// Directories are created as needed, and anything else (devices, fifos,
+		// etc.) has no business in a `js_tar`.
 		return nil
 	})
 
 	if err != nil {
+		os.RemoveAll(dir)
 		return nil, err
 	}
 
-	repo := &DiskRepository{
-		root:  dir,
-		cache: files,
-	}
 	return repo, nil
 }
 
-// Consults the cache to see if this requested file has been extracted
+// Consults the cache to see if this requested file has been extracted, or is a
+// link to one that has.
 func (dr *DiskRepository) IsFile(path string) bool {
-	_, ok := dr.cache[path]
+	_, ok := dr.resolve(path)
 	return ok
 }
 
 // Opens the file directly from disk. This will return the actual `os.File`
 // instance, so its up the caller to close it in order to not leak handles.
-// Also note that this won't prevent walking up and out of a directory, and is
-// generally not safe to consume untrusted inputs.
+// Only extracted files can be opened, so there's no way to walk up and out of
+// the temporary directory.
 func (dr *DiskRepository) Open(path string) (io.ReadCloser, error) {
-	if !dr.IsFile(path) {
+	extracted, ok := dr.resolve(path)
+	if !ok {
 		return nil, fmt.Errorf("Could not open path: %s in %s", path, dr.root)
 	}
-	absolute := pth.Join(dr.root, path)
-	return os.Open(absolute)
+	return os.Open(filepath.Join(dr.root, filepath.FromSlash(extracted)))
 }
 
 // Removes the temporary directory this implementation used to store the
@@ -151,48 +195,190 @@ func (dr *DiskRepository) Close() error {
 	return os.RemoveAll(dr.root)
 }
 
-type tarFlowControl uint8
-
-func (tarFlowControl) Error() string {
-	return "Stop Iteration"
-}
-
-const stopIteration = tarFlowControl(0)
-
-// Iterate over a tar file, invoking each function as a file is encountered. To
-// abort iteration, the function can return the above defined `stopIteration`
-// error value.
-// Because the tar reading implementation is serial and stateful, It is not safe
-// to call this function with the same file concurrently.
-func iterateTar(f *os.File, each func(*tar.Header, os.FileInfo,
-	io.Reader) error) error {
-
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
+// Writes out a regular file from the archive. A later entry with the same name
+// replaces an earlier one. Because links are never created on disk, there's no
+// way for this to write through one and out of the temporary directory.
+func (dr *DiskRepository) extract(name string, r io.Reader) error {
+	dstPath := filepath.Join(dr.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 		return err
 	}
-	gzf, err := gzip.NewReader(f)
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer gzf.Close()
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
 
-	tr := tar.NewReader(gzf)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			return nil
+	dr.cache[name] = true
+	delete(dr.links, name)
+	return nil
+}
+
+// Records a link from the archive. As with files, a later entry with the same
+// name replaces an earlier one.
+func (dr *DiskRepository) link(name, target string) {
+	dr.links[name] = target
+	delete(dr.cache, name)
+}
+
+// Maps a requested path to the extracted file it names, following links along
+// the way. A link may name a directory, in which case it's substituted for the
+// leading part of the path.
+func (dr *DiskRepository) resolve(path string) (string, bool) {
+	path, ok := cleanPath(path)
+	if !ok {
+		return "", false
+	}
+
+	for hops := 0; hops <= maxLinkHops; hops++ {
+		if dr.cache[path] {
+			return path, true
 		}
-		if err != nil {
-			return err
+		if len(dr.links) == 0 {
+			return "", false
 		}
 
-		err = each(hdr, hdr.FileInfo(), tr)
-		if err == stopIteration {
-			return nil
+		// Find the longest leading part of the path which is a link, and swap in
+		// its target.
+		prefix, rest, found := path, "", false
+		for {
+			if target, ok := dr.links[prefix]; ok {
+				path, found = pth.Join(target, rest), true
+				break
+			}
+			i := strings.LastIndex(prefix, "/")
+			if i < 0 {
+				break
+			}
+			prefix, rest = prefix[:i], pth.Join(prefix[i+1:], rest)
 		}
-		if err != nil {
-			return err
+		if !found {
+			return "", false
 		}
 	}
+	return "", false
+}
+
+// `Repository` implementation which reads files straight out of a directory on
+// disk. This is handy for local development, where building a `js_tar` for
+// every change is a chore. Requested paths are cleaned and may not walk up and
+// out of the root. Symlinks are only followed when asked for, and a followed
+// symlink may point anywhere on disk, so only enable it for trusted trees.
+type DirRepository struct {
+	root           string
+	followSymlinks bool
+}
+
+// Creates a new `DirRepository` rooted at the given directory.
+func NewDirRepository(root string, followSymlinks bool) (*DirRepository, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// Resolve the root itself up front, so that a symlink somewhere above the
+	// root (ie: `/tmp` on a Mac) isn't mistaken for one inside of it.
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Not a directory: %s", root)
+	}
+
+	repo := &DirRepository{
+		root:           abs,
+		followSymlinks: followSymlinks,
+	}
+	return repo, nil
+}
+
+// Checks the disk to see if the requested path is a regular file under the
+// root.
+func (dr *DirRepository) IsFile(path string) bool {
+	_, ok := dr.lookup(path)
+	return ok
+}
+
+// Opens the file directly from disk. As with `DiskRepository`, it's up to the
+// caller to close the returned file.
+func (dr *DirRepository) Open(path string) (io.ReadCloser, error) {
+	absolute, ok := dr.lookup(path)
+	if !ok {
+		return nil, fmt.Errorf("Could not open path: %s in %s", path, dr.root)
+	}
+	return os.Open(absolute)
+}
+
+// Nothing to clean up. The directory is owned by whoever created it.
+func (dr *DirRepository) Close() error {
 	return nil
 }
+
+// Describes a file or directory under the root. Symlinks are only followed
+// when asked for.
+func (dr *DirRepository) Stat(path string) (os.FileInfo, error) {
+	clean, ok := cleanPath(path)
+	if !ok {
+		return nil, fmt.Errorf("Could not stat path: %s in %s", path, dr.root)
+	}
+	absolute := filepath.Join(dr.root, filepath.FromSlash(clean))
+	if dr.followSymlinks {
+		return os.Stat(absolute)
+	}
+	return os.Lstat(absolute)
+}
+
+// Maps a repository path to an absolute path on disk, provided it names a
+// regular file that doesn't escape the root.
+func (dr *DirRepository) lookup(path string) (string, bool) {
+	clean, ok := cleanPath(path)
+	if !ok {
+		return "", false
+	}
+	absolute := filepath.Join(dr.root, filepath.FromSlash(clean))
+
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	if dr.followSymlinks {
+		fi, err = os.Stat(absolute)
+	} else {
+		// Any symlink along the way will make the resolved path differ from the
+		// one we asked for.
+		if real, err := filepath.EvalSymlinks(absolute); err != nil ||
+			real != absolute {
+			return "", false
+		}
+		fi, err = os.Lstat(absolute)
+	}
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return absolute, true
+}
+
+// Cleans a slash-separated repository path, reporting false for paths which
+// are absolute or would walk up and out of the repository root.
+func cleanPath(path string) (string, bool) {
+	if pth.IsAbs(path) {
+		return "", false
+	}
+	clean := pth.Clean(path)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
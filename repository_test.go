@@ -1,11 +1,16 @@
 package jssquish
 
 import (
+	"archive/tar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 // Simple in-memory repository to use for testing
@@ -43,3 +48,339 @@ func (mr MemRepository) Open(path string) (io.ReadCloser, error) {
 func (mr *MemRepository) Close() error {
 	return nil
 }
+
+var _ = Describe("DirRepository", func() {
+
+	var (
+		root string
+		repo *DirRepository
+	)
+
+	write := func(path, src string) {
+		dst := filepath.Join(root, path)
+		Expect(os.MkdirAll(filepath.Dir(dst), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(dst, []byte(src), 0644)).To(Succeed())
+	}
+
+	read := func(path string) string {
+		r, err := repo.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		return string(bs)
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "js-squish-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		write("src/a.js", "a")
+		write("src/lib/b.js", "b")
+		write("outside.js", "outside")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	Context("rooted at a subdirectory", func() {
+
+		BeforeEach(func() {
+			var err error
+			repo, err = NewDirRepository(filepath.Join(root, "src"), false)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should find files", func() {
+			Expect(repo.IsFile("a.js")).To(BeTrue())
+			Expect(repo.IsFile("lib/b.js")).To(BeTrue())
+			Expect(read("lib/b.js")).To(Equal("b"))
+		})
+
+		It("should not consider directories files", func() {
+			Expect(repo.IsFile("lib")).To(BeFalse())
+			_, err := repo.Open("lib")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should clean paths", func() {
+			Expect(repo.IsFile("lib/../a.js")).To(BeTrue())
+			Expect(read("./lib/./b.js")).To(Equal("b"))
+		})
+
+		It("should not walk up and out of the root", func() {
+			Expect(repo.IsFile("../outside.js")).To(BeFalse())
+			Expect(repo.IsFile("lib/../../outside.js")).To(BeFalse())
+			Expect(repo.IsFile(filepath.Join(root, "outside.js"))).To(BeFalse())
+
+			_, err := repo.Open("../outside.js")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with symlinks", func() {
+
+		BeforeEach(func() {
+			src := filepath.Join(root, "src")
+			Expect(os.Symlink(filepath.Join(root, "outside.js"),
+				filepath.Join(src, "linked.js"))).To(Succeed())
+			Expect(os.Symlink(filepath.Join(src, "lib"),
+				filepath.Join(src, "linked-lib"))).To(Succeed())
+		})
+
+		It("should ignore them by default", func() {
+			var err error
+			repo, err = NewDirRepository(filepath.Join(root, "src"), false)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(repo.IsFile("linked.js")).To(BeFalse())
+			Expect(repo.IsFile("linked-lib/b.js")).To(BeFalse())
+		})
+
+		It("should follow them when asked", func() {
+			var err error
+			repo, err = NewDirRepository(filepath.Join(root, "src"), true)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(read("linked.js")).To(Equal("outside"))
+			Expect(read("linked-lib/b.js")).To(Equal("b"))
+		})
+	})
+
+	It("should not be created from a file", func() {
+		_, err := NewDirRepository(filepath.Join(root, "outside.js"), false)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("OverlayRepository", func() {
+
+	var repo *OverlayRepository
+
+	read := func(path string) string {
+		r, err := repo.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		return string(bs)
+	}
+
+	BeforeEach(func() {
+		repo = NewOverlayRepository(
+			NewMemRepository(map[string]string{
+				"vendor/lib.js": "vendored",
+				"app/config.js": "default config",
+			}),
+			NewMemRepository(map[string]string{
+				"app/index.js":  "app",
+				"app/config.js": "app config",
+			}),
+			NewMemRepository(map[string]string{
+				"app/config.js": "staging config",
+			}),
+		)
+	})
+
+	It("should find files in every layer", func() {
+		Expect(repo.IsFile("vendor/lib.js")).To(BeTrue())
+		Expect(repo.IsFile("app/index.js")).To(BeTrue())
+		Expect(repo.IsFile("app/missing.js")).To(BeFalse())
+
+		Expect(read("vendor/lib.js")).To(Equal("vendored"))
+		Expect(read("app/index.js")).To(Equal("app"))
+	})
+
+	It("should let later layers shadow earlier ones", func() {
+		Expect(read("app/config.js")).To(Equal("staging config"))
+	})
+
+	It("should not open missing files", func() {
+		_, err := repo.Open("app/missing.js")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("DiskRepository", func() {
+
+	var (
+		tmp  string
+		repo *DiskRepository
+	)
+
+	type entry struct {
+		hdr tar.Header
+		src string
+	}
+
+	file := func(name, src string) entry {
+		return entry{tar.Header{Name: name, Typeflag: tar.TypeReg}, src}
+	}
+	symlink := func(name, target string) entry {
+		return entry{tar.Header{Name: name, Linkname: target,
+			Typeflag: tar.TypeSymlink}, ""}
+	}
+	hardlink := func(name, target string) entry {
+		return entry{tar.Header{Name: name, Linkname: target,
+			Typeflag: tar.TypeLink}, ""}
+	}
+
+	// Expands a tarball built from the given entries, in order
+	expand := func(entries ...entry) (*DiskRepository, error) {
+		f, err := ioutil.TempFile("", "js-squish-archive")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		tw := tar.NewWriter(f)
+		for _, e := range entries {
+			hdr := e.hdr
+			hdr.Mode = 0644
+			hdr.Size = int64(len(e.src))
+			Expect(tw.WriteHeader(&hdr)).To(Succeed())
+			_, err := tw.Write([]byte(e.src))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+
+		return NewDiskJsTarRepository(f)
+	}
+
+	read := func(path string) string {
+		r, err := repo.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		return string(bs)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "js-squish-tmpdir")
+		Expect(err).ToNot(HaveOccurred())
+		os.Setenv("TMPDIR", tmp)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("TMPDIR")
+		if repo != nil {
+			repo.Close()
+			repo = nil
+		}
+		os.RemoveAll(tmp)
+	})
+
+	// Anything written outside of the repository's own directory would land in
+	// `tmp` next to it. A rejected archive should also clean up after itself.
+	expectNothingEscaped := func() {
+		leftovers, err := ioutil.ReadDir(tmp)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leftovers).To(BeEmpty())
+	}
+
+	Describe("malicious archives", func() {
+
+		It("should reject entries walking up and out", func() {
+			_, err := expand(file("ok.js", ""), file("../evil.js", "evil"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+
+			_, err = expand(file("lib/../../evil.js", "evil"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+		})
+
+		It("should reject absolute entries", func() {
+			_, err := expand(file(filepath.Join(tmp, "evil.js"), "evil"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+		})
+
+		It("should reject symlinks walking up and out", func() {
+			_, err := expand(symlink("lib", "../.."), file("lib/evil.js", "evil"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+		})
+
+		It("should reject absolute symlinks", func() {
+			_, err := expand(symlink("lib", tmp), file("lib/evil.js", "evil"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+		})
+
+		It("should reject hard links walking up and out", func() {
+			_, err := expand(hardlink("passwd", "../../../etc/passwd"))
+			Expect(err).To(HaveOccurred())
+			expectNothingEscaped()
+		})
+	})
+
+	Describe("links", func() {
+
+		BeforeEach(func() {
+			var err error
+			repo, err = expand(
+				file("pkg/lib/a.js", "a"),
+				symlink("pkg/current", "lib"),
+				symlink("pkg/main.js", "current/a.js"),
+				hardlink("pkg/copy.js", "pkg/lib/a.js"),
+				symlink("pkg/loop-a.js", "loop-b.js"),
+				symlink("pkg/loop-b.js", "loop-a.js"),
+				symlink("pkg/dangling.js", "missing.js"),
+			)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should resolve symlinks to files", func() {
+			Expect(read("pkg/main.js")).To(Equal("a"))
+		})
+
+		It("should resolve symlinks to directories", func() {
+			Expect(repo.IsFile("pkg/current/a.js")).To(BeTrue())
+			Expect(read("pkg/current/a.js")).To(Equal("a"))
+		})
+
+		It("should resolve hard links", func() {
+			Expect(read("pkg/copy.js")).To(Equal("a"))
+		})
+
+		It("should not resolve dangling or looping links", func() {
+			Expect(repo.IsFile("pkg/dangling.js")).To(BeFalse())
+			Expect(repo.IsFile("pkg/loop-a.js")).To(BeFalse())
+		})
+
+		It("should not create links on disk", func() {
+			fi, err := os.Lstat(filepath.Join(repo.root, "pkg", "main.js"))
+			Expect(os.IsNotExist(err)).To(BeTrue(), "%v", fi)
+		})
+	})
+
+	It("should not walk up and out when opening", func() {
+		var err error
+		repo, err = expand(file("a.js", "a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ioutil.WriteFile(filepath.Join(tmp, "secret.js"), nil, 0644)).
+			To(Succeed())
+		Expect(repo.IsFile("../secret.js")).To(BeFalse())
+		_, err = repo.Open("../secret.js")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should extract with sane permissions", func() {
+		var err error
+		repo, err = expand(file("deeply/nested/a.js", "a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		fi, err := os.Stat(filepath.Join(repo.root, "deeply", "nested"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Mode().Perm() & 0700).To(Equal(os.FileMode(0700)))
+
+		fi, err = os.Stat(filepath.Join(repo.root, "deeply", "nested", "a.js"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fi.Mode().Perm() & 0700).To(Equal(os.FileMode(0600)))
+	})
+})
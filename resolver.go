@@ -6,15 +6,84 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type resolveError struct {
 	require string
 	from    string
+
+	// Every step taken trying to resolve it, when it was traced
+	trace []ResolveStep
 }
 
 func (re *resolveError) Error() string {
-	return fmt.Sprintf("Could not resolve '%s' from '%s'", re.require, re.from)
+	msg := fmt.Sprintf("Could not resolve '%s' from '%s'", re.require, re.from)
+	for _, step := range re.trace {
+		msg += "\n  " + step.String()
+	}
+	return msg
+}
+
+// A step taken while resolving a require, as recorded by `Resolver.Trace`
+type ResolveStep struct {
+	Kind ResolveStepKind
+	Path string
+
+	// Whether the path was found. For a package.json, this is whether it could
+	// be read.
+	Found bool
+
+	// The `main` given by a package.json, or the path found in the cache
+	Value string
+}
+
+type ResolveStepKind int
+
+const (
+	// A require already resolved, found in the cache
+	StepCache ResolveStepKind = iota
+
+	// A check for a file
+	StepFile
+
+	// A package.json being read, for its `main`
+	StepPackage
+)
+
+func (rs ResolveStep) String() string {
+	switch {
+	case rs.Kind == StepCache:
+		return fmt.Sprintf("cached %s -> %s", rs.Path, rs.Value)
+	case rs.Kind == StepPackage && !rs.Found:
+		return fmt.Sprintf("read %s: unreadable", rs.Path)
+	case rs.Kind == StepPackage && rs.Value == "":
+		return fmt.Sprintf("read %s: no main", rs.Path)
+	case rs.Kind == StepPackage:
+		return fmt.Sprintf("read %s: main %q", rs.Path, rs.Value)
+	case rs.Found:
+		return fmt.Sprintf("file %s: found", rs.Path)
+	default:
+		return fmt.Sprintf("file %s: missing", rs.Path)
+	}
+}
+
+// The steps of a single resolution. A nil trace records nothing.
+type resolveTrace struct {
+	steps []ResolveStep
+}
+
+func (rt *resolveTrace) add(step ResolveStep) {
+	if rt != nil {
+		rt.steps = append(rt.steps, step)
+	}
+}
+
+func (rt *resolveTrace) result() []ResolveStep {
+	if rt == nil {
+		return nil
+	}
+	return rt.steps
 }
 
 // Module resolution algorithm used in node.js. The basic algorithm is defined
@@ -23,10 +92,19 @@ func (re *resolveError) Error() string {
 // which file is doing the requiring. The simplest example is relative imports.
 // Once an import has been made absolute, the queried `require` value will be
 // cached. The same resulting qualified value will be returned on the next
-// invocation with recomputing.
+// invocation with recomputing. It's safe to resolve from many goroutines at
+// once.
 type Resolver struct {
 	repo  Repository
+	mu    sync.RWMutex
 	cache map[string]string
+
+	// Trace every resolution, attaching the steps taken to any error
+	verbose bool
+
+	// Extensions tried after `.js` and `.json`, for sources which are compiled
+	// as they're read
+	extensions []string
 }
 
 // Creates a new `Resolver`. This instance will not share a cache with any
@@ -38,6 +116,15 @@ func NewResolver(repo Repository) *Resolver {
 	}
 }
 
+// Creates a `Resolver` which finds everything a build with the given options
+// can bundle, such as `.jsx` files, and traces resolutions if it's verbose
+func NewResolverWithOptions(repo Repository, opts Options) *Resolver {
+	resolver := NewResolver(repo)
+	resolver.verbose = opts.Verbose
+	resolver.extensions = sourceExtensions
+	return resolver
+}
+
 // Resolve the `require` request from the given file or directory. This largely
 // implements the node resolution algorithm, but excludes certain lookups such
 // as built-ins and `.node` files. From the site:
@@ -52,7 +139,26 @@ func NewResolver(repo Repository) *Resolver {
 //		3. LOAD_NODE_MODULES(X, dirname(Y))
 //		4. THROW "not found"
 func (r *Resolver) Resolve(require, from string) (string, error) {
-	if fq, ok := r.cache[require]; ok {
+	var trace *resolveTrace
+	if r.verbose {
+		trace = &resolveTrace{}
+	}
+	return r.resolve(require, from, trace)
+}
+
+// Resolves a require like `Resolve`, also giving every step taken, in order
+func (r *Resolver) Trace(require, from string) (string, []ResolveStep,
+	error) {
+
+	trace := &resolveTrace{}
+	fq, err := r.resolve(require, from, trace)
+	return fq, trace.steps, err
+}
+
+func (r *Resolver) resolve(require, from string,
+	trace *resolveTrace) (string, error) {
+
+	if fq, ok := r.cached(require, trace); ok {
 		return fq, nil
 	}
 
@@ -60,28 +166,52 @@ func (r *Resolver) Resolve(require, from string) (string, error) {
 		strings.HasPrefix(require, "../") {
 
 		absolute := filepath.Clean(path.Join(from, require))
-		if fq, ok := r.cache[absolute]; ok {
+		if fq, ok := r.cached(absolute, trace); ok {
 			return fq, nil
 		}
 
-		if fq, ok := r.resolveAsFile(absolute); ok {
-			r.cache[absolute] = fq
+		if fq, ok := r.resolveAsFile(absolute, trace); ok {
+			r.remember(absolute, fq)
 			return fq, nil
 		}
 
-		if fq, ok := r.resolveAsDirectory(absolute); ok {
-			r.cache[absolute] = fq
+		if fq, ok := r.resolveAsDirectory(absolute, trace); ok {
+			r.remember(absolute, fq)
 			return fq, nil
 		}
-		return "", &resolveError{require, from}
+		return "", &resolveError{require, from, trace.result()}
 	}
 
-	if fq, ok := r.resolveAsModule(require, path.Dir(from)); ok {
-		r.cache[require] = fq
+	if fq, ok := r.resolveAsModule(require, path.Dir(from), trace); ok {
+		r.remember(require, fq)
 		return fq, nil
 	}
 
-	return "", &resolveError{require, from}
+	return "", &resolveError{require, from, trace.result()}
+}
+
+func (r *Resolver) cached(require string, trace *resolveTrace) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fq, ok := r.cache[require]
+	if ok {
+		trace.add(ResolveStep{Kind: StepCache, Path: require, Found: true,
+			Value: fq})
+	}
+	return fq, ok
+}
+
+// Checks for a file, recording the check
+func (r *Resolver) isFile(path string, trace *resolveTrace) bool {
+	found := r.repo.IsFile(path)
+	trace.add(ResolveStep{Kind: StepFile, Path: path, Found: found})
+	return found
+}
+
+func (r *Resolver) remember(require, fq string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[require] = fq
 }
 
 // Loads the qualified require value assuming its a file. JSON files will be
@@ -94,21 +224,30 @@ func (r *Resolver) Resolve(require, from string) (string, error) {
 //		2. If X.js is a file, load X.js as JavaScript text. STOP
 //		2. If X.json is a file, load X.json to a JavaScript Object. STOP
 //		4. If X.node is a file, load X.node as a binary addon. STOP
-func (r *Resolver) resolveAsFile(require string) (string, bool) {
-	if r.repo.IsFile(require) {
+func (r *Resolver) resolveAsFile(require string,
+	trace *resolveTrace) (string, bool) {
+
+	if r.isFile(require, trace) {
 		return require, true
 	}
 
 	check := require + ".js"
-	if r.repo.IsFile(check) {
+	if r.isFile(check, trace) {
 		return check, true
 	}
 
 	check = require + ".json"
-	if r.repo.IsFile(check) {
+	if r.isFile(check, trace) {
 		return check, true
 	}
 
+	for _, ext := range r.extensions {
+		check = require + ext
+		if r.isFile(check, trace) {
+			return check, true
+		}
+	}
+
 	return "", false
 }
 
@@ -125,11 +264,14 @@ func (r *Resolver) resolveAsFile(require string) (string, bool) {
 //		3. If X/index.json is a file, load X/index.json to a JavaScript object.
 //			 STOP
 //		4. If X/index.node is a file, load X/index.node as a binary addon. STOP
-func (r *Resolver) resolveAsDirectory(require string) (string, bool) {
+func (r *Resolver) resolveAsDirectory(require string,
+	trace *resolveTrace) (string, bool) {
+
 	pkgPath := path.Join(require, "package.json")
-	if r.repo.IsFile(pkgPath) {
+	if r.isFile(pkgPath, trace) {
 		pkgBody, err := r.repo.Open(pkgPath)
 		if err != nil {
+			trace.add(ResolveStep{Kind: StepPackage, Path: pkgPath})
 			return "", false
 		}
 		defer pkgBody.Close()
@@ -138,25 +280,35 @@ func (r *Resolver) resolveAsDirectory(require string) (string, bool) {
 			Main string `json:"main"`
 		}{}
 		if err := json.NewDecoder(pkgBody).Decode(&main); err != nil {
+			trace.add(ResolveStep{Kind: StepPackage, Path: pkgPath})
 			return "", false
 		}
+		trace.add(ResolveStep{Kind: StepPackage, Path: pkgPath, Found: true,
+			Value: main.Main})
 
 		mainPath := path.Join(require, main.Main)
-		if fq, ok := r.resolveAsFile(mainPath); ok {
+		if fq, ok := r.resolveAsFile(mainPath, trace); ok {
 			return fq, ok
 		}
 	}
 
 	check := path.Join(require, "index.js")
-	if r.repo.IsFile(check) {
+	if r.isFile(check, trace) {
 		return check, true
 	}
 
 	check = path.Join(require, "index.json")
-	if r.repo.IsFile(check) {
+	if r.isFile(check, trace) {
 		return check, true
 	}
 
+	for _, ext := range r.extensions {
+		check = path.Join(require, "index"+ext)
+		if r.isFile(check, trace) {
+			return check, true
+		}
+	}
+
 	return "", false
 }
 
@@ -174,17 +326,19 @@ func (r *Resolver) resolveAsDirectory(require string) (string, bool) {
 //			b. LOAD_AS_DIRECTORY(DIR/X)
 //
 // The NODE_MODULES_PATHS implementation has been omitted.
-func (r *Resolver) resolveAsModule(require, start string) (string, bool) {
+func (r *Resolver) resolveAsModule(require, start string,
+	trace *resolveTrace) (string, bool) {
+
 	dirs := []string{"."}
 
 	for _, dir := range dirs {
 		absolute := path.Join(dir, require)
 
-		if fq, ok := r.resolveAsFile(absolute); ok {
+		if fq, ok := r.resolveAsFile(absolute, trace); ok {
 			return fq, ok
 		}
 
-		if fq, ok := r.resolveAsDirectory(absolute); ok {
+		if fq, ok := r.resolveAsDirectory(absolute, trace); ok {
 			return fq, ok
 		}
 	}
@@ -110,4 +110,45 @@ var _ = Describe("Resolver", func() {
 		Expect(repo.checked).To(HaveLen(5))
 		Expect(repo.opened).To(HaveLen(0))
 	})
+
+	It("should trace each step taken", func() {
+		fq, steps, err := resolver.Trace("project-four", ".")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fq).To(Equal("project-four/four-main.js"))
+
+		var lines []string
+		for _, step := range steps {
+			lines = append(lines, step.String())
+		}
+		Expect(lines).To(Equal([]string{
+			"file project-four: missing",
+			"file project-four.js: missing",
+			"file project-four.json: missing",
+			"file project-four/package.json: found",
+			`read project-four/package.json: main "./four-main.js"`,
+			"file project-four/four-main.js: found",
+		}))
+
+		_, steps, _ = resolver.Trace("./four-main", "project-four")
+		Expect(steps).To(HaveLen(2))
+		_, steps, _ = resolver.Trace("project-four", "project-one")
+		Expect(steps).To(Equal([]ResolveStep{{StepCache, "project-four", true,
+			"project-four/four-main.js"}}))
+	})
+
+	It("should only say what was tried when verbose", func() {
+		_, err := resolver.Resolve("./missing", "project-one")
+		Expect(err).To(MatchError("Could not resolve './missing' from 'project-one'"))
+
+		resolver.verbose = true
+		_, err = resolver.Resolve("./missing", "project-one")
+		Expect(err).To(MatchError(
+			"Could not resolve './missing' from 'project-one'\n" +
+				"  file project-one/missing: missing\n" +
+				"  file project-one/missing.js: missing\n" +
+				"  file project-one/missing.json: missing\n" +
+				"  file project-one/missing/package.json: missing\n" +
+				"  file project-one/missing/index.js: missing\n" +
+				"  file project-one/missing/index.json: missing"))
+	})
 })
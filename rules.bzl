@@ -7,35 +7,163 @@ def _js_squish_impl(ctx):
     '-entrypoint',  bin_target.main.short_path,
   ]
 
+  js_tars = [bin_target.js_tar]
+  for overlay in ctx.attr.overlays:
+    arguments += ['-jstar', overlay.js_tar.path]
+    js_tars.append(overlay.js_tar)
+
   if ctx.attr.env:
     arguments += ['-environment', ctx.attr.env]
 
+  if ctx.attr.minify:
+    arguments += ['-minify']
+
+  if ctx.attr.tree_shake:
+    arguments += ['-tree-shake']
+
+  if ctx.attr.scope_hoist:
+    arguments += ['-scope-hoist']
+
+  if ctx.attr.jsx_factory:
+    arguments += ['-jsx-factory', ctx.attr.jsx_factory]
+
+  if ctx.attr.jsx_fragment:
+    arguments += ['-jsx-fragment', ctx.attr.jsx_fragment]
+
+  if ctx.attr.jsx_runtime:
+    arguments += ['-jsx-runtime', ctx.attr.jsx_runtime]
+
+  if ctx.attr.jsx_import_source:
+    arguments += ['-jsx-import-source', ctx.attr.jsx_import_source]
+
+  if ctx.attr.jsx_pragma:
+    arguments += ['-jsx-pragma']
+
+  if ctx.attr.dedupe:
+    arguments += ['-dedupe']
+
+  for ext, loader in sorted(ctx.attr.loaders.items()):
+    arguments += ['-loader', ext + '=' + loader]
+
+  if ctx.attr.inline_limit:
+    arguments += ['-inline-limit', ctx.attr.inline_limit]
+
+  if ctx.attr.max_size:
+    arguments += ['-max-size', ctx.attr.max_size]
+
+  if ctx.attr.max_gzipped_size:
+    arguments += ['-max-gzipped-size', ctx.attr.max_gzipped_size]
+
+  for package, size in sorted(ctx.attr.max_package_sizes.items()):
+    arguments += ['-max-package-size', package + '=' + size]
+
+  outputs = [ctx.outputs.out]
+  if ctx.attr.sourcemap:
+    arguments += ['-sourcemap', ctx.outputs.sourcemap.path]
+    outputs.append(ctx.outputs.sourcemap)
+
+  if ctx.attr.extract_css:
+    arguments += [
+      '-css',     ctx.outputs.css.path,
+      '-css-dir', ctx.label.package,
+    ]
+    outputs.append(ctx.outputs.css)
+    if ctx.attr.sourcemap:
+      arguments += ['-css-sourcemap', ctx.outputs.css_sourcemap.path]
+      outputs.append(ctx.outputs.css_sourcemap)
+
+  # Arguments go in a file, so that the action can run on a persistent worker,
+  # which gets them with each request instead
+  argfile = ctx.new_file(ctx.label.name + '.args')
+  ctx.file_action(output=argfile, content='\n'.join(arguments))
+
   ctx.action(
-    inputs     = [ctx.executable._js_squish, bin_target.js_tar],
-    outputs    = [ctx.outputs.out],
+    inputs     = [ctx.executable._js_squish, argfile] + js_tars,
+    outputs    = outputs,
     executable = ctx.executable._js_squish,
-    arguments  = arguments,
+    arguments  = ['@' + argfile.path],
     mnemonic   = 'JsSquish',
+    execution_requirements = {'supports-workers': '1'},
   )
 
   return struct(
-    files    = set([ctx.outputs.out]),
-    runfiles = ctx.runfiles(files = [ctx.outputs.out]),
+    files    = set(outputs),
+    runfiles = ctx.runfiles(files = outputs),
   )
 
 
+def _js_squish_outputs(sourcemap, extract_css):
+  outputs = {
+    'out': '%{name}.js',
+  }
+  if sourcemap:
+    outputs['sourcemap'] = '%{name}.js.map'
+  if extract_css:
+    outputs['css'] = '%{name}.css'
+    if sourcemap:
+      outputs['css_sourcemap'] = '%{name}.css.map'
+  return outputs
+
+
 js_squish = rule(
   _js_squish_impl,
   attrs = {
     'env':   attr.string(values=['', 'development', 'production']),
     'src':   attr.label(providers=['js_tar', 'main']),
 
+    # Additional `js_tar`s layered on top of the one from `src`, in order. Files
+    # in later overlays shadow those at the same path in earlier ones.
+    'overlays': attr.label_list(providers=['js_tar']),
+
+    # Strip comments and whitespace, and shorten local names
+    'minify':    attr.bool(default=False),
+
+    # Remove exports which nothing uses, and modules nothing needs
+    'tree_shake': attr.bool(default=False),
+
+    # Inline modules into the module requiring them where it's safe to
+    'scope_hoist': attr.bool(default=False),
+
+    # Write modules with identical contents only once
+    'dedupe': attr.bool(default=False),
+
+    # How JSX is compiled, by calling a factory such as 'h', or with React's
+    # automatic runtime, required from `jsx_import_source`
+    'jsx_factory':       attr.string(),
+    'jsx_fragment':      attr.string(),
+    'jsx_runtime':       attr.string(values=['', 'classic', 'automatic']),
+    'jsx_import_source': attr.string(),
+
+    # Also compile JSX in `.js` files with an `@jsx` comment
+    'jsx_pragma': attr.bool(default=False),
+
+    # The loader of files of each extension, as {'.svg': 'text'}, over the
+    # defaults. Loaders are 'js', 'json', 'text', 'css' and 'dataurl'.
+    'loaders': attr.string_dict(),
+
+    # The largest file the 'dataurl' loader inlines, as '32KB'
+    'inline_limit': attr.string(),
+
+    # Also write `%{name}.js.map`, referenced from the end of `%{name}.js`, and
+    # `%{name}.css.map` with `extract_css`
+    'sourcemap': attr.bool(default=False),
+
+    # Write the CSS of stylesheets required to `%{name}.css`, in the order
+    # they're required, instead of adding it to the page from `%{name}.js`
+    'extract_css': attr.bool(default=False),
+
+    # Fail the build if the bundle is bigger than this, raw or gzipped. Sizes
+    # are in bytes, or have a `KB` or `MB` suffix, as in '300KB'.
+    'max_size':         attr.string(),
+    'max_gzipped_size': attr.string(),
+
+    # Fail the build if a package is bigger than its size here, by name
+    'max_package_sizes': attr.string_dict(),
+
     '_js_squish': attr.label(
       default     = Label('//tool/js-squish'),
       cfg         = 'host',
       executable  = True),
   },
-  outputs = {
-    'out':  '%{name}.js'
-  },
+  outputs = _js_squish_outputs,
 )
@@ -0,0 +1,410 @@
+package jssquish
+
+import (
+	"sort"
+
+	"github.com/robertkrimen/otto/ast"
+	"github.com/robertkrimen/otto/file"
+)
+
+// A lexical scope of a parsed program. Being ES5, only functions and catch
+// clauses introduce scopes.
+type scope struct {
+	parent   *scope
+	children []*scope
+	bindings map[string]*binding
+
+	// Function scopes hold `var` declarations. Catch scopes hold nothing but
+	// their parameter.
+	function bool
+
+	// A direct `eval` or a `with` statement can see names at runtime that we
+	// can't see now, so nothing may be renamed in a dynamic scope or any scope
+	// enclosing it.
+	dynamic bool
+	frozen  bool
+
+	// References made from within this scope, or any scope inside of it, which
+	// resolve to a binding outside of it (or to no binding at all).
+	outerRefs []*reference
+}
+
+// A declared name, and everywhere it appears in the source
+type binding struct {
+	name  string
+	scope *scope
+	sites []int
+
+	// Set when a binding must keep its name, regardless of its scope
+	pinned bool
+
+	// The name this binding is given. It's the original name unless it has been
+	// renamed.
+	newName string
+}
+
+type reference struct {
+	name    string
+	offset  int
+	scope   *scope
+	binding *binding
+}
+
+func newScope(parent *scope, function bool) *scope {
+	sc := &scope{
+		parent:   parent,
+		bindings: make(map[string]*binding),
+		function: function,
+	}
+	if parent != nil {
+		parent.children = append(parent.children, sc)
+	}
+	return sc
+}
+
+// The closest function scope, which is where `var` declarations land
+func (sc *scope) functionScope() *scope {
+	for !sc.function {
+		sc = sc.parent
+	}
+	return sc
+}
+
+// Declares a name in this scope, returning the existing binding if the name
+// has already been declared.
+func (sc *scope) declare(name string) *binding {
+	if b, ok := sc.bindings[name]; ok {
+		return b
+	}
+	b := &binding{name: name, scope: sc, newName: name}
+	sc.bindings[name] = b
+	return b
+}
+
+// Finds the binding a name refers to from this scope. A nil binding means the
+// name is either global, or is the implicit `arguments` of a function.
+func (sc *scope) resolve(name string) *binding {
+	for s := sc; s != nil; s = s.parent {
+		if b, ok := s.bindings[name]; ok {
+			return b
+		}
+		if name == "arguments" && s.function && s.parent != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// The result of analyzing every scope of a program
+type scopeTree struct {
+	root *scope
+	refs []*reference
+
+	// `var` declarations, paired with the binding the declared identifier
+	// refers to. These differ for a `var` in a catch block shadowing the catch
+	// parameter.
+	vars []varDeclaration
+}
+
+type varDeclaration struct {
+	declared *binding
+	ref      *reference
+}
+
+// Builds the scope tree of a program. The program is treated as the body of a
+// function taking the given parameters, which is exactly how a module is
+// wrapped. A nil `params` instead treats the program as global code, whose
+// top-level names can't be touched.
+func analyzeScopes(program *ast.Program, params []string) (*scopeTree, error) {
+	tree := &scopeTree{
+		root: newScope(nil, true),
+	}
+	if params == nil {
+		tree.root.frozen = true
+	}
+	for _, param := range params {
+		tree.root.declare(param)
+	}
+
+	sv := &scopeVisitor{tree: tree, current: tree.root}
+	for _, stmt := range program.Body {
+		sv.walk(stmt)
+	}
+	if sv.err != nil {
+		return nil, sv.err
+	}
+	tree.resolve()
+	return tree, nil
+}
+
+// Binds every reference to its declaration, and works out which scopes are
+// stuck with their names.
+func (st *scopeTree) resolve() {
+	for _, ref := range st.refs {
+		ref.binding = ref.scope.resolve(ref.name)
+		if ref.binding != nil {
+			ref.binding.sites = append(ref.binding.sites, ref.offset)
+		}
+
+		// Let every scope between the reference and its binding know about it
+		for s := ref.scope; s != nil; s = s.parent {
+			if ref.binding != nil && s == ref.binding.scope {
+				break
+			}
+			s.outerRefs = append(s.outerRefs, ref)
+		}
+	}
+
+	for _, decl := range st.vars {
+		if decl.ref.binding != decl.declared {
+			decl.declared.pinned = true
+			if decl.ref.binding != nil {
+				decl.ref.binding.pinned = true
+			}
+		}
+	}
+
+	var freeze func(sc *scope)
+	freeze = func(sc *scope) {
+		for _, child := range sc.children {
+			freeze(child)
+		}
+		if sc.dynamic {
+			for s := sc; s != nil; s = s.parent {
+				s.frozen = true
+			}
+		}
+	}
+	freeze(st.root)
+}
+
+// Gives every binding which can safely be renamed the shortest name available
+// to it, returning the new names keyed by the offset of each identifier to
+// rename.
+func (st *scopeTree) mangle() map[int]string {
+	renames := make(map[int]string)
+	st.root.mangle(renames)
+	return renames
+}
+
+func (sc *scope) mangle(renames map[int]string) {
+	if !sc.frozen {
+		// Names which must stay visible in here: anything referred to from
+		// within which is declared outside, and anything declared within which
+		// keeps its name.
+		taken := make(map[string]bool)
+		for _, ref := range sc.outerRefs {
+			if ref.binding == nil {
+				taken[ref.name] = true
+			} else {
+				taken[ref.binding.newName] = true
+			}
+		}
+		sc.keptNames(taken)
+
+		var renamable []*binding
+		for _, b := range sc.bindings {
+			if !b.pinned {
+				renamable = append(renamable, b)
+			}
+		}
+
+		// The most used names get the shortest replacements
+		sort.Slice(renamable, func(i, j int) bool {
+			if len(renamable[i].sites) != len(renamable[j].sites) {
+				return len(renamable[i].sites) > len(renamable[j].sites)
+			}
+			return renamable[i].name < renamable[j].name
+		})
+
+		next := 0
+		for _, b := range renamable {
+			for {
+				b.newName = mangledName(next)
+				next++
+				if !taken[b.newName] && !reservedWords[b.newName] {
+					break
+				}
+			}
+			if b.newName != b.name {
+				for _, site := range b.sites {
+					renames[site] = b.newName
+				}
+			}
+		}
+	}
+
+	for _, child := range sc.children {
+		child.mangle(renames)
+	}
+}
+
+// Collects the names of bindings in this scope and those inside of it which
+// won't be renamed.
+func (sc *scope) keptNames(names map[string]bool) {
+	for name, b := range sc.bindings {
+		if b.pinned || sc.frozen {
+			names[name] = true
+		}
+	}
+	for _, child := range sc.children {
+		child.keptNames(names)
+	}
+}
+
+const (
+	mangleFirst = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ$_"
+	mangleRest  = mangleFirst + "0123456789"
+)
+
+// The `n`th shortest identifier
+func mangledName(n int) string {
+	name := []byte{mangleFirst[n%len(mangleFirst)]}
+	n /= len(mangleFirst)
+	for n > 0 {
+		n--
+		name = append(name, mangleRest[n%len(mangleRest)])
+		n /= len(mangleRest)
+	}
+	return string(name)
+}
+
+// Words which can't be used as identifiers, along with a few globals which are
+// best left unshadowed.
+var reservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true,
+	"continue": true, "debugger": true, "default": true, "delete": true,
+	"do": true, "else": true, "enum": true, "export": true, "extends": true,
+	"false": true, "finally": true, "for": true, "function": true, "if": true,
+	"implements": true, "import": true, "in": true, "instanceof": true,
+	"interface": true, "let": true, "new": true, "null": true, "package": true,
+	"private": true, "protected": true, "public": true, "return": true,
+	"static": true, "super": true, "switch": true, "this": true, "throw": true,
+	"true": true, "try": true, "typeof": true, "var": true, "void": true,
+	"while": true, "with": true, "yield": true, "await": true,
+	"arguments": true, "eval": true, "undefined": true, "NaN": true,
+	"Infinity": true,
+}
+
+// Walks a program, building up its scopes. This steers the walk around
+// identifiers which aren't references (property names, labels), and into new
+// scopes for functions and catch clauses.
+type scopeVisitor struct {
+	tree    *scopeTree
+	current *scope
+	err     error
+}
+
+// Walks a node, holding on to the first error seen, as `Visit` has no way of
+// reporting one.
+func (sv *scopeVisitor) walk(n ast.Node) error {
+	if err := WalkNode(sv, n); err != nil && sv.err == nil {
+		sv.err = err
+	}
+	return sv.err
+}
+
+// Walks a node from within the given scope
+func (sv *scopeVisitor) walkIn(sc *scope, n ast.Node) {
+	outer := sv.current
+	sv.current = sc
+	sv.walk(n)
+	sv.current = outer
+}
+
+func (sv *scopeVisitor) reference(name string, idx file.Idx) *reference {
+	ref := &reference{
+		name:   name,
+		offset: int(idx) - 1,
+		scope:  sv.current,
+	}
+	sv.tree.refs = append(sv.tree.refs, ref)
+	return ref
+}
+
+func (sv *scopeVisitor) Visit(n ast.Node) bool {
+	switch t := n.(type) {
+
+	case *ast.Identifier:
+		// Only identifiers in expression position make it here
+		sv.reference(t.Name, t.Idx)
+
+	case *ast.DotExpression:
+		sv.walk(t.Left)
+		return false
+
+	case *ast.LabelledStatement:
+		sv.walk(t.Statement)
+		return false
+
+	case *ast.BranchStatement:
+		return false
+
+	case *ast.FunctionStatement:
+		// Declarations are hoisted to the enclosing function
+		fn := t.Function
+		sv.current.functionScope().declare(fn.Name.Name)
+		sv.reference(fn.Name.Name, fn.Name.Idx)
+		sv.function(fn, false)
+		return false
+
+	case *ast.FunctionLiteral:
+		sv.function(t, true)
+		return false
+
+	case *ast.VariableExpression:
+		declared := sv.current.functionScope().declare(t.Name)
+		ref := sv.reference(t.Name, t.Idx)
+		sv.tree.vars = append(sv.tree.vars, varDeclaration{declared, ref})
+		if t.Initializer != nil {
+			sv.walk(t.Initializer)
+		}
+		return false
+
+	case *ast.CatchStatement:
+		sc := newScope(sv.current, false)
+		if t.Parameter != nil {
+			sc.declare(t.Parameter.Name)
+			outer := sv.current
+			sv.current = sc
+			sv.reference(t.Parameter.Name, t.Parameter.Idx)
+			sv.current = outer
+		}
+		sv.walkIn(sc, t.Body)
+		return false
+
+	case *ast.WithStatement:
+		sv.walk(t.Object)
+		sv.current.dynamic = true
+		sv.walk(t.Body)
+		return false
+
+	case *ast.CallExpression:
+		if callee, ok := t.Callee.(*ast.Identifier); ok && callee.Name == "eval" {
+			sv.current.dynamic = true
+		}
+	}
+	return true
+}
+
+// Opens a new scope for a function. The name of a function expression is only
+// visible inside of the function itself.
+func (sv *scopeVisitor) function(fn *ast.FunctionLiteral, expression bool) {
+	sc := newScope(sv.current, true)
+	outer := sv.current
+	sv.current = sc
+
+	if expression && fn.Name != nil {
+		sc.declare(fn.Name.Name)
+		sv.reference(fn.Name.Name, fn.Name.Idx)
+	}
+	if fn.ParameterList != nil {
+		for _, param := range fn.ParameterList.List {
+			sc.declare(param.Name)
+			sv.reference(param.Name, param.Idx)
+		}
+	}
+	sv.walk(fn.Body)
+
+	sv.current = outer
+}
@@ -0,0 +1,291 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	pth "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves a bundle over HTTP for local development, building it when it's asked
+// for. The bundle is built again only once a file it was built from changes,
+// and parsed modules are kept between builds, so only changed files are parsed
+// again. A failed build is served as a script which throws its error, so it
+// shows up in the browser's console rather than as a missing script.
+//
+// With hot module replacement enabled, the server also watches for changes
+// itself, and pushes the wrappers of every module whose wrapper changed to the
+// bundle's runtime over an event stream, served alongside the bundle with
+// `.hot` added. Modules are keyed by the ids `Writer` gives them.
+type DevServer struct {
+	repo       Repository
+	entrypoint string
+	opts       Options
+
+	// Where the bundle is served. Its source map is served alongside it, with
+	// `.map` added.
+	path string
+
+	mu        sync.Mutex
+	watcher   *FileWatcher
+	bundle    []byte
+	sourceMap []byte
+
+	// Hot module replacement state. `build` counts successful builds, and
+	// `modules` holds the wrapper of each module of the last, by id.
+	hot     bool
+	build   int
+	modules map[int][]byte
+	clients map[chan []byte]bool
+}
+
+func NewDevServer(repo Repository, entrypoint, path string,
+	opts Options) *DevServer {
+
+	opts.ParseCache = NewParseCache()
+	opts.SourceMap = nil
+	opts.SourceMapURL = pth.Base(path) + ".map"
+
+	return &DevServer{
+		repo:       repo,
+		entrypoint: entrypoint,
+		opts:       opts,
+		path:       path,
+		clients:    make(map[chan []byte]bool),
+	}
+}
+
+// Includes the hot module replacement runtime in the bundle, and serves its
+// event stream. Call `Poll` too, so changes are pushed as they're made rather
+// than the next time the bundle is asked for.
+func (ds *DevServer) EnableHot() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.hot = true
+	ds.watcher = nil
+}
+
+// Checks for changes every `interval`, building the bundle again as soon as
+// there are any. It never returns.
+func (ds *DevServer) Poll(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ds.mu.Lock()
+		if ds.watcher != nil && len(ds.watcher.Changed()) > 0 {
+			ds.rebuild()
+		}
+		ds.mu.Unlock()
+	}
+}
+
+func (ds *DevServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		body        []byte
+		contentType string
+	)
+	switch r.URL.Path {
+	case ds.path:
+		body, _ = ds.current()
+		contentType = "application/javascript; charset=utf-8"
+	case ds.path + ".map":
+		_, body = ds.current()
+		contentType = "application/json; charset=utf-8"
+	case ds.path + ".hot":
+		ds.serveUpdates(w, r)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+}
+
+// Gives the bundle and its source map, building them again first if anything
+// they were built from has changed
+func (ds *DevServer) current() ([]byte, []byte) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.watcher == nil || len(ds.watcher.Changed()) > 0 {
+		ds.rebuild()
+	}
+	return ds.bundle, ds.sourceMap
+}
+
+// Builds the bundle again, pushing whatever changed to any hot clients. The
+// lock must be held.
+func (ds *DevServer) rebuild() {
+	start := time.Now()
+	out, sourceMap := &bytes.Buffer{}, &bytes.Buffer{}
+	opts := ds.opts
+	opts.SourceMap = sourceMap
+	if ds.hot {
+		// The runtime gives the build it came from when it connects, so it can
+		// be told if it's missed any updates
+		opts.HotURL = fmt.Sprintf("%s.hot?build=%d", pth.Base(ds.path),
+			ds.build+1)
+	}
+
+	result, err := Build(ds.repo, ds.entrypoint, out, opts)
+	ds.opts.ParseCache.Prune(0)
+	ds.watcher = NewFileWatcher(ds.repo,
+		append(result.Files, pth.Clean(ds.entrypoint)))
+
+	if err != nil {
+		log.Printf("build failed after %s: %s", time.Since(start), err)
+		ds.bundle, ds.sourceMap = buildErrorScript(err), emptySourceMap
+		ds.broadcast(sseEvent("failed", "", []byte(err.Error())))
+		return
+	}
+	log.Printf("built %s in %s", ds.entrypoint, time.Since(start))
+	ds.bundle, ds.sourceMap = out.Bytes(), sourceMap.Bytes()
+	if !ds.hot {
+		return
+	}
+
+	ds.build++
+	modules := make(map[int][]byte, len(result.Modules))
+	for _, module := range result.Modules {
+		modules[module.Id] = ds.bundle[module.Start:module.End]
+	}
+	if ds.modules != nil {
+		if update := changedModules(ds.modules, modules); update != nil {
+			ds.broadcast(sseEvent("update", strconv.Itoa(ds.build), update))
+		}
+	}
+	ds.modules = modules
+}
+
+// Gives the wrappers which are new or different in `modules`, separated so
+// that they make up the properties of an object, or nil if none are
+func changedModules(old, modules map[int][]byte) []byte {
+	var ids []int
+	for id, wrapper := range modules {
+		if !bytes.Equal(old[id], wrapper) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Ints(ids)
+
+	update := &bytes.Buffer{}
+	for i, id := range ids {
+		if i > 0 {
+			update.WriteString(",\n")
+		}
+		update.Write(modules[id])
+	}
+	return update.Bytes()
+}
+
+// How many events a client can fall behind by before it's disconnected. When
+// it reconnects, it's told to reload.
+const hotClientBuffer = 16
+
+// Sends an event to every hot client. The lock must be held.
+func (ds *DevServer) broadcast(event []byte) {
+	for client := range ds.clients {
+		select {
+		case client <- event:
+		default:
+			close(client)
+			delete(ds.clients, client)
+		}
+	}
+}
+
+// Streams updates to a hot module replacement runtime
+func (ds *DevServer) serveUpdates(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The build the client last saw is the last event it was sent, if it's
+	// reconnecting, or else the build its bundle came from
+	seen := r.Header.Get("Last-Event-ID")
+	if seen == "" {
+		seen = r.URL.Query().Get("build")
+	}
+
+	events := make(chan []byte, hotClientBuffer)
+	ds.mu.Lock()
+	if !ds.hot {
+		ds.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	ds.clients[events] = true
+	missed := seen != strconv.Itoa(ds.build)
+	ds.mu.Unlock()
+	defer func() {
+		ds.mu.Lock()
+		delete(ds.clients, events)
+		ds.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if missed {
+		w.Write(sseEvent("reload", "", nil))
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Each of the line breaks an event stream allows
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// Formats a server-sent event. Each line of its data is sent on a line of its
+// own, and put back together with newlines by the client.
+func sseEvent(name, id string, data []byte) []byte {
+	event := &bytes.Buffer{}
+	fmt.Fprintf(event, "event: %s\n", name)
+	if id != "" {
+		fmt.Fprintf(event, "id: %s\n", id)
+	}
+	for _, line := range strings.Split(lineBreaks.Replace(string(data)), "\n") {
+		fmt.Fprintf(event, "data: %s\n", line)
+	}
+	event.WriteString("\n")
+	return event.Bytes()
+}
+
+// What's served as the source map of a failed build
+var emptySourceMap = []byte(`{"version":3,"sources":[],"names":[],"mappings":""}`)
+
+// A script which throws a build's error when it's run
+func buildErrorScript(err error) []byte {
+	// JSON escapes everything a JavaScript string literal needs it to,
+	// including the line separators JSON otherwise allows
+	message, _ := json.Marshal("js-squish: " + err.Error())
+	return []byte(fmt.Sprintf("throw new Error(%s);\n", message))
+}
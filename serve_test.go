@@ -0,0 +1,300 @@
+package jssquish
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Development server", func() {
+
+	var (
+		root   string
+		server *DevServer
+	)
+
+	write := func(path, contents string) {
+		path = filepath.Join(root, path)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+
+		// Make sure the change is seen, however coarse file times are
+		later := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(path, later, later)).To(Succeed())
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	run := func(bundle string) (interface{}, error) {
+		vm := otto.New()
+		if _, err := vm.Run(bundle); err != nil {
+			return nil, err
+		}
+		result, err := vm.Get("result")
+		Expect(err).ToNot(HaveOccurred())
+		return result.Export()
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "js-squish-serve")
+		Expect(err).ToNot(HaveOccurred())
+		write("index.js", "result = require('./lib')")
+		write("lib.js", "module.exports = 'first'")
+
+		repo, err := NewDirRepository(root, false)
+		Expect(err).ToNot(HaveOccurred())
+		server = NewDevServer(repo, "index.js", "/js/app.js", Options{})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("should serve the bundle, pointing to its source map", func() {
+		resp := get("/js/app.js")
+		Expect(resp.Code).To(Equal(200))
+		Expect(resp.Header().Get("Content-Type")).To(
+			HavePrefix("application/javascript"))
+		Expect(resp.Body.String()).To(
+			HaveSuffix("//# sourceMappingURL=app.js.map\n"))
+		Expect(run(resp.Body.String())).To(Equal("first"))
+
+		resp = get("/js/app.js.map")
+		Expect(resp.Code).To(Equal(200))
+		var sourceMap struct{ Sources []string }
+		Expect(json.Unmarshal(resp.Body.Bytes(), &sourceMap)).To(Succeed())
+		Expect(sourceMap.Sources).To(ConsistOf("index.js", "lib.js"))
+	})
+
+	It("should only serve the bundle", func() {
+		Expect(get("/index.js").Code).To(Equal(404))
+	})
+
+	It("should build again once a file changes", func() {
+		first := get("/js/app.js").Body.String()
+		Expect(get("/js/app.js").Body.String()).To(Equal(first))
+
+		write("lib.js", "module.exports = 'second'")
+		Expect(run(get("/js/app.js").Body.String())).To(Equal("second"))
+	})
+
+	It("should serve a failed build as a script throwing its error", func() {
+		write("lib.js", "module.exports = require('./missing')")
+		resp := get("/js/app.js")
+		Expect(resp.Code).To(Equal(200))
+		_, err := run(resp.Body.String())
+		Expect(err).To(MatchError(ContainSubstring(
+			"js-squish: Could not resolve './missing'")))
+
+		write("missing.js", "module.exports = 'found'")
+		write("lib.js", "module.exports = require('./missing')")
+		Expect(run(get("/js/app.js").Body.String())).To(Equal("found"))
+	})
+})
+
+var _ = Describe("Hot module replacement", func() {
+
+	var (
+		root   string
+		server *DevServer
+	)
+
+	write := func(path, contents string) {
+		path = filepath.Join(root, path)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		later := time.Now().Add(time.Hour)
+		Expect(os.Chtimes(path, later, later)).To(Succeed())
+	}
+
+	bundle := func() string {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/app.js", nil))
+		return w.Body.String()
+	}
+
+	// Changes a file and builds again, giving the data of the update event the
+	// runtime would have been sent
+	change := func(path, contents string) string {
+		events := make(chan []byte, 1)
+		server.mu.Lock()
+		server.clients[events] = true
+		server.mu.Unlock()
+
+		write(path, contents)
+		bundle()
+
+		var data []string
+		for _, line := range strings.Split(string(<-events), "\n") {
+			if strings.HasPrefix(line, "data: ") {
+				data = append(data, line[len("data: "):])
+			}
+		}
+		return strings.Join(data, "\n")
+	}
+
+	// Runs a bundle with a stand-in for the browser's `EventSource`, giving a
+	// function which sends the runtime an update
+	run := func(vm *otto.Otto, bundle string) func(string) {
+		_, err := vm.Run(`
+			var sources = [], reloaded = false;
+			var location = {reload: function() { reloaded = true }};
+			console.log = console.warn = function() {};
+			function EventSource(url) {
+				this.url = url;
+				this.listeners = {};
+				sources.push(this);
+			}
+			EventSource.prototype.addEventListener = function(name, listener) {
+				this.listeners[name] = listener;
+			};`)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+
+		return func(data string) {
+			listener, err := vm.Run("sources[0].listeners.update")
+			Expect(err).ToNot(HaveOccurred())
+			event, err := vm.Object("({})")
+			Expect(err).ToNot(HaveOccurred())
+			event.Set("data", data)
+			_, err = listener.Call(otto.UndefinedValue(), event)
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	get := func(vm *otto.Otto, expr string) interface{} {
+		value, err := vm.Run(expr)
+		Expect(err).ToNot(HaveOccurred())
+		exported, err := value.Export()
+		Expect(err).ToNot(HaveOccurred())
+		return exported
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "js-squish-hot")
+		Expect(err).ToNot(HaveOccurred())
+		write("lib.js", "module.exports = 'first'")
+
+		repo, err := NewDirRepository(root, false)
+		Expect(err).ToNot(HaveOccurred())
+		server = NewDevServer(repo, "index.js", "/app.js", Options{})
+		server.EnableHot()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("should connect to the event stream next to the bundle", func() {
+		write("index.js", "")
+		vm := otto.New()
+		run(vm, bundle())
+		Expect(get(vm, "sources[0].url")).To(Equal("app.js.hot?build=1"))
+	})
+
+	It("should run a dependency again for a module accepting it", func() {
+		write("index.js", `
+			result = [require('./lib')];
+			module.hot.accept('./lib', function () { result.push(require('./lib')) });`)
+		vm := otto.New()
+		update := run(vm, bundle())
+
+		data := change("lib.js", "module.exports = 'second'")
+		Expect(data).To(MatchRegexp(`^1: \[function`))
+		update(data)
+		Expect(get(vm, "result")).To(Equal([]string{"first", "second"}))
+		Expect(get(vm, "reloaded")).To(BeFalse())
+	})
+
+	It("should run a module accepting itself again, passing on its data", func() {
+		write("index.js", "result = []; require('./view')")
+		write("view.js", `
+			var runs = module.hot.data ? module.hot.data.runs + 1 : 1;
+			result.push(runs + ' ' + require('./lib'));
+			module.hot.dispose(function (data) { data.runs = runs });
+			module.hot.accept();`)
+		vm := otto.New()
+		update := run(vm, bundle())
+
+		update(change("lib.js", "module.exports = 'second'"))
+		update(change("lib.js", "module.exports = 'third'"))
+		Expect(get(vm, "result")).To(Equal(
+			[]string{"1 first", "2 second", "3 third"}))
+		Expect(get(vm, "reloaded")).To(BeFalse())
+	})
+
+	It("should reload when nothing accepts an update", func() {
+		write("index.js", "result = require('./lib')")
+		vm := otto.New()
+		update := run(vm, bundle())
+
+		update(change("lib.js", "module.exports = 'second'"))
+		Expect(get(vm, "reloaded")).To(BeTrue())
+	})
+
+	It("should stream updates, telling clients which missed one to reload", func() {
+		write("index.js", "require('./lib')")
+		bundle()
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		var bodies []io.Closer
+		defer func() {
+			for _, body := range bodies {
+				body.Close()
+			}
+		}()
+
+		events := func(build string) *bufio.Reader {
+			resp, err := http.Get(ts.URL + "/app.js.hot?build=" + build)
+			Expect(err).ToNot(HaveOccurred())
+			bodies = append(bodies, resp.Body)
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+			return bufio.NewReader(resp.Body)
+		}
+		next := func(r *bufio.Reader) string {
+			var event []string
+			for {
+				line, err := r.ReadString('\n')
+				Expect(err).ToNot(HaveOccurred())
+				if line == "\n" {
+					return strings.Join(event, "")
+				}
+				event = append(event, line)
+			}
+		}
+
+		Expect(next(events("0"))).To(Equal("event: reload\ndata: \n"))
+
+		current := events("1")
+		write("lib.js", "module.exports = 'second'")
+		bundle()
+		Expect(next(current)).To(HavePrefix("event: update\nid: 2\ndata: 1: [function"))
+
+		write("lib.js", "module.exports = require('./missing')")
+		bundle()
+		Expect(next(current)).To(HavePrefix("event: failed\n"))
+	})
+
+	It("should leave out the runtime unless asked for", func() {
+		Expect(squish(map[string]string{"index.js": ""}, Options{})).
+			ToNot(ContainSubstring("EventSource"))
+	})
+})
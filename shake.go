@@ -0,0 +1,879 @@
+package jssquish
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/robertkrimen/otto/ast"
+	jstoken "github.com/robertkrimen/otto/token"
+)
+
+// A range of a module's source. Removing a whole statement leaves a `;` behind
+// so that the statements either side of it don't run together.
+type span struct {
+	start, end int
+	statement  bool
+}
+
+func (s span) contains(offset int) bool {
+	return offset >= s.start && offset < s.end
+}
+
+// A use of one export of a required module
+type nameUse struct {
+	name   string
+	offset int
+}
+
+// A `require` call, and how its result is used. The module it returns is used
+// as a whole wherever it escapes somewhere we can't follow, and only for the
+// named exports otherwise. Each use is tied to an offset in the source, so
+// that uses in code which has been shaken out no longer count.
+type requireSite struct {
+	spec   string
+	offset int
+	uses   []nameUse
+	whole  []int
+
+	// The default import of an ES module. For a CommonJS module, that's the
+	// whole thing.
+	interop bool
+}
+
+// Everywhere an export of a module is defined
+type exportDef struct {
+	spans []span
+
+	// Whether the definitions could be dropped without anyone noticing
+	pure bool
+}
+
+// A top-level declaration which might become dead once exports are removed.
+// `spec` is set for a declaration whose only effect is requiring a module, as
+// in `var a = require('a')` or a bare `require('a')`.
+type topDecl struct {
+	binding *binding
+	span    span
+	pure    bool
+	spec    string
+}
+
+// What tree shaking knows of a module
+type moduleShake struct {
+	tree     *scopeTree
+	refs     map[int]*reference
+	requires []*requireSite
+	exports  map[string]*exportDef
+
+	// Exports the module uses itself, which have to stay regardless
+	internal map[string]bool
+
+	// Set when there's no telling which exports are which, such as for a
+	// module which assigns a function to `module.exports`
+	opaque bool
+
+	decls       []*topDecl
+	removed     []span
+	sideEffects bool
+}
+
+func (ms *moduleShake) isRemoved(offset int) bool {
+	for _, s := range ms.removed {
+		if s.contains(offset) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *moduleShake) remove(spans ...span) {
+	ms.removed = append(ms.removed, spans...)
+}
+
+// What's needed of a module by everything requiring it
+type exportUsage struct {
+	whole bool
+	names map[string]bool
+}
+
+// Removes unused exports from the modules of a `FileSet`, then any modules
+// left without a live `require`. This keeps going until there's nothing left
+// to remove, as removing one export can leave the exports of others unused.
+func (fs *FileSet) shake(root *srcEntry) error {
+	for _, entry := range fs.order {
+		ms, err := analyzeModule(entry)
+		if err != nil {
+			return err
+		}
+		ms.sideEffects = fs.hasSideEffects(entry.path)
+		entry.shake = ms
+	}
+
+	for {
+		live := reachable(root)
+		usage := make(map[*srcEntry]*exportUsage)
+		usage[root] = &exportUsage{whole: true}
+		for entry := range live {
+			entry.shake.addUsage(entry, usage)
+		}
+
+		changed := false
+		for entry := range live {
+			if entry.shake.shakeExports(usage[entry]) {
+				changed = true
+			}
+		}
+		for entry := range live {
+			if entry.shake.sweep(entry) {
+				changed = true
+			}
+		}
+
+		if !changed {
+			for _, entry := range fs.order {
+				entry.dropped = !live[entry]
+			}
+			return nil
+		}
+	}
+}
+
+// The modules which can still be required, starting from the entrypoint
+func reachable(root *srcEntry) map[*srcEntry]bool {
+	live := map[*srcEntry]bool{root: true}
+	queue := []*srcEntry{root}
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+		for _, site := range entry.shake.requires {
+			dep := entry.deps[site.spec]
+			if dep == nil || live[dep] || entry.shake.isRemoved(site.offset) {
+				continue
+			}
+			live[dep] = true
+			queue = append(queue, dep)
+		}
+	}
+	return live
+}
+
+// Adds what this module needs of each module it requires
+func (ms *moduleShake) addUsage(entry *srcEntry,
+	usage map[*srcEntry]*exportUsage) {
+
+	for _, site := range ms.requires {
+		dep := entry.deps[site.spec]
+		if dep == nil || ms.isRemoved(site.offset) {
+			continue
+		}
+		u, ok := usage[dep]
+		if !ok {
+			u = &exportUsage{names: make(map[string]bool)}
+			usage[dep] = u
+		}
+
+		for _, offset := range site.whole {
+			if !ms.isRemoved(offset) {
+				u.whole = true
+			}
+		}
+		for _, use := range site.uses {
+			if !ms.isRemoved(use.offset) {
+				u.names[use.name] = true
+			}
+		}
+		if site.interop {
+			if dep.esm {
+				u.names["default"] = true
+			} else {
+				u.whole = true
+			}
+		}
+	}
+}
+
+// Removes the definitions of unused exports, reporting whether there were any
+func (ms *moduleShake) shakeExports(usage *exportUsage) bool {
+	if ms.opaque || usage == nil || usage.whole {
+		return false
+	}
+
+	changed := false
+	for name, def := range ms.exports {
+		if usage.names[name] || ms.internal[name] || !def.pure ||
+			ms.isRemoved(def.spans[0].start) {
+			continue
+		}
+		ms.remove(def.spans...)
+		changed = true
+	}
+	return changed
+}
+
+// Removes top-level declarations which are no longer referenced, reporting
+// whether there were any. Declarations which were never referenced are left
+// alone, unless they only pull in a module without side effects.
+func (ms *moduleShake) sweep(entry *srcEntry) bool {
+	if ms.tree.root.frozen {
+		return false
+	}
+
+	changed := false
+	for _, decl := range ms.decls {
+		if ms.isRemoved(decl.span.start) {
+			continue
+		}
+
+		if decl.spec != "" {
+			dep := entry.deps[decl.spec]
+			if dep == nil || dep.shake.sideEffects {
+				continue
+			}
+		} else if !decl.pure || decl.binding == nil {
+			continue
+		}
+
+		if decl.binding != nil {
+			live, shaken := false, false
+			for _, site := range decl.binding.sites {
+				switch {
+				case decl.span.contains(site):
+				case ms.isRemoved(site):
+					shaken = true
+				default:
+					live = true
+				}
+			}
+			if live || !shaken && decl.spec == "" {
+				continue
+			}
+		}
+
+		ms.remove(decl.span)
+		changed = true
+	}
+	return changed
+}
+
+// Whether a module may have side effects, going by the `sideEffects` field of
+// the closest `package.json`. It's either `false`, or a list of patterns
+// matching the only files which do.
+func (fs *FileSet) hasSideEffects(modulePath string) bool {
+	for dir := path.Dir(modulePath); ; dir = path.Dir(dir) {
+		pkgPath := path.Join(dir, "package.json")
+		if fs.repo.IsFile(pkgPath) {
+			patterns, ok := fs.sideEffectPatterns(pkgPath)
+			if !ok {
+				return true
+			}
+			rel := strings.TrimPrefix(modulePath, dir+"/")
+			for _, pattern := range patterns {
+				if matchSideEffects(pattern, rel) {
+					return true
+				}
+			}
+			return false
+		}
+		if dir == "." || dir == "/" {
+			return true
+		}
+	}
+}
+
+// The `sideEffects` patterns of a package, which are empty for
+// `"sideEffects": false`. Anything else means there may be side effects
+// anywhere.
+func (fs *FileSet) sideEffectPatterns(pkgPath string) ([]string, bool) {
+	if patterns, ok := fs.sideEffects[pkgPath]; ok {
+		return patterns, patterns != nil
+	}
+
+	var patterns []string
+	if r, err := fs.repo.Open(pkgPath); err == nil {
+		pkg := struct {
+			SideEffects json.RawMessage `json:"sideEffects"`
+		}{}
+		if json.NewDecoder(r).Decode(&pkg) == nil {
+			var flag bool
+			if json.Unmarshal(pkg.SideEffects, &flag) == nil && !flag {
+				patterns = []string{}
+			} else if json.Unmarshal(pkg.SideEffects, &patterns) != nil {
+				patterns = nil
+			}
+		}
+		r.Close()
+	}
+
+	fs.sideEffects[pkgPath] = patterns
+	return patterns, patterns != nil
+}
+
+// Matches a `sideEffects` pattern against a path within its package. As with
+// webpack, a pattern without a slash matches against the file name alone.
+func matchSideEffects(pattern, rel string) bool {
+	pattern = strings.TrimPrefix(pattern, "./")
+	if !strings.Contains(pattern, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(pattern, rel)
+	return ok
+}
+
+// Works out the requires, exports, and top-level declarations of a module
+func analyzeModule(entry *srcEntry) (*moduleShake, error) {
+	tree, err := analyzeScopes(entry.program, wrapperParams)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &moduleShake{
+		tree:     tree,
+		refs:     make(map[int]*reference, len(tree.refs)),
+		exports:  make(map[string]*exportDef),
+		internal: make(map[string]bool),
+		opaque:   tree.root.frozen,
+	}
+	for _, ref := range tree.refs {
+		ms.refs[ref.offset] = ref
+	}
+
+	sv := &shakeVisitor{
+		ms:                  ms,
+		claimed:             make(map[int]bool),
+		memberOf:            make(map[int]string),
+		moduleExportsMember: make(map[int]string),
+	}
+	for _, stmt := range entry.program.Body {
+		if err := WalkNode(sv, stmt); err != nil {
+			return nil, err
+		}
+	}
+	sv.bindRequires()
+
+	// Any dependency we can't find the `require` for is assumed to be used in
+	// full, from somewhere that never goes away.
+	found := make(map[string]bool)
+	for _, site := range ms.requires {
+		found[site.spec] = true
+	}
+	for spec := range entry.deps {
+		if !found[spec] {
+			ms.requires = append(ms.requires,
+				&requireSite{spec: spec, offset: -1, whole: []int{-1}})
+		}
+	}
+
+	ms.topLevel(entry, sv)
+	if entry.esm {
+		for _, exp := range entry.exports {
+			def := ms.export(exp.name)
+			def.spans = append(def.spans, span{exp.start, exp.end, false})
+		}
+	} else {
+		ms.commonJSExports(sv)
+	}
+	if sv.thisAtTop {
+		ms.opaque = true
+	}
+	return ms, nil
+}
+
+func (ms *moduleShake) export(name string) *exportDef {
+	def, ok := ms.exports[name]
+	if !ok {
+		def = &exportDef{pure: true}
+		ms.exports[name] = def
+	}
+	return def
+}
+
+// The binding an identifier refers to, if it's local
+func (ms *moduleShake) bindingOf(id *ast.Identifier) *binding {
+	if ref, ok := ms.refs[int(id.Idx)-1]; ok {
+		return ref.binding
+	}
+	return nil
+}
+
+// Whether an expression is a call to the module's own `require` with a
+// string, returning the specifier and the offset of the call.
+func (ms *moduleShake) requireCall(expr ast.Expression) (string, int, bool) {
+	ce, ok := expr.(*ast.CallExpression)
+	if !ok || len(ce.ArgumentList) != 1 {
+		return "", 0, false
+	}
+	callee, ok := ce.Callee.(*ast.Identifier)
+	if !ok || callee.Name != "require" ||
+		ms.bindingOf(callee) != ms.tree.root.bindings["require"] {
+		return "", 0, false
+	}
+	str, ok := ce.ArgumentList[0].(*ast.StringLiteral)
+	if !ok {
+		return "", 0, false
+	}
+	return str.Value, int(callee.Idx) - 1, true
+}
+
+// Like `requireCall`, but also taking in a single export of the required
+// module, as lowered imports do.
+func (ms *moduleShake) requireExpression(expr ast.Expression) (string, bool) {
+	switch t := expr.(type) {
+	case *ast.DotExpression:
+		expr = t.Left
+	case *ast.BracketExpression:
+		if _, ok := t.Member.(*ast.StringLiteral); ok {
+			expr = t.Left
+		}
+	case *ast.CallExpression:
+		if callee, ok := t.Callee.(*ast.Identifier); ok &&
+			callee.Name == esmInterop && len(t.ArgumentList) == 1 {
+			expr = t.ArgumentList[0]
+		}
+	}
+	spec, _, ok := ms.requireCall(expr)
+	return spec, ok
+}
+
+// Whether evaluating an expression can have any effect, beyond its value.
+// Only the simplest of expressions qualify, and reading a global doesn't, as
+// it may not exist.
+func (ms *moduleShake) isPure(expr ast.Expression) bool {
+	switch t := expr.(type) {
+	case nil:
+		return true
+	case *ast.BooleanLiteral, *ast.NullLiteral, *ast.NumberLiteral,
+		*ast.StringLiteral, *ast.RegExpLiteral, *ast.FunctionLiteral:
+		return true
+	case *ast.Identifier:
+		switch t.Name {
+		case "undefined", "NaN", "Infinity":
+			return true
+		}
+		return ms.bindingOf(t) != nil
+	case *ast.ArrayLiteral:
+		for _, value := range t.Value {
+			if value != nil && !ms.isPure(value) {
+				return false
+			}
+		}
+		return true
+	case *ast.ObjectLiteral:
+		for _, prop := range t.Value {
+			if !ms.isPure(prop.Value) {
+				return false
+			}
+		}
+		return true
+	case *ast.UnaryExpression:
+		switch t.Operator {
+		case jstoken.DELETE, jstoken.INCREMENT, jstoken.DECREMENT:
+			return false
+		case jstoken.TYPEOF:
+			if _, ok := t.Operand.(*ast.Identifier); ok {
+				return true
+			}
+		}
+		return ms.isPure(t.Operand)
+	case *ast.BinaryExpression:
+		if t.Operator == jstoken.IN || t.Operator == jstoken.INSTANCEOF {
+			return false
+		}
+		return ms.isPure(t.Left) && ms.isPure(t.Right)
+	case *ast.ConditionalExpression:
+		return ms.isPure(t.Test) && ms.isPure(t.Consequent) &&
+			ms.isPure(t.Alternate)
+	case *ast.SequenceExpression:
+		for _, expr := range t.Sequence {
+			if !ms.isPure(expr) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Records the top-level declarations of a module, along with any CommonJS
+// exports assigned at the top level.
+func (ms *moduleShake) topLevel(entry *srcEntry, sv *shakeVisitor) {
+	body := entry.program.Body
+	for i, stmt := range body {
+		s := span{int(stmt.Idx0()) - 1, len(entry.src), true}
+		if i+1 < len(body) {
+			s.end = int(body[i+1].Idx0()) - 1
+		}
+
+		switch t := stmt.(type) {
+		case *ast.FunctionStatement:
+			if t.Function.Name != nil {
+				ms.decls = append(ms.decls, &topDecl{
+					binding: ms.bindingOf(t.Function.Name),
+					span:    s,
+					pure:    true,
+				})
+			}
+
+		case *ast.VariableStatement:
+			if len(t.List) != 1 {
+				continue
+			}
+			ve, ok := t.List[0].(*ast.VariableExpression)
+			if !ok {
+				continue
+			}
+			decl := &topDecl{
+				binding: ms.tree.root.bindings[ve.Name],
+				span:    s,
+			}
+			if spec, ok := ms.requireExpression(ve.Initializer); ok {
+				decl.spec = spec
+			} else {
+				decl.pure = ms.isPure(ve.Initializer)
+			}
+			ms.decls = append(ms.decls, decl)
+
+		case *ast.ExpressionStatement:
+			if spec, _, ok := ms.requireCall(t.Expression); ok {
+				ms.decls = append(ms.decls, &topDecl{span: s, spec: spec})
+			} else if !entry.esm {
+				sv.topLevelAssignment(entry, t, s)
+			}
+		}
+	}
+}
+
+// Checks that every use of `exports` and `module` is one we understand,
+// marking the module opaque otherwise.
+func (ms *moduleShake) commonJSExports(sv *shakeVisitor) {
+	if sv.replaced && sv.shorthand {
+		ms.opaque = true
+	}
+
+	if exports := ms.tree.root.bindings["exports"]; exports != nil {
+		for _, site := range exports.sites {
+			if sv.claimed[site] {
+				continue
+			}
+			if name, ok := sv.memberOf[site]; ok {
+				ms.internal[name] = true
+			} else {
+				ms.opaque = true
+			}
+		}
+	}
+
+	if module := ms.tree.root.bindings["module"]; module != nil {
+		for _, site := range module.sites {
+			if sv.claimed[site] {
+				continue
+			}
+			if name, ok := sv.moduleExportsMember[site]; ok {
+				ms.internal[name] = true
+			} else if name, ok := sv.memberOf[site]; !ok || name == "exports" {
+				ms.opaque = true
+			}
+		}
+	}
+}
+
+// Walks a module, finding each `require` call and how it's used, and which
+// identifiers are only used to get at a property.
+type shakeVisitor struct {
+	ms    *moduleShake
+	depth int
+
+	// Offsets of `require` calls, and of `exports` and `module` identifiers,
+	// which have already been accounted for
+	claimed map[int]bool
+
+	// Identifiers followed by a property with a static name, by offset
+	memberOf map[int]string
+
+	// `module` identifiers in `module.exports.name`, by offset
+	moduleExportsMember map[int]string
+
+	// Modules assigned to a variable, whose uses are found once the walk is
+	// done
+	bound []boundRequire
+
+	thisAtTop bool
+
+	// Whether `module.exports` has been replaced with an object, and whether
+	// that's after anything assigned to `exports` directly
+	replaced  bool
+	shorthand bool
+}
+
+type boundRequire struct {
+	site    *requireSite
+	binding *binding
+	decl    int
+}
+
+func (sv *shakeVisitor) site(spec string, offset int) *requireSite {
+	site := &requireSite{spec: spec, offset: offset}
+	sv.ms.requires = append(sv.ms.requires, site)
+	sv.claimed[offset] = true
+	return site
+}
+
+// Records a property with a static name being accessed on an expression
+func (sv *shakeVisitor) member(left ast.Expression, name string) {
+	if spec, offset, ok := sv.ms.requireCall(left); ok {
+		site := sv.site(spec, offset)
+		site.uses = append(site.uses, nameUse{name, offset})
+		return
+	}
+
+	switch t := left.(type) {
+	case *ast.Identifier:
+		sv.memberOf[int(t.Idx)-1] = name
+	case *ast.DotExpression:
+		if id, ok := t.Left.(*ast.Identifier); ok && id.Name == "module" &&
+			t.Identifier.Name == "exports" {
+			sv.moduleExportsMember[int(id.Idx)-1] = name
+		}
+	}
+}
+
+func (sv *shakeVisitor) Visit(n ast.Node) bool {
+	switch t := n.(type) {
+
+	case *ast.ExpressionStatement:
+		if spec, offset, ok := sv.ms.requireCall(t.Expression); ok {
+			sv.site(spec, offset)
+		}
+
+	case *ast.DotExpression:
+		sv.member(t.Left, t.Identifier.Name)
+
+	case *ast.BracketExpression:
+		if str, ok := t.Member.(*ast.StringLiteral); ok {
+			sv.member(t.Left, str.Value)
+		}
+
+	case *ast.VariableExpression:
+		if spec, offset, ok := sv.ms.requireCall(t.Initializer); ok {
+			decl := int(t.Idx) - 1
+			var b *binding
+			if ref, ok := sv.ms.refs[decl]; ok {
+				b = ref.binding
+			}
+			sv.bound = append(sv.bound,
+				boundRequire{sv.site(spec, offset), b, decl})
+		}
+
+	case *ast.CallExpression:
+		if callee, ok := t.Callee.(*ast.Identifier); ok &&
+			callee.Name == esmInterop && len(t.ArgumentList) == 1 {
+			if spec, offset, ok := sv.ms.requireCall(t.ArgumentList[0]); ok {
+				sv.site(spec, offset).interop = true
+			}
+		}
+		if spec, offset, ok := sv.ms.requireCall(t); ok && !sv.claimed[offset] {
+			site := sv.site(spec, offset)
+			site.whole = append(site.whole, offset)
+		}
+
+	case *ast.ThisExpression:
+		if sv.depth == 0 {
+			sv.thisAtTop = true
+		}
+
+	case *ast.FunctionLiteral:
+		inner := *sv
+		inner.depth++
+		if err := WalkNode(&inner, t.Body); err != nil {
+			return false
+		}
+		sv.bound = inner.bound
+		return false
+	}
+	return true
+}
+
+// Works out what's used of each module assigned to a variable. Using it only
+// to get at properties with static names uses just those exports, while any
+// other use of it uses the whole thing.
+func (sv *shakeVisitor) bindRequires() {
+	for _, br := range sv.bound {
+		if br.binding == nil || br.binding.scope.frozen {
+			br.site.whole = append(br.site.whole, br.site.offset)
+			continue
+		}
+		for _, site := range br.binding.sites {
+			if site == br.decl {
+				continue
+			}
+			if name, ok := sv.memberOf[site]; ok {
+				br.site.uses = append(br.site.uses, nameUse{name, site})
+			} else {
+				br.site.whole = append(br.site.whole, site)
+			}
+		}
+	}
+}
+
+// Recognizes `exports.name = value`, `module.exports.name = value`, and
+// `module.exports = {...}` at the top level of a CommonJS module.
+func (sv *shakeVisitor) topLevelAssignment(entry *srcEntry,
+	stmt *ast.ExpressionStatement, s span) {
+
+	ms := sv.ms
+	assign, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok || assign.Operator != jstoken.ASSIGN {
+		return
+	}
+
+	var (
+		name   string
+		object ast.Expression
+	)
+	switch left := assign.Left.(type) {
+	case *ast.DotExpression:
+		name, object = left.Identifier.Name, left.Left
+	case *ast.BracketExpression:
+		str, ok := left.Member.(*ast.StringLiteral)
+		if !ok {
+			return
+		}
+		name, object = str.Value, left.Left
+	default:
+		return
+	}
+
+	// module.exports = {...}
+	if id, ok := object.(*ast.Identifier); ok && id.Name == "module" &&
+		name == "exports" && ms.bindingOf(id) == ms.tree.root.bindings["module"] {
+
+		obj, ok := assign.Right.(*ast.ObjectLiteral)
+		if !ok || sv.replaced || len(ms.exports) > 0 {
+			ms.opaque = true
+			return
+		}
+		spans, ok := propertySpans(entry.src, obj)
+		if !ok {
+			ms.opaque = true
+			return
+		}
+		sv.replaced = true
+		sv.claimed[int(id.Idx)-1] = true
+		for i, prop := range obj.Value {
+			def := ms.export(prop.Key)
+			def.spans = append(def.spans, spans[i])
+			def.pure = def.pure && ms.isPure(prop.Value)
+		}
+		return
+	}
+
+	// exports.name = value, or module.exports.name = value
+	var base *ast.Identifier
+	switch t := object.(type) {
+	case *ast.Identifier:
+		if t.Name == "exports" &&
+			ms.bindingOf(t) == ms.tree.root.bindings["exports"] {
+			base = t
+			sv.shorthand = true
+		}
+	case *ast.DotExpression:
+		if id, ok := t.Left.(*ast.Identifier); ok && id.Name == "module" &&
+			t.Identifier.Name == "exports" &&
+			ms.bindingOf(id) == ms.tree.root.bindings["module"] {
+			base = id
+		}
+	}
+	if base == nil {
+		return
+	}
+
+	sv.claimed[int(base.Idx)-1] = true
+	def := ms.export(name)
+	def.spans = append(def.spans, s)
+	def.pure = def.pure && ms.isPure(assign.Right)
+}
+
+// Finds the source of each property of an object literal, along with a comma
+// either side of it, so that removing any of them leaves a valid object.
+func propertySpans(src []byte, obj *ast.ObjectLiteral) ([]span, bool) {
+	start, end := int(obj.LeftBrace), int(obj.RightBrace)-1
+	tokens, err := tokenize(string(src[start:end]), "")
+	if err != nil {
+		return nil, false
+	}
+
+	// Split the significant tokens on commas outside of any brackets
+	var (
+		props  [][2]int
+		commas []int
+		depth  int
+		first  = -1
+		last   int
+	)
+	for _, tok := range tokens {
+		if tok.trivia() {
+			continue
+		}
+		switch {
+		case depth == 0 && tok.is(tokPunctuator, ","):
+			props = append(props, [2]int{first, last})
+			commas = append(commas, tok.offset)
+			first = -1
+			continue
+		case tok.kind == tokPunctuator && strings.Contains("({[", tok.text):
+			depth++
+		case tok.kind == tokPunctuator && strings.Contains(")}]", tok.text):
+			depth--
+		}
+		if first < 0 {
+			first = tok.offset
+		}
+		last = tok.offset + len(tok.text)
+	}
+	if first >= 0 {
+		props = append(props, [2]int{first, last})
+	}
+	if len(props) != len(obj.Value) {
+		return nil, false
+	}
+
+	spans := make([]span, len(props))
+	for i, prop := range props {
+		s := span{start + prop[0], start + prop[1], false}
+		if i < len(commas) {
+			s.end = start + commas[i] + 1
+		} else if i > 0 {
+			s.start = start + commas[i-1]
+		}
+		spans[i] = s
+	}
+	return spans, true
+}
+
+// The source of a module with everything shaken out of it blanked, keeping
+// every line where it was.
+func blank(src []byte, removed []span) []byte {
+	if len(removed) == 0 {
+		return src
+	}
+	out := make([]byte, len(src))
+	copy(out, src)
+	for _, s := range removed {
+		for i := s.start; i < s.end; {
+			r, size := utf8.DecodeRune(src[i:s.end])
+			if !isLineTerminator(r) {
+				for j := i; j < i+size; j++ {
+					out[j] = ' '
+				}
+			}
+			i += size
+		}
+	}
+	for _, s := range removed {
+		if s.statement {
+			out[s.start] = ';'
+		}
+	}
+	return out
+}
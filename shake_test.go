@@ -0,0 +1,189 @@
+package jssquish
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Bundles the given files from `index.js`, returning the output
+func squish(files map[string]string, opts Options) string {
+	repo := memoryRepository(files)
+	defer repo.Close()
+
+	out := &bytes.Buffer{}
+	Expect(MainWithOptions(repo, "index.js", out, opts)).To(Succeed())
+	return out.String()
+}
+
+var _ = Describe("ES module lowering", func() {
+
+	lower := func(src string) *loweredModule {
+		lowered, err := lowerModule([]byte(src), "test.js")
+		Expect(err).ToNot(HaveOccurred())
+		return lowered
+	}
+
+	It("should leave CommonJS alone", func() {
+		src := "var a = require('a');\nmodule.exports = a.import;"
+		lowered := lower(src)
+		Expect(lowered.esm).To(BeFalse())
+		Expect(string(lowered.src)).To(Equal(src))
+	})
+
+	It("should turn imports into requires", func() {
+		lowered := lower(
+			"import a, {b, c as d} from 'x';\nimport * as ns from 'y'\nimport 'z'")
+		Expect(lowered.esm).To(BeTrue())
+
+		src := string(lowered.src)
+		Expect(src).To(ContainSubstring(
+			"var a = __squish_interop(require('x')); var b = require('x').b; " +
+				"var d = require('x').c;\n"))
+		Expect(src).To(ContainSubstring("var ns = require('y');\n"))
+		Expect(src).To(ContainSubstring("require('z');"))
+		Expect(src).To(ContainSubstring("function __squish_interop(m)"))
+	})
+
+	It("should define exports as getters", func() {
+		lowered := lower("export var a = 1, b = [2, 3]\nexport function f() {}\n" +
+			"export {a as c}\nexport default a + 1")
+
+		var names []string
+		for _, exp := range lowered.exports {
+			names = append(names, exp.name)
+			Expect(string(lowered.src[exp.start:exp.end])).To(HavePrefix(
+				"Object.defineProperty(exports, \"" + exp.name + "\""))
+		}
+		Expect(names).To(Equal([]string{"a", "b", "f", "c", "default"}))
+		Expect(string(lowered.src)).To(ContainSubstring(
+			"var __squish_default = a + 1"))
+	})
+
+	It("should keep every line where it was", func() {
+		src := "import {\n  a,\n  b\n} from 'x'\nexport function f() {}\nf(a, b)"
+		lowered := lower(src)
+		lines := strings.Split(string(lowered.src), "\n")
+		Expect(lines).To(HaveLen(6))
+		Expect(lines[4]).To(Equal(" function f() {}"))
+		Expect(lines[5]).To(Equal("f(a, b)"))
+	})
+
+	It("should not mistake dynamic imports for declarations", func() {
+		lowered := lower("var p = import('x')")
+		Expect(lowered.esm).To(BeFalse())
+	})
+
+	It("should report malformed declarations", func() {
+		_, err := lowerModule([]byte("import {a b} from 'x'"), "test.js")
+		Expect(err).To(MatchError("test.js:1:11: expected ',' or '}'"))
+	})
+})
+
+var _ = Describe("Tree shaking", func() {
+
+	shaken := func(files map[string]string) string {
+		return squish(files, Options{TreeShake: true})
+	}
+
+	It("should keep everything without being asked", func() {
+		out := squish(map[string]string{
+			"index.js": "require('./lib').a",
+			"lib.js":   "exports.a = 'A'; exports.b = 'DEAD'",
+		}, Options{})
+		Expect(out).To(ContainSubstring("DEAD"))
+	})
+
+	It("should remove unused CommonJS exports", func() {
+		out := shaken(map[string]string{
+			"index.js": "var lib = require('./lib'); lib.a",
+			"lib.js": "function b() { return 'DEAD' }\n" +
+				"exports.a = 'A'\nexports.b = b\nexports.c = console.log('C')",
+		})
+		Expect(out).To(ContainSubstring("exports.a = 'A'"))
+		Expect(out).To(ContainSubstring("console.log('C')"))
+		Expect(out).ToNot(ContainSubstring("DEAD"))
+		Expect(out).ToNot(ContainSubstring("exports.b"))
+	})
+
+	It("should remove unused properties of module.exports", func() {
+		out := shaken(map[string]string{
+			"index.js": "require('./lib').b",
+			"lib.js":   "module.exports = {a: 'DEAD', b: 'B', c: 'DEAD'}",
+		})
+		Expect(out).To(MatchRegexp(`module.exports = \{\s*b: 'B'\s*\}`))
+	})
+
+	It("should remove unused ES exports", func() {
+		out := shaken(map[string]string{
+			"index.js": "import {a} from './lib'; a()",
+			"lib.js": "export function a() {}\nexport function b() { c() }\n" +
+				"function c() { return 'DEAD' }",
+		})
+		Expect(out).To(ContainSubstring("function a() {}"))
+		Expect(out).ToNot(ContainSubstring("DEAD"))
+		Expect(out).ToNot(ContainSubstring(`"b"`))
+	})
+
+	It("should follow exports through re-exports", func() {
+		out := shaken(map[string]string{
+			"index.js": "import {a} from './reexport'; a",
+			"reexport.js": "export {a, b} from './lib'\n" +
+				"export {c} from './lib'",
+			"lib.js": "export var a = 'A', b = 'DEAD'\nexport var c = 'DEAD'",
+		})
+		Expect(out).To(ContainSubstring("'A'"))
+		Expect(out).To(ContainSubstring(`"a"`))
+		Expect(out).ToNot(ContainSubstring(`"c"`))
+		Expect(out).ToNot(ContainSubstring("var c = 'DEAD'"))
+	})
+
+	It("should keep everything of a module used as a whole", func() {
+		out := shaken(map[string]string{
+			"index.js": "var lib = require('./lib'); console.log(lib)",
+			"lib.js":   "exports.a = 'A'; exports.b = 'B'",
+		})
+		Expect(out).To(ContainSubstring("exports.b = 'B'"))
+	})
+
+	It("should keep everything of an opaque module", func() {
+		out := shaken(map[string]string{
+			"index.js": "require('./lib').a",
+			"lib.js":   "exports.a = 'A'; exports.b = 'B'; module.exports.c = exports",
+		})
+		Expect(out).To(ContainSubstring("exports.b = 'B'"))
+	})
+
+	It("should keep exports the module uses itself", func() {
+		out := shaken(map[string]string{
+			"index.js": "require('./lib').a()",
+			"lib.js":   "exports.a = function () { return exports.b }; exports.b = 'B'",
+		})
+		Expect(out).To(ContainSubstring("exports.b = 'B'"))
+	})
+
+	It("should drop unused modules without side effects", func() {
+		out := shaken(map[string]string{
+			"index.js":          "import {a} from './pure/lib'; import './impure'",
+			"impure.js":         "console.log('IMPURE')",
+			"pure/package.json": `{"sideEffects": false}`,
+			"pure/lib.js":       "console.log('DEAD')",
+		})
+		Expect(out).To(ContainSubstring("IMPURE"))
+		Expect(out).ToNot(ContainSubstring("DEAD"))
+		Expect(out).ToNot(ContainSubstring("pure/lib"))
+	})
+
+	It("should keep files listed as having side effects", func() {
+		out := shaken(map[string]string{
+			"index.js":          "require('./pure/a'); require('./pure/polyfill')",
+			"pure/package.json": `{"sideEffects": ["polyfill.js"]}`,
+			"pure/a.js":         "console.log('DEAD')",
+			"pure/polyfill.js":  "console.log('POLYFILL')",
+		})
+		Expect(out).To(ContainSubstring("POLYFILL"))
+		Expect(out).ToNot(ContainSubstring("DEAD"))
+	})
+})
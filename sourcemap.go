@@ -0,0 +1,170 @@
+package jssquish
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// Builds a version 3 source map, as described at
+// https://sourcemaps.info/spec.html
+// Mappings must be added in the order they were generated.
+type sourceMap struct {
+	file     string
+	sources  []string
+	contents []*string
+	names    []string
+	nameIdx  map[string]int
+
+	mappings bytes.Buffer
+
+	// Every field of a mapping segment is relative to the previous one, with the
+	// generated column resetting at each line.
+	genLine   int
+	genCol    int
+	source    int
+	srcLine   int
+	srcCol    int
+	name      int
+	lineStart bool
+}
+
+func newSourceMap(file string) *sourceMap {
+	return &sourceMap{
+		file:      file,
+		nameIdx:   make(map[string]int),
+		lineStart: true,
+	}
+}
+
+// Adds a source file, returning its index for use in mappings. The contents
+// are embedded in the map, so it's useful without access to the originals.
+func (sm *sourceMap) AddSource(path string, contents []byte) int {
+	src := string(contents)
+	sm.sources = append(sm.sources, path)
+	sm.contents = append(sm.contents, &src)
+	return len(sm.sources) - 1
+}
+
+// Maps a position in the generated output to one in a source. A non-empty
+// `name` records the original name of a renamed identifier.
+func (sm *sourceMap) AddMapping(genLine, genCol, source, srcLine, srcCol int,
+	name string) {
+
+	for sm.genLine < genLine {
+		sm.mappings.WriteByte(';')
+		sm.genLine++
+		sm.genCol = 0
+		sm.lineStart = true
+	}
+	if !sm.lineStart {
+		sm.mappings.WriteByte(',')
+	}
+	sm.lineStart = false
+
+	writeVLQ(&sm.mappings, genCol-sm.genCol)
+	writeVLQ(&sm.mappings, source-sm.source)
+	writeVLQ(&sm.mappings, srcLine-sm.srcLine)
+	writeVLQ(&sm.mappings, srcCol-sm.srcCol)
+	sm.genCol, sm.source, sm.srcLine, sm.srcCol = genCol, source, srcLine, srcCol
+
+	if name != "" {
+		idx, ok := sm.nameIdx[name]
+		if !ok {
+			idx = len(sm.names)
+			sm.names = append(sm.names, name)
+			sm.nameIdx[name] = idx
+		}
+		writeVLQ(&sm.mappings, idx-sm.name)
+		sm.name = idx
+	}
+}
+
+// Maps each line of a source, starting from the given generated line, to the
+// start of the same line in the source. This is all the detail there is for a
+// source copied into the output as-is.
+func (sm *sourceMap) AddLines(genLine, source int, contents []byte) {
+	lines := bytes.Count(contents, []byte("\n")) + 1
+	for i := 0; i < lines; i++ {
+		sm.AddMapping(genLine+i, 0, source, i, 0, "")
+	}
+}
+
+func (sm *sourceMap) WriteTo(w io.Writer) (int64, error) {
+	sources := sm.sources
+	if sources == nil {
+		sources = []string{}
+	}
+	names := sm.names
+	if names == nil {
+		names = []string{}
+	}
+
+	out := struct {
+		Version        int       `json:"version"`
+		File           string    `json:"file,omitempty"`
+		Sources        []string  `json:"sources"`
+		SourcesContent []*string `json:"sourcesContent"`
+		Names          []string  `json:"names"`
+		Mappings       string    `json:"mappings"`
+	}{3, sm.file, sources, sm.contents, names, sm.mappings.String()}
+
+	bs, err := json.Marshal(out)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(bs)
+	return int64(n), err
+}
+
+const vlqBase64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// Writes a base64 variable length quantity. The sign is kept in the lowest
+// bit, and each digit holds five bits with the sixth flagging a continuation.
+func writeVLQ(buf *bytes.Buffer, n int) {
+	v := n << 1
+	if n < 0 {
+		v = (-n << 1) | 1
+	}
+	for {
+		digit := v & 31
+		v >>= 5
+		if v > 0 {
+			digit |= 32
+		}
+		buf.WriteByte(vlqBase64[digit])
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// Tracks the line and column of everything written through it, so that
+// mappings can be made to the output. Columns are counted in UTF-16 code units,
+// and the offset in bytes.
+type positionWriter struct {
+	w      io.Writer
+	line   int
+	col    int
+	offset int
+}
+
+func (pw *positionWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.offset += n
+	for i := 0; i < n; {
+		r, size := utf8.DecodeRune(p[i:n])
+		switch {
+		case r == '\n':
+			pw.line++
+			pw.col = 0
+		case r > 0xffff:
+			pw.col += 2
+		default:
+			pw.col++
+		}
+		i += size
+	}
+	return n, err
+}
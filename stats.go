@@ -0,0 +1,164 @@
+package jssquish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"vistarmedia.com/tool/js-squish/file"
+)
+
+// How big a bundle is, and what it's made of. Each module is measured as it was
+// written, as it would be minified, and gzipped on its own. Gzipping a module
+// alone can't make use of what it has in common with the rest of the bundle,
+// so those sizes add up to more than the gzipped bundle does.
+type Stats struct {
+	Size    int `json:"size"`
+	Gzipped int `json:"gzipped"`
+
+	// Largest first
+	Packages []PackageStats `json:"packages"`
+	Modules  []ModuleStats  `json:"modules"`
+}
+
+type ModuleStats struct {
+	Path    string `json:"path"`
+	Id      int    `json:"id"`
+	Package string `json:"package"`
+	Sizes
+}
+
+// The modules of a package, measured together
+type PackageStats struct {
+	Package string `json:"package"`
+	Modules int    `json:"modules"`
+	Sizes
+}
+
+// Sizes, in bytes
+type Sizes struct {
+	Raw      int `json:"raw"`
+	Minified int `json:"minified"`
+	Gzipped  int `json:"gzipped"`
+}
+
+// Measures a bundle, and the modules written in it. Minified sizes are only
+// known for a bundle which was minified or built with `Options.Stats`.
+func NewStats(bundle []byte, modules []WrittenModule) *Stats {
+	stats := &Stats{
+		Size:     len(bundle),
+		Gzipped:  gzippedSize(bundle),
+		Packages: []PackageStats{},
+		Modules:  []ModuleStats{},
+	}
+
+	var (
+		packages = make(map[string]*PackageStats)
+		contents = make(map[string]*bytes.Buffer)
+	)
+	for _, module := range modules {
+		wrapper := bundle[module.Start:module.End]
+		pkg := packageOf(module.Path)
+		stats.Modules = append(stats.Modules, ModuleStats{
+			Path:    module.Path,
+			Id:      module.Id,
+			Package: pkg,
+			Sizes:   Sizes{len(wrapper), module.Minified, gzippedSize(wrapper)},
+		})
+
+		ps, ok := packages[pkg]
+		if !ok {
+			ps = &PackageStats{Package: pkg}
+			packages[pkg] = ps
+			contents[pkg] = &bytes.Buffer{}
+		}
+		ps.Modules++
+		ps.Raw += len(wrapper)
+		ps.Minified += module.Minified
+		contents[pkg].Write(wrapper)
+	}
+
+	for pkg, ps := range packages {
+		ps.Gzipped = gzippedSize(contents[pkg].Bytes())
+		stats.Packages = append(stats.Packages, *ps)
+	}
+
+	sort.Slice(stats.Modules, func(i, j int) bool {
+		a, b := stats.Modules[i], stats.Modules[j]
+		return a.Raw > b.Raw || a.Raw == b.Raw && a.Path < b.Path
+	})
+	sort.Slice(stats.Packages, func(i, j int) bool {
+		a, b := stats.Packages[i], stats.Packages[j]
+		return a.Raw > b.Raw || a.Raw == b.Raw && a.Package < b.Package
+	})
+	return stats
+}
+
+// The package a module belongs to: the package under the innermost
+// `node_modules` directory in its path, or else its top-level directory, which
+// is where a JSTar keeps each package. A scoped package's directory is inside
+// its scope's. Files at the top level belong to ".".
+func packageOf(path string) string {
+	dir := packageDir(path)
+	if i := strings.LastIndex(dir, "node_modules/"); i >= 0 {
+		return dir[i+len("node_modules/"):]
+	}
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// The directory of the package a module belongs to, as for `packageOf`, or ""
+// for a file at the top level
+func packageDir(path string) string {
+	parts, start := strings.Split(path, "/"), 0
+	for i := len(parts) - 2; i >= 0; i-- {
+		if parts[i] == "node_modules" {
+			start = i + 1
+			break
+		}
+	}
+
+	rest := parts[start:]
+	switch {
+	case len(rest) == 1:
+		return ""
+	case strings.HasPrefix(rest[0], "@") && len(rest) > 2:
+		return strings.Join(parts[:start+2], "/")
+	default:
+		return strings.Join(parts[:start+1], "/")
+	}
+}
+
+func gzippedSize(bs []byte) int {
+	counter := &positionWriter{w: ioutil.Discard}
+	gz, _ := gzip.NewWriterLevel(counter, gzip.BestCompression)
+	gz.Write(bs)
+	gz.Close()
+	return counter.offset
+}
+
+// Writes the stats as indented JSON
+func (s *Stats) WriteJSON(w io.Writer) error {
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+var statsTemplate = template.Must(template.New("stats").Parse(
+	string(file.MustAsset("tool/js-squish/stats.html"))))
+
+// Writes a page showing the stats as a treemap of packages and their modules.
+// Everything it needs is in the page.
+func (s *Stats) WriteHTML(w io.Writer) error {
+	return statsTemplate.Execute(w, s)
+}
@@ -0,0 +1,88 @@
+package jssquish
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stats", func() {
+
+	files := map[string]string{
+		"index.js": "require('big'); require('@scope/pkg'); require('./lib/a')",
+		"lib/a.js": "module.exports = 'a'",
+		"big/index.js": "// A long comment, which makes this the biggest module\n" +
+			"var longName = 1;\nmodule.exports = longName + longName",
+		"@scope/pkg/index.js": "module.exports = 2",
+	}
+
+	stats := func(opts Options) (*Stats, string) {
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		result, err := Build(repo, "index.js", out, opts)
+		Expect(err).ToNot(HaveOccurred())
+		return NewStats(out.Bytes(), result.Modules), out.String()
+	}
+
+	It("should find the package of each module", func() {
+		Expect(packageOf("index.js")).To(Equal("."))
+		Expect(packageOf("lib/a.js")).To(Equal("lib"))
+		Expect(packageOf("node_modules/big/lib/index.js")).To(Equal("big"))
+		Expect(packageOf("node_modules/@scope/pkg/index.js")).
+			To(Equal("@scope/pkg"))
+		Expect(packageOf("node_modules/a/node_modules/b/index.js")).
+			To(Equal("b"))
+		Expect(packageOf("@scope/pkg/index.js")).To(Equal("@scope/pkg"))
+		Expect(packageOf("lib/node_modules")).To(Equal("lib"))
+	})
+
+	It("should measure each module as written, minified and gzipped", func() {
+		s, bundle := stats(Options{Stats: true})
+		Expect(s.Size).To(Equal(len(bundle)))
+		Expect(s.Gzipped).To(BeNumerically(">", 0))
+		Expect(s.Modules).To(HaveLen(4))
+
+		big := s.Modules[0]
+		Expect(big.Path).To(Equal("big/index.js"))
+		Expect(big.Package).To(Equal("big"))
+		Expect(bundle).To(ContainSubstring(
+			"biggest module\nvar longName = 1;"))
+		Expect(big.Minified).To(BeNumerically("<", big.Raw))
+		Expect(big.Gzipped).To(BeNumerically(">", 0))
+
+		// Minifying the bundle should match the estimate of every module
+		minified, _ := stats(Options{Minify: true})
+		estimates := make(map[string]int)
+		for _, module := range s.Modules {
+			estimates[module.Path] = module.Minified
+		}
+		for _, module := range minified.Modules {
+			Expect(module.Raw).To(Equal(estimates[module.Path]))
+			Expect(module.Minified).To(Equal(module.Raw))
+		}
+	})
+
+	It("should add up each package's modules", func() {
+		s, _ := stats(Options{Stats: true})
+		var names []string
+		for _, pkg := range s.Packages {
+			names = append(names, pkg.Package)
+		}
+		Expect(names).To(ConsistOf(".", "lib", "big", "@scope/pkg"))
+		Expect(s.Packages[0].Package).To(Equal("big"))
+		Expect(s.Packages[0].Raw).To(Equal(s.Modules[0].Raw))
+		Expect(s.Packages[0].Modules).To(Equal(1))
+	})
+
+	It("should write a page with the stats in it", func() {
+		s, _ := stats(Options{Stats: true})
+		out := &bytes.Buffer{}
+		Expect(s.WriteHTML(out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"path":"big/index.js"`))
+		Expect(strings.Count(out.String(), "<script")).To(Equal(1))
+		Expect(out.String()).ToNot(MatchRegexp(`(src|href)=`))
+	})
+})
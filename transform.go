@@ -0,0 +1,176 @@
+package jssquish
+
+import (
+	"bytes"
+	"fmt"
+	pth "path"
+	"strings"
+)
+
+// A source transform, run on a file before its requires are found, so that
+// what it requires is read from what the transform gives. Requires a
+// transform adds are bundled just like any other.
+type Transform interface {
+	// Gives the new source of the file at `path`, along with any other files
+	// the new source was made from, such as a file it inlined. Those are
+	// watched along with the files of the bundle.
+	Transform(path string, src []byte) ([]byte, []string, error)
+}
+
+// The extensions of files the built in transforms compile, which are resolved
+// like `.js` files
+var sourceExtensions = []string{".jsx", ".ts", ".tsx"}
+
+// The transforms compiling JSX and TypeScript
+func builtinTransforms(opts Options) []TransformRule {
+	return append(jsxTransforms(opts.JSX), typescriptTransforms()...)
+}
+
+// Where in `Options.Transforms` the built in transforms, compiling JSX and
+// TypeScript, are run. Without it, they're run before any others.
+var BuiltinTransforms = TransformRule{Transform: builtinPlace{}}
+
+type builtinPlace struct{}
+
+func (builtinPlace) Transform(path string, src []byte) ([]byte, []string,
+	error) {
+	return src, nil, nil
+}
+
+// The transforms a build runs: its own, with the built in transforms where it
+// puts `BuiltinTransforms`, or else before all of them
+func buildTransforms(opts Options, cache *buildCache) []TransformRule {
+	builtin := TransformRule{Transform: &compileTransform{
+		rules:  builtinTransforms(opts),
+		salt:   fmt.Sprintf("%s\x00%#v", cacheSalt, opts.JSX),
+		cache:  cache,
+		parsed: opts.ParseCache,
+	}}
+
+	var rules []TransformRule
+	placed := false
+	for _, rule := range opts.Transforms {
+		if _, ok := rule.Transform.(builtinPlace); ok {
+			rule, placed = builtin, true
+		}
+		rules = append(rules, rule)
+	}
+	if !placed {
+		rules = append([]TransformRule{builtin}, rules...)
+	}
+	return rules
+}
+
+// Runs the built in transforms, keeping what they give in the caches a build
+// has, if any. Entries are keyed on the source given, the path of the file and
+// the options compiling it, so a file compiles the same way each time.
+type compileTransform struct {
+	rules  []TransformRule
+	salt   string
+	cache  *buildCache
+	parsed *ParseCache
+}
+
+func (ct *compileTransform) Transform(path string, src []byte) ([]byte,
+	[]string, error) {
+
+	matched := false
+	for _, rule := range ct.rules {
+		matched = matched || rule.matches(path)
+	}
+	if !matched || (ct.cache == nil && ct.parsed == nil) {
+		return runTransforms(ct.rules, path, src)
+	}
+
+	key := ct.key(path, src)
+	if ct.parsed != nil {
+		if out, ok := ct.parsed.GetSource(key); ok {
+			return out, nil, nil
+		}
+	}
+	if ct.cache != nil {
+		if out, ok := ct.cache.GetSource(key); ok {
+			if ct.parsed != nil {
+				ct.parsed.PutSource(key, out)
+			}
+			return out, nil, nil
+		}
+	}
+
+	out, files, err := runTransforms(ct.rules, path, src)
+	if err != nil || bytes.Equal(out, src) {
+		return out, files, err
+	}
+	if ct.cache != nil {
+		ct.cache.PutSource(key, out)
+	}
+	if ct.parsed != nil {
+		ct.parsed.PutSource(key, out)
+	}
+	return out, files, nil
+}
+
+func (ct *compileTransform) key(path string, src []byte) string {
+	return contentKey(ct.salt+"\x00"+path, src)
+}
+
+// A function used as a `Transform`
+type TransformFunc func(path string, src []byte) ([]byte, []string, error)
+
+func (f TransformFunc) Transform(path string, src []byte) ([]byte, []string,
+	error) {
+	return f(path, src)
+}
+
+// A transform, and the files it's run on
+type TransformRule struct {
+	// A pattern matched against the path of each file, as by `path.Match`. A
+	// pattern without a slash is matched against the name of the file alone,
+	// so "*.coffee" matches a file of that extension in any directory. An
+	// empty pattern matches every file.
+	Pattern string
+
+	Transform Transform
+}
+
+// Whether the rule applies to the file at `path`
+func (tr TransformRule) matches(path string) bool {
+	if tr.Pattern == "" {
+		return true
+	}
+	if !strings.Contains(tr.Pattern, "/") {
+		path = pth.Base(path)
+	}
+	matched, _ := pth.Match(tr.Pattern, path)
+	return matched
+}
+
+// Runs each transform which applies to a file, in order, each on what the one
+// before gave. Also gives the other files any of them read.
+func transform(rules []TransformRule, path string, src []byte) ([]byte,
+	[]string, error) {
+
+	out, files, err := runTransforms(rules, path, src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transforming %s: %s", path, err)
+	}
+	return out, files, nil
+}
+
+func runTransforms(rules []TransformRule, path string, src []byte) ([]byte,
+	[]string, error) {
+
+	var files []string
+	for _, rule := range rules {
+		if !rule.matches(path) {
+			continue
+		}
+		out, read, err := rule.Transform.Transform(path, src)
+		if err != nil {
+			return nil, nil, err
+		}
+		src = out
+		files = append(files, read...)
+	}
+	return src, files, nil
+}
@@ -0,0 +1,175 @@
+package jssquish
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transforms", func() {
+
+	build := func(files map[string]string,
+		rules ...TransformRule) (*BuildResult, string, error) {
+
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		result, err := Build(repo, "index.js", out, Options{Transforms: rules})
+		return result, out.String(), err
+	}
+
+	// Replaces one string with another in every file it's run on
+	replace := func(old, new string) Transform {
+		return TransformFunc(func(path string, src []byte) ([]byte, []string,
+			error) {
+			return []byte(strings.Replace(string(src), old, new, -1)), nil, nil
+		})
+	}
+
+	It("should match patterns against names, or whole paths", func() {
+		for _, match := range []struct {
+			pattern, path string
+			matches       bool
+		}{
+			{"", "lib/a.js", true},
+			{"*.coffee", "a.coffee", true},
+			{"*.coffee", "lib/deep/a.coffee", true},
+			{"*.coffee", "a.js", false},
+			{"lib/*.js", "lib/a.js", true},
+			{"lib/*.js", "lib/deep/a.js", false},
+			{"lib/*.js", "a.js", false},
+		} {
+			rule := TransformRule{Pattern: match.pattern}
+			Expect(rule.matches(match.path)).To(Equal(match.matches),
+				match.pattern+" "+match.path)
+		}
+	})
+
+	It("should run each matching transform in order", func() {
+		_, bundle, err := build(map[string]string{
+			"index.js":   "result = [require('./lib/a'), 'INDEX']",
+			"lib/a.js":   "module.exports = 'A'",
+			"other/b.js": "",
+		},
+			TransformRule{"lib/*.js", replace("A", "B")},
+			TransformRule{"*.js", replace("B", "C")},
+			TransformRule{"index.js", replace("INDEX", "D")},
+			TransformRule{"*.coffee", replace("C", "E")},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		vm := otto.New()
+		_, err = vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result.join()")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("C,D"))
+	})
+
+	It("should find requires in what transforms give", func() {
+		result, bundle, err := build(map[string]string{
+			"index.js": "result = INLINE",
+			"value.js": "module.exports = 42",
+			"name.txt": "inlined",
+		}, TransformRule{"index.js", TransformFunc(
+			func(path string, src []byte) ([]byte, []string, error) {
+				inlined := []byte("[require('./value'), 'inlined']")
+				out := bytes.Replace(src, []byte("INLINE"), inlined, 1)
+				return out, []string{"name.txt"}, nil
+			})})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(Equal([]string{"index.js", "name.txt",
+			"value.js"}))
+
+		vm := otto.New()
+		_, err = vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result.join()")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("42,inlined"))
+	})
+
+	It("should run the built in transforms where they're placed", func() {
+		files := map[string]string{
+			"index.js": "result = require('./view')",
+			"view.jsx": "var React = {createElement: function (t, p, c) {" +
+				" return t + c }};\nmodule.exports = TAG",
+		}
+		tag := TransformRule{"*.jsx", replace("TAG", "<b>jsx</b>")}
+
+		_, bundle, err := build(files, tag, BuiltinTransforms)
+		Expect(err).ToNot(HaveOccurred())
+		vm := otto.New()
+		_, err = vm.Run(bundle)
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("bjsx"))
+
+		// Otherwise, they run first
+		_, _, err = build(files, tag)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should cache what the built in transforms give", func() {
+		dir, err := ioutil.TempDir("", "js-squish-cache")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		files := map[string]string{
+			"index.js": "result = require('./view')",
+			"view.jsx": "module.exports = <b/>",
+		}
+		repo := memoryRepository(files)
+		defer repo.Close()
+		run := func(opts Options) string {
+			out := &bytes.Buffer{}
+			_, err := Build(repo, "index.js", out, opts)
+			Expect(err).ToNot(HaveOccurred())
+			vm := otto.New()
+			_, err = vm.Run("React = {createElement: function (t) { return t }}")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = vm.Run(out.String())
+			Expect(err).ToNot(HaveOccurred())
+			value, err := vm.Run("result")
+			Expect(err).ToNot(HaveOccurred())
+			return value.String()
+		}
+
+		parsed := NewParseCache()
+		opts := Options{CacheDir: dir, ParseCache: parsed}
+		Expect(run(opts)).To(Equal("b"))
+
+		// What's cached is given back, rather than compiling the file again
+		compile := buildTransforms(opts, nil)[0].Transform.(*compileTransform)
+		key := compile.key("view.jsx", []byte(files["view.jsx"]))
+		cache, err := newBuildCache(dir)
+		Expect(err).ToNot(HaveOccurred())
+		cache.PutSource(key, []byte("module.exports = 'disk'"))
+		Expect(run(Options{CacheDir: dir})).To(Equal("disk"))
+		parsed.PutSource(key, []byte("module.exports = 'memory'"))
+		Expect(run(opts)).To(Equal("memory"))
+
+		// Compiling it differently is another entry
+		Expect(run(Options{CacheDir: dir, JSX: JSXOptions{
+			Factory: "React.createElement", Pragma: true}})).To(Equal("b"))
+	})
+
+	It("should say which file a transform failed on", func() {
+		_, _, err := build(map[string]string{
+			"index.js": "require('./bad')",
+			"bad.js":   "",
+		}, TransformRule{"bad.js", TransformFunc(
+			func(path string, src []byte) ([]byte, []string, error) {
+				return nil, nil, errors.New("unexpected token")
+			})})
+		Expect(err).To(MatchError("transforming bad.js: unexpected token"))
+	})
+})
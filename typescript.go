@@ -0,0 +1,1006 @@
+package jssquish
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The transforms stripping the types from TypeScript. `.tsx` files have their
+// JSX compiled first.
+func typescriptTransforms() []TransformRule {
+	strip := TransformFunc(func(path string, src []byte) ([]byte, []string,
+		error) {
+		out, err := stripTypes(src, path)
+		return out, nil, err
+	})
+	return []TransformRule{{"*.ts", strip}, {"*.tsx", strip}}
+}
+
+// Type parameters of a generic arrow function in a `.tsx` file, such as
+// `<T,>`, which would otherwise be taken for an element
+var tsxTypeParameters = regexp.MustCompile(
+	`^\s*[A-Za-z_$][\w$]*\s*(,|extends\s+[^\s=>])`)
+
+// Modifiers of a constructor's parameters
+var parameterModifiers = map[string]bool{
+	"public": true, "private": true, "protected": true, "readonly": true,
+	"override": true,
+}
+
+// Words which begin a type from the type following them
+var typePrefixes = map[string]bool{
+	"keyof": true, "typeof": true, "readonly": true, "infer": true,
+	"unique": true, "new": true, "asserts": true, "abstract": true,
+}
+
+// Strips the types from a TypeScript source, leaving JavaScript. This is
+// syntax removal alone, with no type checking. Annotations, type parameters
+// and arguments, assertions, interfaces, type aliases, `declare`s and overload
+// signatures are blanked out, so every line and column stays where it was.
+// Enums are compiled to objects, `import x = require()` to a `var`, and
+// imports only used as types are dropped, as `tsc` would. As with the rest of
+// the module, what's left needs to be ES5, other than `import` and `export`.
+func stripTypes(src []byte, path string) ([]byte, error) {
+	tokens, err := tokenize(string(src), path)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &typeStripper{
+		path:         path,
+		types:        make(map[string]bool),
+		replacements: make(map[int]string),
+		inserts:      make(map[int]string),
+		parameters:   make(map[int]int),
+	}
+	for i := range tokens {
+		if !tokens[i].trivia() {
+			ts.toks = append(ts.toks, &tokens[i])
+		}
+	}
+	ts.removed = make([]bool, len(ts.toks))
+
+	if err := ts.strip(); err != nil {
+		return nil, err
+	}
+	ts.elide()
+	return ts.apply(src), nil
+}
+
+type typeStripper struct {
+	path string
+	toks []*token
+
+	// Tokens blanked out, or replaced by the text given
+	removed      []bool
+	replacements map[int]string
+
+	// Text written after a token
+	inserts map[int]string
+
+	// The lists of annotated bindings being stripped, innermost last
+	contexts []tsContext
+
+	// The `(` of each function's parameters, giving the first token of the
+	// function's declaration, or -1 for an expression
+	parameters map[int]int
+
+	// Names declared as types alone
+	types map[string]bool
+
+	imports []tsImport
+
+	// The specifiers of each `export {}`, to be dropped if they're types
+	exports [][]tsSpecifier
+}
+
+// A list of parameters, or of the declarators of a `var`
+type tsContext struct {
+	// The depth of brackets within the list
+	depth int
+
+	params bool
+
+	// The closing `)` of parameters, and the first token of an overloadable
+	// function declaration, or -1
+	close int
+	start int
+}
+
+// An import, dropped if nothing it binds is used as a value
+type tsImport struct {
+	start, last int
+	bindings    []string
+}
+
+// A specifier of an import or export list, from its first token to its last
+type tsSpecifier struct {
+	local       string
+	first, last int
+}
+
+func (ts *typeStripper) errorAt(i int, reason string) error {
+	tok := ts.toks[len(ts.toks)-1]
+	if i < len(ts.toks) {
+		tok = ts.toks[i]
+	}
+	return &lexError{ts.path, tok.line, tok.col, reason}
+}
+
+func (ts *typeStripper) is(i int, kind tokenKind, text string) bool {
+	return i >= 0 && i < len(ts.toks) && ts.toks[i].is(kind, text)
+}
+
+func (ts *typeStripper) punct(i int, text string) bool {
+	return ts.is(i, tokPunctuator, text)
+}
+
+func (ts *typeStripper) keyword(i int, text string) bool {
+	return ts.is(i, tokIdentifier, text)
+}
+
+func (ts *typeStripper) identifier(i int) bool {
+	return i >= 0 && i < len(ts.toks) && ts.toks[i].kind == tokIdentifier
+}
+
+// Blanks out tokens `from` through `to` inclusive
+func (ts *typeStripper) remove(from, to int) {
+	for i := from; i <= to && i < len(ts.toks); i++ {
+		ts.removed[i] = true
+	}
+}
+
+// Replaces tokens `from` through `to` inclusive with `text`
+func (ts *typeStripper) replace(from, to int, text string) {
+	ts.remove(from, to)
+	ts.replacements[from] = text
+}
+
+// The last token before `i` which hasn't been removed, or -1
+func (ts *typeStripper) previous(i int) int {
+	for i--; i >= 0 && ts.removed[i]; i-- {
+	}
+	return i
+}
+
+// Whether token `i` starts a statement, as far as can be told without a
+// parser
+func (ts *typeStripper) statementAt(i int) bool {
+	return i == 0 || ts.punct(i-1, ";") || ts.punct(i-1, "{") ||
+		ts.punct(i-1, "}") || ts.toks[i].newline
+}
+
+// Whether token `i` can end an expression, so that what follows it continues
+// the expression rather than starting one
+func (ts *typeStripper) expressionEnds(i int) bool {
+	if i < 0 {
+		return false
+	}
+	tok := ts.toks[i]
+	switch tok.kind {
+	case tokIdentifier:
+		switch tok.text {
+		case "this", "super", "null", "true", "false":
+			return true
+		}
+		return !reservedWords[tok.text] && !regExpKeywords[tok.text]
+	case tokPunctuator:
+		return tok.text == ")" || tok.text == "]" || tok.text == "}"
+	}
+	return true
+}
+
+// Finds the bracket closing the one at token `i`, or -1. Angle brackets close
+// with `>>` and `>>>` too, and give up at anything which can't be in a type,
+// including brackets closing what they didn't open.
+func (ts *typeStripper) match(i int) int {
+	open := ts.toks[i].text
+	close := map[string]string{"(": ")", "[": "]", "{": "}", "<": ">"}[open]
+	depth, inner := 0, 0
+	for j := i; j < len(ts.toks); j++ {
+		tok := ts.toks[j]
+		if tok.kind != tokPunctuator {
+			continue
+		}
+		if open != "<" {
+			switch tok.text {
+			case open:
+				depth++
+			case close:
+				if depth--; depth == 0 {
+					return j
+				}
+			}
+			continue
+		}
+
+		switch tok.text {
+		case "<":
+			depth++
+		case ">", ">>", ">>>":
+			if depth -= len(tok.text); depth <= 0 {
+				return j
+			}
+		case "(", "[", "{":
+			inner++
+		case ")", "]", "}":
+			if inner--; inner < 0 {
+				return -1
+			}
+		case ";":
+			if inner == 0 {
+				return -1
+			}
+		case ",", ".", "|", "&", ":", "?", "=>", "...", "-", "=":
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// Finds the end of the type starting at token `i`, giving the index of the
+// first token after it
+func (ts *typeStripper) skipType(i int) int {
+	operand := true
+	extends, conditional := 0, 0
+	for ; i < len(ts.toks); i++ {
+		tok := ts.toks[i]
+		if !operand && tok.newline && !(tok.kind == tokPunctuator &&
+			strings.Contains("|&.?:", tok.text)) {
+			return i
+		}
+
+		switch tok.kind {
+		case tokPunctuator:
+			switch tok.text {
+			case "(", "[", "{":
+				if !operand && tok.text != "[" {
+					return i
+				}
+				end := ts.match(i)
+				if end < 0 {
+					return len(ts.toks)
+				}
+				if operand && tok.text == "(" && ts.punct(end+1, "=>") {
+					// A function type
+					i = end + 1
+					continue
+				}
+				i, operand = end, false
+			case "<":
+				end := ts.match(i)
+				if end < 0 {
+					return i
+				}
+				i = end
+			case "|", "&", ".", "...":
+				operand = true
+			case "-":
+				if !operand {
+					return i
+				}
+			case "?":
+				if operand || extends == 0 {
+					return i
+				}
+				extends, conditional, operand = extends-1, conditional+1, true
+			case ":":
+				if conditional == 0 {
+					return i
+				}
+				conditional, operand = conditional-1, true
+			default:
+				return i
+			}
+
+		case tokIdentifier:
+			if !operand {
+				switch tok.text {
+				case "extends":
+					extends++
+				case "is":
+				default:
+					return i
+				}
+				operand = true
+				continue
+			}
+			if typePrefixes[tok.text] && ts.typeStarts(i+1) {
+				continue
+			}
+			operand = false
+
+		case tokString, tokNumber, tokTemplate:
+			if !operand {
+				return i
+			}
+			operand = false
+
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// Whether a type can start at token `i`
+func (ts *typeStripper) typeStarts(i int) bool {
+	if i >= len(ts.toks) || ts.toks[i].newline {
+		return false
+	}
+	switch tok := ts.toks[i]; tok.kind {
+	case tokIdentifier, tokString, tokNumber, tokTemplate:
+		return true
+	case tokPunctuator:
+		return strings.Contains("([{<-", tok.text)
+	}
+	return false
+}
+
+// Finds the end of the statement starting at token `i`, giving its last token.
+// As with `declaredNames`, this is the first `;`, or line break which can't be
+// continuing the statement, outside of any brackets.
+func (ts *typeStripper) statementEnd(i int) int {
+	depth := 0
+	for j := i + 1; j < len(ts.toks); j++ {
+		tok := ts.toks[j]
+		if depth == 0 && (tok.is(tokPunctuator, ";")) {
+			return j
+		}
+		if depth == 0 && tok.newline && lineBreakSignificant(ts.toks[j-1], tok) {
+			return j - 1
+		}
+		switch {
+		case tok.kind == tokPunctuator && strings.Contains("({[", tok.text):
+			depth++
+		case tok.kind == tokPunctuator && strings.Contains(")}]", tok.text):
+			if depth--; depth < 0 {
+				return j - 1
+			}
+		}
+	}
+	return len(ts.toks) - 1
+}
+
+func (ts *typeStripper) strip() error {
+	depth := 0
+	for i := 0; i < len(ts.toks); i++ {
+		if ts.removed[i] {
+			continue
+		}
+		tok := ts.toks[i]
+
+		if tok.kind == tokPunctuator {
+			switch tok.text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+		}
+
+		// The end of a list of parameters or declarators
+		if n := len(ts.contexts); n > 0 {
+			c := ts.contexts[n-1]
+			switch {
+			case c.params && i == c.close:
+				ts.contexts = ts.contexts[:n-1]
+				i = ts.returnType(i, c.start)
+				continue
+			case !c.params && (depth < c.depth || depth == c.depth &&
+				(tok.is(tokPunctuator, ";") || tok.newline &&
+					lineBreakSignificant(ts.toks[ts.previous(i)], tok))):
+				ts.contexts = ts.contexts[:n-1]
+			}
+		}
+
+		if tok.kind == tokIdentifier && ts.statementAt(i) {
+			last, ok, err := ts.declaration(i)
+			if err != nil {
+				return err
+			}
+			if ok {
+				i = last
+				continue
+			}
+		}
+
+		prev := ts.previous(i)
+		switch {
+		case tok.is(tokPunctuator, "("):
+			if start, ok := ts.parameterList(i); ok {
+				ts.contexts = append(ts.contexts,
+					tsContext{depth: depth, params: true, close: ts.match(i),
+						start: start})
+				i = ts.head(i+1, true)
+			}
+
+		case tok.is(tokPunctuator, ","):
+			if n := len(ts.contexts); n > 0 && ts.contexts[n-1].depth == depth {
+				i = ts.head(i+1, ts.contexts[n-1].params)
+			}
+
+		case tok.is(tokIdentifier, "function") && !ts.punct(prev, "."):
+			i = ts.function(i)
+
+		case tok.is(tokIdentifier, "catch") && ts.punct(i+1, "("):
+			ts.parameters[i+1] = -1
+
+		case (tok.is(tokIdentifier, "var") || tok.is(tokIdentifier, "let") ||
+			tok.is(tokIdentifier, "const")) && !ts.punct(prev, "."):
+			ts.contexts = append(ts.contexts, tsContext{depth: depth})
+			i = ts.head(i+1, false)
+
+		case (tok.is(tokIdentifier, "as") || tok.is(tokIdentifier, "satisfies")) &&
+			!tok.newline && ts.expressionEnds(prev):
+			// x as T
+			end := ts.skipType(i + 1)
+			ts.remove(i, end-1)
+			i = end - 1
+
+		case tok.is(tokPunctuator, "!") && !tok.newline && ts.expressionEnds(prev):
+			// A non-null assertion, x!
+			ts.remove(i, i)
+
+		case tok.is(tokPunctuator, "<"):
+			end := ts.match(i)
+			if end < 0 {
+				break
+			}
+			if !ts.expressionEnds(prev) ||
+				ts.identifier(prev) && ts.typeArguments(i, end) {
+				// A type assertion, <T>x, type parameters of an arrow function,
+				// or type arguments, f<T>()
+				ts.remove(i, end)
+				i = end
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the angle brackets from token `open` to `close` give the type
+// arguments of a call
+func (ts *typeStripper) typeArguments(open, close int) bool {
+	next := close + 1
+	return ts.punct(next, "(") ||
+		next < len(ts.toks) && ts.toks[next].kind == tokTemplate
+}
+
+// Strips the type parameters of the function whose `function` keyword is token
+// `i`, and notes where its parameters are
+func (ts *typeStripper) function(i int) int {
+	// Only a declaration can be overloaded
+	start := -1
+	switch {
+	case ts.statementAt(i):
+		start = i
+	case ts.keyword(i-1, "export") && ts.statementAt(i-1):
+		start = i - 1
+	}
+
+	j := i + 1
+	if ts.punct(j, "*") {
+		j++
+	}
+	if ts.identifier(j) {
+		j++
+	}
+	if ts.punct(j, "<") {
+		if end := ts.match(j); end > 0 {
+			ts.remove(j, end)
+			j = end + 1
+		}
+	}
+	if ts.punct(j, "(") {
+		ts.parameters[j] = start
+	}
+	return j - 1
+}
+
+// Whether the `(` at token `i` opens parameters, either of a function or of an
+// arrow function. Also gives the first token of an overloadable declaration.
+func (ts *typeStripper) parameterList(i int) (int, bool) {
+	if start, ok := ts.parameters[i]; ok {
+		return start, true
+	}
+	prev := ts.previous(i)
+	if ts.identifier(prev) && ts.expressionEnds(prev) &&
+		!ts.keyword(prev, "async") {
+		// A call
+		return 0, false
+	}
+	close := ts.match(i)
+	if close < 0 {
+		return 0, false
+	}
+	if ts.punct(close+1, "=>") ||
+		ts.punct(close+1, ":") && ts.punct(ts.skipType(close+2), "=>") {
+		return -1, true
+	}
+	return 0, false
+}
+
+// Strips the annotation of the parameter or declarator starting at token `i`,
+// giving the index of the last token of its binding
+func (ts *typeStripper) head(i int, params bool) int {
+	if params {
+		if ts.identifier(i) && parameterModifiers[ts.toks[i].text] &&
+			(ts.identifier(i+1) || ts.punct(i+1, "{") || ts.punct(i+1, "[")) {
+			ts.remove(i, i)
+			i++
+		}
+		if ts.keyword(i, "this") && ts.punct(i+1, ":") {
+			// function (this: T, a) {}
+			end := ts.skipType(i + 2)
+			if !ts.punct(end, ",") {
+				ts.remove(i, end-1)
+				return end - 1
+			}
+			ts.remove(i, end)
+			return ts.head(end+1, params)
+		}
+		if ts.punct(i, "...") {
+			i++
+		}
+	}
+
+	switch {
+	case ts.identifier(i):
+		i++
+	case ts.punct(i, "{"), ts.punct(i, "["):
+		end := ts.match(i)
+		if end < 0 {
+			return i - 1
+		}
+		i = end + 1
+	default:
+		return i - 1
+	}
+
+	// An optional parameter, a?: T, or a definite assignment, x!: T
+	if params && ts.punct(i, "?") || !params && ts.punct(i, "!") {
+		ts.remove(i, i)
+		i++
+	}
+	if ts.punct(i, ":") {
+		end := ts.skipType(i + 1)
+		ts.remove(i, end-1)
+		i = end
+	}
+	return i - 1
+}
+
+// Strips the return type following the parameters closed at token `close`. A
+// function declaration without a body is the signature of an overload, which
+// is removed entirely.
+func (ts *typeStripper) returnType(close, start int) int {
+	i := close + 1
+	if ts.punct(i, ":") {
+		end := ts.skipType(i + 1)
+		ts.remove(i, end-1)
+		i = end
+	}
+	if start >= 0 && !ts.punct(i, "{") {
+		last := i - 1
+		if ts.punct(i, ";") {
+			last = i
+		}
+		ts.remove(start, last)
+		return last
+	}
+	return close
+}
+
+// Strips or rewrites the declaration starting at token `start`, if it's one
+// only TypeScript has, giving its last token
+func (ts *typeStripper) declaration(start int) (int, bool, error) {
+	i := start
+	switch {
+	case ts.keyword(i, "import"):
+		last, ok := ts.importDeclaration(i)
+		return last, ok, nil
+
+	case ts.keyword(i, "export"):
+		i++
+		switch {
+		case ts.keyword(i, "type") && (ts.punct(i+1, "{") || ts.punct(i+1, "*")):
+			// export type {T}
+			last := ts.statementEnd(i)
+			ts.remove(start, last)
+			return last, true, nil
+		case ts.punct(i, "="):
+			// export = x
+			ts.replace(start, start, "module.exports")
+			return start, true, nil
+		case ts.punct(i, "{"):
+			return ts.exportList(i), true, nil
+		case ts.keyword(i, "default"):
+			i++
+		}
+	}
+
+	switch {
+	case ts.keyword(i, "declare") && ts.identifier(i+1) && !ts.toks[i+1].newline:
+		last := ts.statementEnd(i)
+		ts.remove(start, last)
+		return last, true, nil
+
+	case ts.keyword(i, "interface") && ts.identifier(i+1):
+		ts.types[ts.toks[i+1].text] = true
+		j := i + 2
+		for j < len(ts.toks) && !ts.punct(j, "{") {
+			if ts.punct(j, "<") {
+				if end := ts.match(j); end > 0 {
+					j = end
+				}
+			}
+			j++
+		}
+		if j == len(ts.toks) {
+			return 0, false, ts.errorAt(i, "expected the body of the interface")
+		}
+		last := ts.match(j)
+		if last < 0 {
+			return 0, false, ts.errorAt(j, "unterminated interface")
+		}
+		if ts.punct(last+1, ";") {
+			last++
+		}
+		ts.remove(start, last)
+		return last, true, nil
+
+	case ts.keyword(i, "type") && ts.identifier(i+1) &&
+		!ts.toks[i+1].newline && (ts.punct(i+2, "=") || ts.punct(i+2, "<")):
+		// type T = ...
+		ts.types[ts.toks[i+1].text] = true
+		j := i + 2
+		if ts.punct(j, "<") {
+			if j = ts.match(j) + 1; j == 0 {
+				return 0, false, ts.errorAt(i+2, "unterminated type parameters")
+			}
+		}
+		if !ts.punct(j, "=") {
+			return 0, false, ts.errorAt(j, "expected '='")
+		}
+		last := ts.skipType(j+1) - 1
+		if ts.punct(last+1, ";") {
+			last++
+		}
+		ts.remove(start, last)
+		return last, true, nil
+
+	case ts.keyword(i, "enum") && ts.identifier(i+1),
+		ts.keyword(i, "const") && ts.keyword(i+1, "enum"):
+		last, err := ts.enum(i)
+		return last, err == nil, err
+	}
+	return 0, false, nil
+}
+
+// Strips an `import` at token `start` of its types. Imports of types alone
+// are removed, as are those found to only be used as types by `elide`.
+func (ts *typeStripper) importDeclaration(start int) (int, bool) {
+	i := start + 1
+	if ts.punct(i, "(") || ts.punct(i, ".") {
+		return 0, false
+	}
+
+	if ts.keyword(i, "type") && (ts.punct(i+1, "{") || ts.punct(i+1, "*") ||
+		ts.identifier(i+1) && !ts.keyword(i+1, "from")) {
+		// import type {T} from 'spec'
+		last := ts.statementEnd(i)
+		ts.remove(start, last)
+		return last, true
+	}
+	if ts.identifier(i) && ts.punct(i+1, "=") {
+		// import x = require('spec')
+		ts.replace(start, start, "var")
+		return start, true
+	}
+
+	imp := tsImport{start: start}
+	if ts.identifier(i) && !ts.keyword(i, "from") ||
+		ts.keyword(i, "from") && ts.keyword(i+1, "from") {
+		imp.bindings = append(imp.bindings, ts.toks[i].text)
+		if i++; ts.punct(i, ",") {
+			i++
+		}
+	}
+	switch {
+	case ts.punct(i, "*") && ts.keyword(i+1, "as") && ts.identifier(i+2):
+		imp.bindings = append(imp.bindings, ts.toks[i+2].text)
+		i += 3
+	case ts.punct(i, "{"):
+		specs, close := ts.specifiers(i)
+		if specs == nil && close < 0 {
+			return 0, false
+		}
+		for _, spec := range specs {
+			imp.bindings = append(imp.bindings, spec.local)
+		}
+		if len(imp.bindings) == 0 && close > i+1 {
+			// Every specifier was of a type
+			imp.bindings = []string{}
+		}
+		i = close + 1
+	}
+
+	if !ts.keyword(i, "from") || i+1 >= len(ts.toks) ||
+		ts.toks[i+1].kind != tokString {
+		// import 'spec', or something the lowering can report on
+		return i, true
+	}
+	imp.last = i + 1
+	if ts.punct(imp.last+1, ";") {
+		imp.last++
+	}
+	if imp.bindings != nil {
+		ts.imports = append(ts.imports, imp)
+	}
+	return imp.last, true
+}
+
+// Strips the types from an `export {}` at token `open`. Those exported by
+// name are only known once the whole module has been read, so are left to
+// `elide`.
+func (ts *typeStripper) exportList(open int) int {
+	specs, close := ts.specifiers(open)
+	if close < 0 {
+		return open
+	}
+	if !ts.keyword(close+1, "from") {
+		ts.exports = append(ts.exports, specs)
+	}
+	return close
+}
+
+// Parses `{a, type B, c as d}`, removing specifiers of types, and giving
+// those left along with the index of the closing brace, or -1
+func (ts *typeStripper) specifiers(open int) ([]tsSpecifier, int) {
+	var specs []tsSpecifier
+	i := open + 1
+	for ; !ts.punct(i, "}"); i++ {
+		if !ts.identifier(i) {
+			return nil, -1
+		}
+		typeOnly := ts.keyword(i, "type") && ts.identifier(i+1) &&
+			!(ts.keyword(i+1, "as") && !ts.identifier(i+2))
+		first := i
+		if typeOnly {
+			i++
+		}
+		spec := tsSpecifier{local: ts.toks[i].text, first: first}
+		if ts.keyword(i+1, "as") && ts.identifier(i+2) {
+			i += 2
+			spec.local = ts.toks[i].text
+		}
+		spec.last = i
+		if typeOnly {
+			ts.removeSpecifier(spec)
+		} else {
+			specs = append(specs, spec)
+		}
+
+		if ts.punct(i+1, ",") {
+			i++
+		} else if !ts.punct(i+1, "}") {
+			return nil, -1
+		}
+	}
+	return specs, i
+}
+
+// Removes a specifier from its list, along with the comma separating it from
+// the next, or else the last
+func (ts *typeStripper) removeSpecifier(spec tsSpecifier) {
+	first, last := spec.first, spec.last
+	if ts.punct(last+1, ",") {
+		last++
+	} else if prev := ts.previous(first); ts.punct(prev, ",") {
+		first = prev
+	}
+	ts.remove(first, last)
+}
+
+// Compiles the enum at token `i` to an object, as `tsc` does, member by member
+// so that each stays on its line
+func (ts *typeStripper) enum(i int) (int, error) {
+	if ts.keyword(i, "const") {
+		// Const enums are compiled like any other, rather than inlined
+		i++
+	}
+	name := ts.toks[i+1].text
+	open := i + 2
+	if !ts.punct(open, "{") {
+		return 0, ts.errorAt(open, "expected '{'")
+	}
+	close := ts.match(open)
+	if close < 0 {
+		return 0, ts.errorAt(open, "unterminated enum")
+	}
+	ts.replace(ts.previousOrSelf(i), open,
+		"var "+name+"; (function ("+name+") {")
+
+	next := "0"
+	for j := open + 1; j < close; {
+		var key string
+		switch tok := ts.toks[j]; tok.kind {
+		case tokIdentifier:
+			key = strconv.Quote(tok.text)
+		case tokString:
+			key = tok.text
+		default:
+			return 0, ts.errorAt(j, "expected an enum member")
+		}
+		member := name + "[" + key + "]"
+
+		end := j + 1
+		var closing string
+		if ts.punct(end, "=") {
+			// The end of the initializer
+			depth := 0
+			for end++; end < close; end++ {
+				if ts.punct(end, ",") && depth == 0 {
+					break
+				}
+				switch {
+				case ts.punct(end, "("), ts.punct(end, "["), ts.punct(end, "{"):
+					depth++
+				case ts.punct(end, ")"), ts.punct(end, "]"), ts.punct(end, "}"):
+					depth--
+				}
+			}
+			value := ts.toks[j+2 : end]
+			if len(value) == 1 && (value[0].kind == tokString ||
+				value[0].kind == tokTemplate) {
+				// A string member, which isn't mapped back to its name
+				ts.replace(j, j+1, member+" =")
+				closing = ";"
+				next = ""
+			} else {
+				ts.replace(j, j+1, name+"["+member+" =")
+				closing = "] = " + key + ";"
+				if n, ok := enumNumber(value); ok {
+					next = strconv.FormatFloat(n+1, 'f', -1, 64)
+				} else {
+					next = member + " + 1"
+				}
+			}
+		} else {
+			if next == "" {
+				return 0, ts.errorAt(j, "enum member must have an initializer")
+			}
+			ts.replace(j, j, name+"["+member+" = "+next+"] = "+key+";")
+			if n, err := strconv.ParseFloat(next, 64); err == nil {
+				next = strconv.FormatFloat(n+1, 'f', -1, 64)
+			} else {
+				next = member + " + 1"
+			}
+		}
+
+		if closing != "" {
+			ts.inserts[end-1] += closing
+		}
+		if ts.punct(end, ",") {
+			ts.remove(end, end)
+			end++
+		}
+		j = end
+	}
+
+	ts.replace(close, close, "})("+name+" || ("+name+" = {}));")
+	if ts.punct(close+1, ";") {
+		ts.remove(close+1, close+1)
+		return close + 1, nil
+	}
+	return close, nil
+}
+
+// The `const` of a `const enum` starting at token `i`, which goes with it
+func (ts *typeStripper) previousOrSelf(i int) int {
+	if ts.keyword(i-1, "const") {
+		return i - 1
+	}
+	return i
+}
+
+// The value of an enum member's initializer, if it's a number
+func enumNumber(value []*token) (float64, bool) {
+	sign := 1.0
+	if len(value) == 2 && value[0].is(tokPunctuator, "-") {
+		sign, value = -1, value[1:]
+	}
+	if len(value) != 1 || value[0].kind != tokNumber {
+		return 0, false
+	}
+	text := value[0].text
+	if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+		return sign * float64(n), true
+	}
+	if n, err := strconv.ParseFloat(text, 64); err == nil {
+		return sign * n, true
+	}
+	return 0, false
+}
+
+// Drops the imports whose bindings are only used as types, which `tsc` would
+// elide, and the exports of names which are only types
+func (ts *typeStripper) elide() {
+	inImport := make([]bool, len(ts.toks))
+	for _, imp := range ts.imports {
+		for i := imp.start; i <= imp.last; i++ {
+			inImport[i] = true
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, tok := range ts.toks {
+		if ts.removed[i] || inImport[i] || tok.kind != tokIdentifier {
+			continue
+		}
+		if prev := ts.previous(i); ts.punct(prev, ".") || ts.punct(prev, "?.") {
+			continue
+		}
+		used[tok.text] = true
+	}
+
+	for _, imp := range ts.imports {
+		keep := false
+		for _, binding := range imp.bindings {
+			keep = keep || used[binding]
+		}
+		if !keep {
+			ts.remove(imp.start, imp.last)
+		}
+	}
+
+	for _, specs := range ts.exports {
+		for _, spec := range specs {
+			if ts.types[ts.toks[spec.first].text] {
+				ts.removeSpecifier(spec)
+			}
+		}
+	}
+}
+
+// Writes out the stripped source, blanking out each token removed, so that
+// everything else stays where it was
+func (ts *typeStripper) apply(src []byte) []byte {
+	out := &bytes.Buffer{}
+	pos := 0
+	for i, tok := range ts.toks {
+		text, replaced := ts.replacements[i]
+		insert := ts.inserts[i]
+		if !ts.removed[i] && insert == "" {
+			continue
+		}
+		out.Write(src[pos:tok.offset])
+		switch {
+		case replaced:
+			out.WriteString(text)
+			for _, r := range tok.text {
+				if isLineTerminator(r) {
+					out.WriteRune(r)
+				}
+			}
+		case ts.removed[i]:
+			for _, r := range tok.text {
+				if isLineTerminator(r) {
+					out.WriteRune(r)
+				} else {
+					out.WriteByte(' ')
+				}
+			}
+		default:
+			out.WriteString(tok.text)
+		}
+		out.WriteString(insert)
+		pos = tok.offset + len(tok.text)
+	}
+	out.Write(src[pos:])
+	return out.Bytes()
+}
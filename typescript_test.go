@@ -0,0 +1,154 @@
+package jssquish
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TypeScript", func() {
+
+	// Strips a source, giving what's left with its spacing collapsed
+	strip := func(src string) string {
+		out, err := stripTypes([]byte(src), "app.ts")
+		Expect(err).ToNot(HaveOccurred())
+		return strings.Join(strings.Fields(string(out)), " ")
+	}
+
+	It("should strip annotations", func() {
+		Expect(strip(`var a: number = 1, b: Array<string>, c!: {x: T}`)).
+			To(Equal(`var a = 1, b , c`))
+		Expect(strip(`function f<T>(a: T, b?: string, ...c: T[]): T | null {}`)).
+			To(Equal(`function f (a , b , ...c ) {}`))
+		Expect(strip(`var f = function (this: Window, a: (x: number) => void) {}`)).
+			To(Equal(`var f = function ( a ) {}`))
+		Expect(strip(`function is(x: any): x is string { return true }`)).
+			To(Equal(`function is(x ) { return true }`))
+		Expect(strip(`var f = (a: number, b = {x: 1}): string => a`)).
+			To(Equal(`var f = (a , b = {x: 1}) => a`))
+		Expect(strip(`try {} catch (e: unknown) {}`)).
+			To(Equal(`try {} catch (e ) {}`))
+	})
+
+	It("should leave JavaScript which looks like types alone", func() {
+		src := "var o = {a: 1, b: c ? d : e}; f(a, b); if (a < b && c > d) g()\n" +
+			"label: for (var i = 0, n = x.length; i < n; i++) x[i]!= y"
+		Expect(strip(src)).To(Equal(strings.Join(strings.Fields(src), " ")))
+	})
+
+	It("should strip assertions", func() {
+		Expect(strip(`var a = b as unknown as string, c = <T>d, e = f!.g`)).
+			To(Equal(`var a = b , c = d, e = f .g`))
+		Expect(strip(`g(h as const); k<string, number>(1); new M<T>()`)).
+			To(Equal(`g(h ); k (1); new M ()`))
+	})
+
+	It("should remove declarations of types", func() {
+		Expect(strip("interface A<T> extends B<T> {\n  a: T;\n}\n" +
+			"export interface C { c(): void }\n" +
+			"type D<T> = T extends string ? 'a' : {d: T}[];\n" +
+			"export type E =\n  | 'a'\n  | 'b'\n" +
+			"declare var process: any\n" +
+			"declare module 'x' { export var y: number }\n" +
+			"var type = 1")).To(Equal("var type = 1"))
+	})
+
+	It("should remove overload signatures", func() {
+		Expect(strip("function f(a: string): string;\n" +
+			"export function f(a: number): number;\n" +
+			"export function f(a: any): any { return a }")).
+			To(Equal("export function f(a ) { return a }"))
+	})
+
+	It("should remove imports and exports of types", func() {
+		Expect(strip("import type {A} from './a';\n" +
+			"import {type B, C} from './b';\n" +
+			"import D, {E} from './d';\n" +
+			"import * as F from './f';\n" +
+			"import './g';\n" +
+			"import H = require('./h');\n" +
+			"interface I {}\n" +
+			"var x: D = C(H), y: E;\n" +
+			"export type {I};\n" +
+			"export {I, x, type E};\n" +
+			"export {C, type B} from './b'")).To(Equal(
+			"import { C} from './b'; " +
+				"import './g'; " +
+				"var H = require('./h'); " +
+				"var x = C(H), y ; " +
+				"export { x }; " +
+				"export {C } from './b'"))
+	})
+
+	It("should compile enums to objects", func() {
+		Expect(strip("export enum E {\n  A,\n  B = 4,\n  C,\n  D = 'd',\n}")).
+			To(Equal(`export var E; (function (E) {` +
+				` E[E["A"] = 0] = "A";` +
+				` E[E["B"] = 4] = "B";` +
+				` E[E["C"] = 5] = "C";` +
+				` E["D"] = 'd';` +
+				` })(E || (E = {}));`))
+		Expect(strip(`const enum F { A = 1 << 2, B }`)).
+			To(Equal(`var F; (function (F) {` +
+				` F[F["A"] = 1 << 2] = "A";` +
+				` F[F["B"] = F["A"] + 1] = "B"; })(F || (F = {}));`))
+
+		_, err := stripTypes([]byte("enum G {\n  A = 'a',\n  B\n}"), "app.ts")
+		Expect(err).To(MatchError("app.ts:3:3: enum member must have an initializer"))
+	})
+
+	It("should keep every line and column where it was", func() {
+		src := "var a: {\n  b: number\n} = {b: 1}\nfunction f(x?: T): void {\n  g(x)\n}"
+		out, err := stripTypes([]byte(src), "app.ts")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(HaveLen(len(src)))
+		Expect(strings.Split(string(out), "\n")[4]).To(Equal("  g(x)"))
+		Expect(strings.Index(string(out), "= {b: 1}")).
+			To(Equal(strings.Index(src, "= {b: 1}")))
+	})
+
+	It("should tell type parameters from elements in .tsx files", func() {
+		src := "var f = <T,>(x: T) => x, g = <T extends {}>(x: T) => x"
+		out, err := compileJSX([]byte(src), "app.tsx", JSXOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(out)).To(Equal(src))
+		out, err = stripTypes(out, "app.tsx")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Join(strings.Fields(string(out)), " ")).
+			To(Equal("var f = (x ) => x, g = (x ) => x"))
+	})
+
+	It("should bundle .ts and .tsx files", func() {
+		files := map[string]string{
+			"index.ts": "import {Shape, area} from './shape';\n" +
+				"import view from './view';\n" +
+				"var square: Shape = {kind: 'square', size: 3};\n" +
+				"result = [area(square), view];",
+			"shape.ts": "export interface Shape { kind: 'square'; size: number }\n" +
+				"export enum Sides { Square = 4 }\n" +
+				"export function area(s: Shape): number {\n" +
+				"  return s.size * s.size * Sides.Square / (4 as number);\n}",
+			"view.tsx": "function h(t: string, p: any, c: string) { return t + c }\n" +
+				"export default <b>{'bold' as string}</b>;",
+		}
+		repo := memoryRepository(files)
+		defer repo.Close()
+		out := &bytes.Buffer{}
+		result, err := Build(repo, "index.ts", out, Options{
+			JSX: JSXOptions{Factory: "h"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(Equal([]string{"index.ts", "shape.ts",
+			"view.tsx"}))
+
+		vm := otto.New()
+		_, err = vm.Run(out.String())
+		Expect(err).ToNot(HaveOccurred())
+		value, err := vm.Run("result.join()")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value.String()).To(Equal("9,bbold"))
+	})
+})
@@ -0,0 +1,73 @@
+package jssquish
+
+import (
+	pth "path"
+	"sort"
+	"time"
+)
+
+// Polls the files a bundle was built from, and the directories holding them,
+// for changes. Watching directories catches files being added or removed,
+// which can change what a `require` resolves to. Only a `StatRepository` can
+// be watched; with any other, nothing ever changes.
+type FileWatcher struct {
+	repo   StatRepository
+	stamps map[string]fileStamp
+}
+
+// What's compared between polls
+type fileStamp struct {
+	exists  bool
+	modTime int64
+	size    int64
+}
+
+func NewFileWatcher(repo Repository, paths []string) *FileWatcher {
+	fw := &FileWatcher{stamps: make(map[string]fileStamp)}
+	statRepo, ok := repo.(StatRepository)
+	if !ok {
+		return fw
+	}
+	fw.repo = statRepo
+
+	for _, path := range paths {
+		for _, watched := range []string{path, pth.Dir(path)} {
+			if _, ok := fw.stamps[watched]; !ok {
+				fw.stamps[watched] = fw.stamp(watched)
+			}
+		}
+	}
+	return fw
+}
+
+func (fw *FileWatcher) stamp(path string) fileStamp {
+	fi, err := fw.repo.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{true, fi.ModTime().UnixNano(), fi.Size()}
+}
+
+// Checks every watched path, returning those which have changed since they
+// were last checked, in order.
+func (fw *FileWatcher) Changed() []string {
+	var changed []string
+	for path, old := range fw.stamps {
+		if stamp := fw.stamp(path); stamp != old {
+			fw.stamps[path] = stamp
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Polls every `interval` until something changes, returning what did
+func (fw *FileWatcher) Wait(interval time.Duration) []string {
+	for {
+		time.Sleep(interval)
+		if changed := fw.Changed(); len(changed) > 0 {
+			return changed
+		}
+	}
+}
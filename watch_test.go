@@ -0,0 +1,93 @@
+package jssquish
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watching", func() {
+
+	var (
+		root string
+		repo *DirRepository
+	)
+
+	write := func(path, contents string) {
+		path = filepath.Join(root, path)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+	}
+
+	build := func() (*BuildResult, error) {
+		return Build(repo, "index.js", &bytes.Buffer{}, Options{})
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "js-squish-watch")
+		Expect(err).ToNot(HaveOccurred())
+		write("index.js", "require('./lib/a')")
+		write("lib/a.js", "module.exports = 'a'")
+		write("unused.js", "")
+
+		repo, err = NewDirRepository(root, false)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("should say which files a build read", func() {
+		result, err := build()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(Equal([]string{"index.js", "lib/a.js"}))
+	})
+
+	It("should say which files a failed build read", func() {
+		write("lib/a.js", "require('./missing')")
+		result, err := build()
+		Expect(err).To(HaveOccurred())
+		Expect(result.Files).To(Equal([]string{"index.js", "lib/a.js"}))
+	})
+
+	It("should see files which were built from change", func() {
+		result, err := build()
+		Expect(err).ToNot(HaveOccurred())
+		watcher := NewFileWatcher(repo, result.Files)
+		Expect(watcher.Changed()).To(BeEmpty())
+
+		write("unused.js", "changed")
+		Expect(watcher.Changed()).To(BeEmpty())
+
+		write("lib/a.js", "module.exports = 'changed'")
+		Expect(watcher.Changed()).To(Equal([]string{"lib/a.js"}))
+		Expect(watcher.Changed()).To(BeEmpty())
+	})
+
+	It("should see files being added next to those built from", func() {
+		result, err := build()
+		Expect(err).ToNot(HaveOccurred())
+		watcher := NewFileWatcher(repo, result.Files)
+
+		// Directory times can be coarse, so make sure this one looks different
+		dir := filepath.Join(root, "lib")
+		Expect(os.Chtimes(dir, time.Unix(0, 0), time.Unix(0, 0))).To(Succeed())
+		Expect(watcher.Changed()).To(Equal([]string{"lib"}))
+
+		write("lib/b.js", "")
+		Expect(os.Chtimes(dir, time.Now(), time.Now())).To(Succeed())
+		Expect(watcher.Wait(time.Millisecond)).To(Equal([]string{"lib"}))
+	})
+
+	It("should see nothing change in a repository which can't", func() {
+		watcher := NewFileWatcher(MemoryRepository{}, []string{"index.js"})
+		Expect(watcher.Changed()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,166 @@
+package jssquish
+
+import (
+	"fmt"
+	"io/ioutil"
+	pth "path"
+	"strings"
+)
+
+// One require along a chain of them, from the module at `From` to the module
+// at `To`
+type RequireHop struct {
+	From      string
+	Specifier string
+	To        string
+
+	// Where the specifier is in `From`, counting from one. Columns are counted
+	// in UTF-16 code units. Both are zero if it couldn't be found.
+	Line, Column int
+}
+
+// Explains why a module is in a bundle, giving every shortest chain of requires
+// from the entrypoint to it, in the order the requires are made. The module is
+// given by its path, or failing that, as a require from the top level, so a
+// package can be given by name. The entrypoint itself is reached by one empty
+// chain.
+func RequireChains(repo Repository, entrypoint, target string,
+	opts Options) ([][]RequireHop, error) {
+
+	graph, err := DependencyGraph(repo, entrypoint, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]bool, len(graph.Nodes))
+	for _, node := range graph.Nodes {
+		nodes[node.Path] = true
+	}
+	if !nodes[target] {
+		resolved, err := NewResolverWithOptions(repo, opts).Resolve(target, ".")
+		if err != nil || !nodes[resolved] {
+			return nil, fmt.Errorf("%s isn't in the bundle", target)
+		}
+		target = resolved
+	}
+
+	// Work out how far each module is from the entrypoint, which is the first
+	// node, remembering each edge which is part of a shortest path to its module
+	root := graph.Nodes[0].Path
+	edges := make(map[string][]GraphEdge)
+	for _, edge := range graph.Edges {
+		edges[edge.From] = append(edges[edge.From], edge)
+	}
+	distance := map[string]int{root: 0}
+	shortest := make(map[string][]GraphEdge)
+	for queue := []string{root}; len(queue) > 0; queue = queue[1:] {
+		from := queue[0]
+		for _, edge := range edges[from] {
+			d, seen := distance[edge.To]
+			if !seen {
+				distance[edge.To] = distance[from] + 1
+				queue = append(queue, edge.To)
+			} else if d != distance[from]+1 {
+				continue
+			}
+			shortest[edge.To] = append(shortest[edge.To], edge)
+		}
+	}
+
+	// Walk back from the target along those edges
+	var chains [][]RequireHop
+	var walk func(path string, chain []RequireHop)
+	walk = func(path string, chain []RequireHop) {
+		if path == root {
+			reversed := make([]RequireHop, len(chain))
+			for i, hop := range chain {
+				reversed[len(chain)-1-i] = hop
+			}
+			chains = append(chains, reversed)
+			return
+		}
+		for _, edge := range shortest[path] {
+			hop := RequireHop{From: edge.From, Specifier: edge.Specifier,
+				To: edge.To}
+			walk(edge.From, append(chain[:len(chain):len(chain)], hop))
+		}
+	}
+	walk(target, []RequireHop{})
+
+	sources := make(map[string][]token)
+	for _, chain := range chains {
+		for i := range chain {
+			hop := &chain[i]
+			tokens, ok := sources[hop.From]
+			if !ok {
+				tokens = tokenizeFile(repo, hop.From)
+				sources[hop.From] = tokens
+			}
+			hop.Line, hop.Column = findSpecifier(tokens, hop.Specifier)
+		}
+	}
+	return chains, nil
+}
+
+// Reads and tokenizes a file, giving nothing if it can't be. JSX elements are
+// each one token, so the rest of a `.jsx` file is where it is in the source.
+// TypeScript's `<T>x` assertions would be taken for elements, so `.ts` files
+// are tokenized as plain JavaScript.
+func tokenizeFile(repo Repository, path string) []token {
+	r, err := repo.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	if strings.ToLower(pth.Ext(path)) == ".ts" {
+		tokens, _ := tokenize(string(src), path)
+		return tokens
+	}
+	tokens, _ := tokenizeJSX(string(src), path)
+	return tokens
+}
+
+// Finds where a specifier is first given to `require`, `import` or `export`,
+// giving its one-based line and column, or zeros if it isn't found
+func findSpecifier(tokens []token, specifier string) (int, int) {
+	var before, last *token
+	for i := range tokens {
+		tok := &tokens[i]
+		if tok.trivia() {
+			continue
+		}
+		if tok.kind == tokString && stringValue(tok.text) == specifier &&
+			specifierFollows(before, last) {
+			return tok.line + 1, tok.col + 1
+		}
+		before, last = last, tok
+	}
+	return 0, 0
+}
+
+// Whether a string following these two tokens is a module specifier, as in
+// `require('x')`, `import('x')`, `import 'x'`, or `... from 'x'`
+func specifierFollows(before, last *token) bool {
+	switch {
+	case last == nil:
+		return false
+	case last.is(tokIdentifier, "from") || last.is(tokIdentifier, "import"):
+		return true
+	case last.is(tokPunctuator, "(") && before != nil:
+		return before.is(tokIdentifier, "require") ||
+			before.is(tokIdentifier, "import")
+	}
+	return false
+}
+
+// The value of a string literal, for the simple strings specifiers are
+func stringValue(literal string) string {
+	if len(literal) < 2 {
+		return ""
+	}
+	return strings.Replace(literal[1:len(literal)-1], `\'`, `'`, -1)
+}
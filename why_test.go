@@ -0,0 +1,77 @@
+package jssquish
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Require chains", func() {
+
+	chains := func(files map[string]string, target string) ([][]RequireHop,
+		error) {
+
+		repo := memoryRepository(files)
+		defer repo.Close()
+		return RequireChains(repo, "index.js", target, Options{})
+	}
+
+	files := map[string]string{
+		"index.js":     "require('./a');\nrequire('./b');\nrequire('./far')",
+		"a.js":         "// a\n  var lib = require('lib')",
+		"b.js":         "import lib from 'lib'",
+		"far.js":       "require('./a')",
+		"lib/index.js": "require('./inner')",
+		"lib/inner.js": "",
+		"unrelated.js": "",
+	}
+
+	It("should give every shortest chain, with where each require is", func() {
+		found, err := chains(files, "lib/index.js")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([][]RequireHop{
+			{
+				{"index.js", "./a", "a.js", 1, 9},
+				{"a.js", "lib", "lib/index.js", 2, 21},
+			},
+			{
+				{"index.js", "./b", "b.js", 2, 9},
+				{"b.js", "lib", "lib/index.js", 1, 17},
+			},
+		}))
+	})
+
+	It("should find a module from a require", func() {
+		found, err := chains(files, "lib")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(HaveLen(2))
+
+		found, err = chains(files, "lib/inner.js")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found[0]).To(HaveLen(3))
+	})
+
+	It("should find requires after JSX", func() {
+		found, err := chains(map[string]string{
+			"index.js": "require('./view')",
+			"view.jsx": "var p = <p title=\"'\">it's {'<'}\n</p>;\n" +
+				"  var lib = require('./lib')",
+			"lib.js": "",
+		}, "lib.js")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([][]RequireHop{{
+			{"index.js", "./view", "view.jsx", 1, 9},
+			{"view.jsx", "./lib", "lib.js", 3, 21},
+		}}))
+	})
+
+	It("should reach the entrypoint by an empty chain", func() {
+		found, err := chains(files, "index.js")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([][]RequireHop{{}}))
+	})
+
+	It("should fail for a module not in the bundle", func() {
+		_, err := chains(files, "unrelated.js")
+		Expect(err).To(MatchError("unrelated.js isn't in the bundle"))
+	})
+})
@@ -0,0 +1,215 @@
+package jssquish
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// A request sent to a Bazel persistent worker. Only the fields js-squish needs
+// are decoded. See
+// https://github.com/bazelbuild/bazel/blob/master/src/main/protobuf/worker_protocol.proto
+type WorkRequest struct {
+	Arguments []string
+	Inputs    []WorkInput
+	RequestId int32
+}
+
+// An input of a work request, with a digest which changes whenever its
+// contents do
+type WorkInput struct {
+	Path   string
+	Digest []byte
+}
+
+type WorkResponse struct {
+	ExitCode  int32
+	Output    string
+	RequestId int32
+}
+
+// Replaces a lone `@file` argument with the arguments in that file, one per
+// line, which is how Bazel passes arguments to an action which can run as a
+// worker. An `@` anywhere else is left alone, as other arguments can start with
+// one too, such as the name of a scoped package.
+func ExpandArgFiles(args []string) ([]string, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "@") {
+		return args, nil
+	}
+	bs, err := ioutil.ReadFile(args[0][1:])
+	if err != nil {
+		return nil, err
+	}
+	var expanded []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		if line != "" {
+			expanded = append(expanded, line)
+		}
+	}
+	return expanded, nil
+}
+
+// Answers work requests read from `in` until it's closed, writing each response
+// to `out`. Requests are handled one at a time, in the order they arrive.
+func ServeWorker(in io.Reader, out io.Writer,
+	handle func(*WorkRequest) *WorkResponse) error {
+
+	r := bufio.NewReader(in)
+	for {
+		req, err := ReadWorkRequest(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp := handle(req)
+		resp.RequestId = req.RequestId
+		if err := WriteWorkResponse(out, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformed = errors.New("malformed work request")
+
+// Reads a work request, which is prefixed with its length as a varint
+func ReadWorkRequest(r *bufio.Reader) (*WorkRequest, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	req := &WorkRequest{}
+	err = eachField(msg, func(field int, value uint64, bs []byte) error {
+		switch field {
+		case 1:
+			req.Arguments = append(req.Arguments, string(bs))
+		case 2:
+			input := WorkInput{}
+			err := eachField(bs, func(field int, value uint64, bs []byte) error {
+				switch field {
+				case 1:
+					input.Path = string(bs)
+				case 2:
+					input.Digest = bs
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			req.Inputs = append(req.Inputs, input)
+		case 3:
+			req.RequestId = int32(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Calls `each` with every field of an encoded message. Varints are given as
+// `value`, and length-delimited fields as `bs`. Other fields are skipped.
+func eachField(msg []byte, each func(field int, value uint64,
+	bs []byte) error) error {
+
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errMalformed
+		}
+		msg = msg[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errMalformed
+			}
+			msg = msg[n:]
+			if err := each(field, value, nil); err != nil {
+				return err
+			}
+
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return errMalformed
+			}
+			bs := msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+			if err := each(field, 0, bs); err != nil {
+				return err
+			}
+
+		case wireFixed64:
+			if len(msg) < 8 {
+				return errMalformed
+			}
+			msg = msg[8:]
+
+		case wireFixed32:
+			if len(msg) < 4 {
+				return errMalformed
+			}
+			msg = msg[4:]
+
+		default:
+			return fmt.Errorf("unsupported wire type %d in work request", tag&7)
+		}
+	}
+	return nil
+}
+
+// Writes a work response, prefixed with its length
+func WriteWorkResponse(w io.Writer, resp *WorkResponse) error {
+	var msg []byte
+	if resp.ExitCode != 0 {
+		msg = appendVarintField(msg, 1, uint64(int64(resp.ExitCode)))
+	}
+	if resp.Output != "" {
+		msg = appendUvarint(msg, 2<<3|wireBytes)
+		msg = appendUvarint(msg, uint64(len(resp.Output)))
+		msg = append(msg, resp.Output...)
+	}
+	if resp.RequestId != 0 {
+		msg = appendVarintField(msg, 3, uint64(int64(resp.RequestId)))
+	}
+
+	out := appendUvarint(nil, uint64(len(msg)))
+	_, err := w.Write(append(out, msg...))
+	return err
+}
+
+// Appends a varint field. A negative `int32` is sign extended to 64 bits before
+// it gets here, as protocol buffers expect.
+func appendVarintField(msg []byte, field int, value uint64) []byte {
+	msg = appendUvarint(msg, uint64(field)<<3|wireVarint)
+	return appendUvarint(msg, value)
+}
+
+func appendUvarint(msg []byte, value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(msg, buf[:binary.PutUvarint(buf, value)]...)
+}
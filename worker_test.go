@@ -0,0 +1,156 @@
+package jssquish
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Encodes a work request as Bazel would, prefixed with its length
+func encodeWorkRequest(req *WorkRequest) []byte {
+	bytesField := func(msg []byte, field int, bs []byte) []byte {
+		msg = appendUvarint(msg, uint64(field)<<3|wireBytes)
+		msg = appendUvarint(msg, uint64(len(bs)))
+		return append(msg, bs...)
+	}
+
+	var msg []byte
+	for _, arg := range req.Arguments {
+		msg = bytesField(msg, 1, []byte(arg))
+	}
+	for _, input := range req.Inputs {
+		var in []byte
+		in = bytesField(in, 1, []byte(input.Path))
+		in = bytesField(in, 2, input.Digest)
+		msg = bytesField(msg, 2, in)
+	}
+	msg = appendVarintField(msg, 3, uint64(req.RequestId))
+
+	// A field from a newer protocol, which should be skipped
+	msg = appendVarintField(msg, 15, 1)
+
+	return append(appendUvarint(nil, uint64(len(msg))), msg...)
+}
+
+var _ = Describe("Persistent worker", func() {
+
+	It("should answer each request in turn", func() {
+		in := &bytes.Buffer{}
+		in.Write(encodeWorkRequest(&WorkRequest{
+			Arguments: []string{"-output", "a.js"},
+			Inputs:    []WorkInput{{"a.tar", []byte{1, 2, 3}}},
+			RequestId: 7,
+		}))
+		in.Write(encodeWorkRequest(&WorkRequest{Arguments: []string{"fail"}}))
+
+		var requests []*WorkRequest
+		out := &bytes.Buffer{}
+		err := ServeWorker(in, out, func(req *WorkRequest) *WorkResponse {
+			requests = append(requests, req)
+			if req.Arguments[0] == "fail" {
+				return &WorkResponse{ExitCode: -1, Output: "failed"}
+			}
+			return &WorkResponse{}
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].Arguments).To(Equal([]string{"-output", "a.js"}))
+		Expect(requests[0].Inputs).To(Equal(
+			[]WorkInput{{"a.tar", []byte{1, 2, 3}}}))
+
+		// The first response only echoes the request id. The second has a sign
+		// extended exit code, and its output.
+		r := bufio.NewReader(out)
+		var responses [][]byte
+		for {
+			size, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			msg := make([]byte, size)
+			_, err = io.ReadFull(r, msg)
+			Expect(err).ToNot(HaveOccurred())
+			responses = append(responses, msg)
+		}
+		Expect(responses).To(Equal([][]byte{
+			{3<<3 | wireVarint, 7},
+			append([]byte{1<<3 | wireVarint,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+				2<<3 | wireBytes, 6}, "failed"...),
+		}))
+	})
+
+	It("should reject a truncated request", func() {
+		msg := encodeWorkRequest(&WorkRequest{Arguments: []string{"-output"}})
+		msg[0]--
+		err := ServeWorker(bytes.NewReader(msg), &bytes.Buffer{},
+			func(*WorkRequest) *WorkResponse { return &WorkResponse{} })
+		Expect(err).To(Equal(errMalformed))
+	})
+
+	It("should expand only an argument file given alone", func() {
+		args := []string{"-max-package-size", "@babel/runtime=10KB",
+			"-entrypoint", "@scope/app"}
+		Expect(ExpandArgFiles(args)).To(Equal(args))
+
+		f, err := ioutil.TempFile("", "js-squish-args")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		defer f.Close()
+		_, err = f.WriteString(strings.Join(args, "\n") + "\n\n-minify\n")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ExpandArgFiles([]string{"@" + f.Name()})).To(Equal(
+			append(args, "-minify")))
+	})
+})
+
+var _ = Describe("ParseCache", func() {
+
+	It("should keep parsed modules between builds", func() {
+		files := map[string]string{
+			"index.js": "require('./lib')",
+			"lib.js":   "module.exports = 1",
+		}
+		cache := NewParseCache()
+		expected := squish(files, Options{Minify: true})
+
+		Expect(squish(files, Options{Minify: true, ParseCache: cache})).
+			To(Equal(expected))
+		Expect(cache.Len()).To(Equal(2))
+
+		key := cache.key([]byte(files["lib.js"]))
+		_, program, ok := cache.Get(key)
+		Expect(ok).To(BeTrue())
+		Expect(program).ToNot(BeNil())
+
+		Expect(squish(files, Options{Minify: true, ParseCache: cache})).
+			To(Equal(expected))
+		_, again, _ := cache.Get(key)
+		Expect(again).To(BeIdenticalTo(program))
+	})
+
+	It("should forget modules builds stop using", func() {
+		cache := NewParseCache()
+		cache.Put("a", &cachedModule{}, nil)
+		cache.Prune(1)
+		cache.Put("b", &cachedModule{}, nil)
+		cache.Prune(1)
+		Expect(cache.Len()).To(Equal(2))
+
+		cache.Get("b")
+		cache.Prune(1)
+		Expect(cache.Len()).To(Equal(1))
+		_, _, ok := cache.Get("b")
+		Expect(ok).To(BeTrue())
+	})
+})
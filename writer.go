@@ -1,11 +1,17 @@
 package jssquish
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"strings"
 	"text/template"
 
+	"github.com/robertkrimen/otto/ast"
+
 	"vistarmedia.com/tool/js-squish/file"
 )
 
@@ -23,16 +29,114 @@ var (
 		template.New("entry").Parse(string(preamble)),
 	)
 
+	// The hot module replacement runtime, which the preamble includes when asked
+	hotTemplate = template.Must(
+		preambleTemplate.New("hot").Parse(
+			string(file.MustAsset("tool/js-squish/hot.js"))),
+	)
+
 	postamble = `},{}, [0]);`
 )
 
+// The body of a module, ready to be written. Most come from a single source,
+// but a scope hoisted module is made up of several, in which case `origins`
+// gives the source and line each of its lines came from.
+type moduleBody struct {
+	src     []byte
+	program *ast.Program
+	sources []bodySource
+	origins []lineOrigin
+}
+
+type bodySource struct {
+	path string
+	src  []byte
+}
+
+type lineOrigin struct {
+	source, line int
+}
+
+// Where a module was written in a bundle
+type WrittenModule struct {
+	Id int
+
+	// The module's path. A scope hoisted module also holds those inlined into it.
+	Path string
+
+	// The byte offsets of the module's wrapper, from its id to the end of its
+	// imports. This slice of the bundle is a property of the object of modules
+	// given to the preamble.
+	Start, End int
+
+	// The size of the wrapper minified. When the bundle wasn't minified, this is
+	// only worked out if `Options.Stats` is set, and is zero otherwise.
+	Minified int
+}
+
+// A function generated code calls, which a bundle defines once, before any of
+// its modules
+type bundleHelper struct {
+	name, src string
+}
+
+// Every helper, in the order they're defined
+var bundleHelpers = []bundleHelper{
+	{jsxAssign, jsxAssignHelper},
+	{styleHelper, styleHelperSrc},
+}
+
 type Writer struct {
-	w           io.Writer
+	w           *positionWriter
 	firstModule bool
+	modules     []WrittenModule
+
+	// The names of the helpers modules call, which `Open` defines
+	helpers map[string]bool
+
+	minify       bool
+	measure      bool
+	hotURL       string
+	sourceMap    *sourceMap
+	sourceMapOut io.Writer
+	sourceMapURL string
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{w, true}
+	return NewWriterWithOptions(w, Options{})
+}
+
+// Creates a `Writer` which minifies and writes a source map as the given
+// options ask. The environment is given to `OpenWithEnvironment` instead.
+func NewWriterWithOptions(w io.Writer, opts Options) *Writer {
+	writer := &Writer{
+		w:            &positionWriter{w: w},
+		firstModule:  true,
+		minify:       opts.Minify,
+		measure:      opts.Stats,
+		hotURL:       opts.HotURL,
+		sourceMapOut: opts.SourceMap,
+		sourceMapURL: opts.SourceMapURL,
+	}
+	if opts.SourceMap != nil {
+		writer.sourceMap = newSourceMap("")
+	}
+	return writer
+}
+
+// Has `Open` define the helpers any of these sources call
+func (w *Writer) useHelpers(srcs ...[]byte) {
+	if w.helpers == nil {
+		w.helpers = make(map[string]bool)
+	}
+	for _, helper := range bundleHelpers {
+		for _, src := range srcs {
+			if bytes.Contains(src, []byte(helper.name)) {
+				w.helpers[helper.name] = true
+				break
+			}
+		}
+	}
 }
 
 func (w *Writer) Open() error {
@@ -49,14 +153,47 @@ func (w *Writer) OpenWithEnvironment(environment *string) error {
 		env = "undefined"
 	}
 
+	// The URL is quoted as JSON, which is also a Javascript string
+	hotURL, err := json.Marshal(w.hotURL)
+	if err != nil {
+		return err
+	}
+	// A module replaced while hot may use any helper
+	var helpers []string
+	for _, helper := range bundleHelpers {
+		if w.helpers[helper.name] || w.hotURL != "" {
+			helpers = append(helpers, helper.src)
+		}
+	}
+
 	entry := struct {
 		Environment string
-	}{env}
+		Helpers     []string
+		Hot         bool
+		HotURL      string
+	}{env, helpers, w.hotURL != "", string(hotURL)}
 
-	if err := preambleTemplate.Execute(w.w, entry); err != nil {
+	src := &bytes.Buffer{}
+	if err := preambleTemplate.Execute(src, entry); err != nil {
 		return err
 	}
-	_, err := fmt.Fprint(w.w, "({")
+
+	if w.minify {
+		program, err := parseProgram(src.Bytes(), "preamble.js")
+		if err != nil {
+			return err
+		}
+		min, err := minifyScript(src.Bytes(), "preamble.js", program)
+		if err != nil {
+			return err
+		}
+		src = bytes.NewBuffer(min)
+	}
+
+	if _, err := src.WriteTo(w.w); err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w.w, "({")
 	return err
 }
 
@@ -64,17 +201,60 @@ func (w *Writer) Close() error {
 	// Close the object of modules, and pass the other two arguments to the anon
 	// function defined in the preamble (module cache, and starting module index
 	// -- always 0).
-	_, err := fmt.Fprint(w.w, "},{},[0]);")
+	if _, err := fmt.Fprint(w.w, "},{},[0]);"); err != nil {
+		return err
+	}
+
+	if w.sourceMap == nil {
+		return nil
+	}
+	if w.sourceMapURL != "" {
+		_, err := fmt.Fprintf(w.w, "\n//# sourceMappingURL=%s\n", w.sourceMapURL)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.sourceMap.WriteTo(w.sourceMapOut)
 	return err
 }
 
-func (w *Writer) Write(src io.Reader, id int, deps map[string]*srcEntry) error {
+// Writes a module. The parsed program is only needed to minify, and may be nil,
+// in which case names are left as they are.
+func (w *Writer) Write(path string, src []byte, program *ast.Program, id int,
+	deps map[string]*srcEntry) error {
+
+	return w.WriteBody(&moduleBody{
+		src:     src,
+		program: program,
+		sources: []bodySource{{path, src}},
+	}, id, deps)
+}
+
+// Writes a module whose body may have been put together from several sources
+func (w *Writer) WriteBody(body *moduleBody, id int,
+	deps map[string]*srcEntry) error {
+
 	// Serialize imports as a json object
 	importsMap, err := w.importsMap(deps)
 	if err != nil {
 		return err
 	}
 
+	path := body.sources[0].path
+	if w.minify {
+		min, err := minifyModule(body.src, path, body.program)
+		if err == nil {
+			return w.writeMinified(body, min, id, importsMap)
+		}
+		// Not being able to minify a module shouldn't stop the build
+		log.Printf("not minifying %s: %s", path, err)
+	}
+
+	var minifiedSize int
+	if w.measure {
+		minifiedSize = w.minifiedSize(body, id, importsMap)
+	}
+
 	entry := struct {
 		Id      int
 		Imports string
@@ -94,12 +274,24 @@ func (w *Writer) Write(src io.Reader, id int, deps map[string]*srcEntry) error {
 	}
 
 	// Write entry preamble
+	start := w.w.offset
 	if err = entryPre.Execute(w.w, entry); err != nil {
 		return err
 	}
 
-	// Write entry body
-	if _, err = io.Copy(w.w, src); err != nil {
+	// Write entry body, mapping each of its lines back to the source
+	if w.sourceMap != nil {
+		sources := w.addSources(body)
+		if body.origins == nil {
+			w.sourceMap.AddLines(w.w.line, sources[0], body.src)
+		} else {
+			for i, origin := range body.origins {
+				w.sourceMap.AddMapping(
+					w.w.line+i, 0, sources[origin.source], origin.line, 0, "")
+			}
+		}
+	}
+	if _, err = w.w.Write(body.src); err != nil {
 		return err
 	}
 
@@ -108,9 +300,80 @@ func (w *Writer) Write(src io.Reader, id int, deps map[string]*srcEntry) error {
 		return err
 	}
 
+	if minifiedSize < 0 {
+		minifiedSize = w.w.offset - start
+	}
+	w.written(id, path, start, minifiedSize)
+	return nil
+}
+
+func (w *Writer) written(id int, path string, start, minifiedSize int) {
+	w.modules = append(w.modules,
+		WrittenModule{id, path, start, w.w.offset, minifiedSize})
+}
+
+// Works out how big a module would be minified, by minifying it to nowhere.
+// This gives -1 for a module which can't be minified.
+func (w *Writer) minifiedSize(body *moduleBody, id int,
+	importsMap string) int {
+
+	min, err := minifyModule(body.src, body.sources[0].path, body.program)
+	if err != nil {
+		return -1
+	}
+	counter := &Writer{w: &positionWriter{w: ioutil.Discard}, firstModule: true}
+	if err := counter.writeMinified(body, min, id, importsMap); err != nil {
+		return -1
+	}
+	return counter.w.offset
+}
+
+// Writes a minified module, with the shortest wrapper it can get away with
+func (w *Writer) writeMinified(body *moduleBody, min *minified, id int,
+	importsMap string) error {
+
+	sep := ","
+	if w.firstModule {
+		sep = ""
+		w.firstModule = false
+	}
+	if _, err := fmt.Fprint(w.w, sep); err != nil {
+		return err
+	}
+	start := w.w.offset
+	_, err := fmt.Fprintf(w.w, "%d:[function(%s){", id,
+		strings.Join(min.params, ","))
+	if err != nil {
+		return err
+	}
+
+	printer := &compactPrinter{w: w.w, source: -1}
+	if w.sourceMap != nil {
+		printer.sm = w.sourceMap
+		printer.sources = w.addSources(body)
+		printer.source = printer.sources[0]
+		printer.origins = body.origins
+	}
+	if err := printer.Print(min.tokens, min.renames); err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(w.w, "},%s]", importsMap); err != nil {
+		return err
+	}
+	w.written(id, body.sources[0].path, start, w.w.offset-start)
 	return nil
 }
 
+// Adds each source of a module body to the source map, returning their indexes
+func (w *Writer) addSources(body *moduleBody) []int {
+	sources := make([]int, len(body.sources))
+	for i, source := range body.sources {
+		sources[i] = w.sourceMap.AddSource(source.path, source.src)
+	}
+	return sources
+}
+
 func (w *Writer) importsMap(deps map[string]*srcEntry) (string, error) {
 	imports := make(map[string]int, len(deps))
 	for impt, entry := range deps {